@@ -0,0 +1,508 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Kenya's 47 counties as written in the Constitution's First Schedule
+var kenyanCounties = []string{
+	"Mombasa", "Kwale", "Kilifi", "Tana River", "Lamu", "Taita-Taveta", "Garissa", "Wajir",
+	"Mandera", "Marsabit", "Isiolo", "Meru", "Tharaka-Nithi", "Embu", "Kitui", "Machakos",
+	"Makueni", "Nyandarua", "Nyeri", "Kirinyaga", "Murang'a", "Kiambu", "Turkana", "West Pokot",
+	"Samburu", "Trans Nzoia", "Uasin Gishu", "Elgeyo-Marakwet", "Nandi", "Baringo", "Laikipia", "Nakuru",
+	"Narok", "Kajiado", "Kericho", "Bomet", "Kakamega", "Vihiga", "Bungoma", "Busia",
+	"Siaya", "Kisumu", "Homa Bay", "Migori", "Kisii", "Nyamira", "Nairobi",
+}
+
+// County names keyed by their letters only, so "muranga" and "Taita Taveta" still match
+var kenyanCountyKeys = func() map[string]string {
+	keys := make(map[string]string, len(kenyanCounties))
+	for _, county := range kenyanCounties {
+		keys[countyKey(county)] = county
+	}
+	return keys
+}()
+
+func countyKey(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if r >= 'a' && r <= 'z' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Check a county name and return its official spelling. Only Kenyan addresses are checked;
+// an empty country counts as Kenya.
+func validateCounty(county, country string) (string, error) {
+	if country != "" && !strings.EqualFold(strings.TrimSpace(country), "Kenya") {
+		return county, nil
+	}
+	if strings.TrimSpace(county) == "" {
+		return "", errors.New("county is required for addresses in Kenya")
+	}
+	name, ok := kenyanCountyKeys[countyKey(county)]
+	if !ok {
+		return "", fmt.Errorf("county %q is not one of Kenya's 47 counties", county)
+	}
+	return name, nil
+}
+
+// PostalAddress is a structured delivery address, as saved in the address book and snapshotted onto orders
+type PostalAddress struct {
+	FirstName    string `json:"first_name"`
+	LastName     string `json:"last_name"`
+	Company      string `json:"company"`
+	AddressLine1 string `json:"address_line_1"`
+	AddressLine2 string `json:"address_line_2"`
+	City         string `json:"city"`
+	County       string `json:"county"`
+	PostalCode   string `json:"postal_code"`
+	Country      string `json:"country"`
+	Phone        string `json:"phone"`
+}
+
+// Trim and check an address sent with an order. The country defaults to Kenya and
+// Kenyan addresses must name a valid county, which is rewritten to its official spelling.
+func (a *PostalAddress) normalize() error {
+	for _, field := range []*string{&a.FirstName, &a.LastName, &a.Company, &a.AddressLine1, &a.AddressLine2, &a.City, &a.County, &a.PostalCode, &a.Country, &a.Phone} {
+		*field = strings.TrimSpace(*field)
+	}
+	if a.Country == "" {
+		a.Country = "Kenya"
+	}
+
+	required := []struct {
+		name  string
+		value string
+	}{
+		{"first_name", a.FirstName},
+		{"last_name", a.LastName},
+		{"address_line_1", a.AddressLine1},
+		{"city", a.City},
+	}
+	for _, field := range required {
+		if field.value == "" {
+			return fmt.Errorf("%s is required", field.name)
+		}
+	}
+
+	county, err := validateCounty(a.County, a.Country)
+	if err != nil {
+		return err
+	}
+	a.County = county
+	return nil
+}
+
+// Single-line form of an address, used as the free-text address on an order
+func (a *PostalAddress) Format() string {
+	parts := []string{strings.TrimSpace(a.FirstName + " " + a.LastName)}
+	for _, part := range []string{a.Company, a.AddressLine1, a.AddressLine2, a.City, a.County, a.PostalCode, a.Country, a.Phone} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Values for the orders.shipping_* columns, first_name through phone. Empty fields
+// (and a nil address) are stored as NULL.
+func (a *PostalAddress) columnValues() []interface{} {
+	values := make([]interface{}, 10)
+	if a == nil {
+		return values
+	}
+	for i, field := range []string{a.FirstName, a.LastName, a.Company, a.AddressLine1, a.AddressLine2, a.City, a.County, a.PostalCode, a.Country, a.Phone} {
+		if field != "" {
+			values[i] = field
+		}
+	}
+	return values
+}
+
+// Address is a saved shipping or billing address in a user's address book
+type Address struct {
+	ID     int    `json:"id"`
+	UserID int    `json:"user_id"`
+	Type   string `json:"type"` // "shipping" or "billing"
+	PostalAddress
+	IsDefault bool      `json:"is_default"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// AddressRequest creates an address, or partially updates one when fields are omitted
+type AddressRequest struct {
+	Type         *string `json:"type,omitempty"`
+	FirstName    *string `json:"first_name,omitempty"`
+	LastName     *string `json:"last_name,omitempty"`
+	Company      *string `json:"company,omitempty"`
+	AddressLine1 *string `json:"address_line_1,omitempty"`
+	AddressLine2 *string `json:"address_line_2,omitempty"`
+	City         *string `json:"city,omitempty"`
+	County       *string `json:"county,omitempty"`
+	PostalCode   *string `json:"postal_code,omitempty"`
+	Country      *string `json:"country,omitempty"`
+	Phone        *string `json:"phone,omitempty"`
+	IsDefault    *bool   `json:"is_default,omitempty"`
+}
+
+// Validate the fields that are present; when creating, the required ones must be present too.
+// A Kenyan county is rewritten to its official spelling. Updates check the county in
+// updateUserAddress, against the stored address merged with the request.
+func (r *AddressRequest) validate(creating bool) error {
+	if r.Type != nil && *r.Type != "shipping" && *r.Type != "billing" {
+		return errors.New("type must be 'shipping' or 'billing'")
+	}
+
+	required := []struct {
+		name  string
+		value *string
+	}{
+		{"first_name", r.FirstName},
+		{"last_name", r.LastName},
+		{"address_line_1", r.AddressLine1},
+		{"city", r.City},
+	}
+	for _, field := range required {
+		if field.value == nil {
+			if creating {
+				return fmt.Errorf("%s is required", field.name)
+			}
+			continue
+		}
+		if strings.TrimSpace(*field.value) == "" {
+			return fmt.Errorf("%s cannot be empty", field.name)
+		}
+	}
+
+	if creating {
+		county, country := "", ""
+		if r.County != nil {
+			county = *r.County
+		}
+		if r.Country != nil {
+			country = *r.Country
+		}
+		county, err := validateCounty(county, country)
+		if err != nil {
+			return err
+		}
+		if county != "" {
+			r.County = &county
+		}
+	}
+
+	return nil
+}
+
+// Check an update's county and country merged over the stored ones, so changing only
+// one of them still leaves a valid pair. A Kenyan county is rewritten to its official spelling.
+func (r *AddressRequest) validateCountyUpdate(currentCounty, currentCountry string) error {
+	if r.County == nil && r.Country == nil {
+		return nil
+	}
+
+	county, country := currentCounty, currentCountry
+	if r.County != nil {
+		county = *r.County
+	}
+	if r.Country != nil {
+		country = *r.Country
+	}
+	county, err := validateCounty(county, country)
+	if err != nil {
+		return err
+	}
+	if county != "" {
+		r.County = &county
+	}
+	return nil
+}
+
+const addressColumns = `
+	id, user_id, type, first_name, last_name, COALESCE(company, ''),
+	address_line_1, COALESCE(address_line_2, ''), city, COALESCE(county, ''),
+	COALESCE(postal_code, ''), COALESCE(country, ''), COALESCE(phone, ''),
+	is_default, created_at, updated_at
+`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAddress(row rowScanner) (*Address, error) {
+	var a Address
+	err := row.Scan(
+		&a.ID, &a.UserID, &a.Type, &a.FirstName, &a.LastName, &a.Company,
+		&a.AddressLine1, &a.AddressLine2, &a.City, &a.County,
+		&a.PostalCode, &a.Country, &a.Phone,
+		&a.IsDefault, &a.CreatedAt, &a.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Get a user's addresses, defaults first
+func getUserAddresses(userID int) ([]Address, error) {
+	rows, err := db.Query(`
+		SELECT `+addressColumns+`
+		FROM auth.user_addresses
+		WHERE user_id = $1
+		ORDER BY type, is_default DESC, created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses := []Address{}
+	for rows.Next() {
+		address, err := scanAddress(rows)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, *address)
+	}
+
+	return addresses, rows.Err()
+}
+
+// Get one of a user's addresses; another user's address is reported as not found
+func getUserAddress(userID, addressID int) (*Address, error) {
+	return scanAddress(db.QueryRow(`
+		SELECT `+addressColumns+`
+		FROM auth.user_addresses
+		WHERE id = $1 AND user_id = $2
+	`, addressID, userID))
+}
+
+// Clear the current default of a type so another address can take it
+func clearDefaultAddress(tx *sql.Tx, userID int, addressType string, exceptID int) error {
+	_, err := tx.Exec(`
+		UPDATE auth.user_addresses SET is_default = false, updated_at = NOW()
+		WHERE user_id = $1 AND type = $2 AND is_default AND id <> $3
+	`, userID, addressType, exceptID)
+	return err
+}
+
+// Save a new address. The first address of a type becomes the default automatically.
+func createUserAddress(userID int, req *AddressRequest) (*Address, error) {
+	addressType := "shipping"
+	if req.Type != nil {
+		addressType = *req.Type
+	}
+	country := "Kenya"
+	if req.Country != nil && *req.Country != "" {
+		country = *req.Country
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var existing int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM auth.user_addresses WHERE user_id = $1 AND type = $2
+	`, userID, addressType).Scan(&existing)
+	if err != nil {
+		return nil, err
+	}
+
+	isDefault := existing == 0 || (req.IsDefault != nil && *req.IsDefault)
+	if isDefault {
+		if err := clearDefaultAddress(tx, userID, addressType, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	address, err := scanAddress(tx.QueryRow(`
+		INSERT INTO auth.user_addresses (
+			user_id, type, first_name, last_name, company,
+			address_line_1, address_line_2, city, county, postal_code, country, phone, is_default
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING `+addressColumns,
+		userID, addressType, *req.FirstName, *req.LastName, req.Company,
+		*req.AddressLine1, req.AddressLine2, *req.City, req.County, req.PostalCode, country, req.Phone, isDefault,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return address, nil
+}
+
+// AddressValidationError rejects an update whose merged address is invalid
+type AddressValidationError struct {
+	Err error
+}
+
+func (e *AddressValidationError) Error() string {
+	return e.Err.Error()
+}
+
+// Update an address. Making it the default (or moving the default to another type)
+// clears the previous default of that type.
+func updateUserAddress(userID, addressID int, req *AddressRequest) (*Address, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var currentType, currentCounty, currentCountry string
+	var isDefault bool
+	err = tx.QueryRow(`
+		SELECT type, is_default, COALESCE(county, ''), COALESCE(country, '') FROM auth.user_addresses
+		WHERE id = $1 AND user_id = $2
+		FOR UPDATE
+	`, addressID, userID).Scan(&currentType, &isDefault, &currentCounty, &currentCountry)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := req.validateCountyUpdate(currentCounty, currentCountry); err != nil {
+		return nil, &AddressValidationError{Err: err}
+	}
+
+	setParts := []string{}
+	args := []interface{}{}
+	argIndex := 1
+
+	fields := []struct {
+		column string
+		value  *string
+	}{
+		{"first_name", req.FirstName},
+		{"last_name", req.LastName},
+		{"company", req.Company},
+		{"address_line_1", req.AddressLine1},
+		{"address_line_2", req.AddressLine2},
+		{"city", req.City},
+		{"county", req.County},
+		{"postal_code", req.PostalCode},
+		{"country", req.Country},
+		{"phone", req.Phone},
+	}
+	for _, field := range fields {
+		if field.value != nil {
+			setParts = append(setParts, fmt.Sprintf("%s = $%d", field.column, argIndex))
+			args = append(args, *field.value)
+			argIndex++
+		}
+	}
+
+	newType := currentType
+	if req.Type != nil && *req.Type != currentType {
+		newType = *req.Type
+		setParts = append(setParts, fmt.Sprintf("type = $%d", argIndex))
+		args = append(args, newType)
+		argIndex++
+	}
+
+	if req.IsDefault != nil {
+		isDefault = *req.IsDefault
+		setParts = append(setParts, fmt.Sprintf("is_default = $%d", argIndex))
+		args = append(args, isDefault)
+		argIndex++
+	}
+
+	if len(setParts) == 0 {
+		return nil, fmt.Errorf("no fields to update")
+	}
+
+	if isDefault {
+		if err := clearDefaultAddress(tx, userID, newType, addressID); err != nil {
+			return nil, err
+		}
+	}
+
+	setParts = append(setParts, "updated_at = NOW()")
+	args = append(args, addressID, userID)
+
+	query := fmt.Sprintf(`
+		UPDATE auth.user_addresses
+		SET %s
+		WHERE id = $%d AND user_id = $%d
+		RETURNING %s
+	`, strings.Join(setParts, ", "), argIndex, argIndex+1, addressColumns)
+
+	address, err := scanAddress(tx.QueryRow(query, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return address, nil
+}
+
+// Delete an address. If it was a default, the newest remaining address of that type takes over.
+func deleteUserAddress(userID, addressID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var addressType string
+	var wasDefault bool
+	err = tx.QueryRow(`
+		DELETE FROM auth.user_addresses
+		WHERE id = $1 AND user_id = $2
+		RETURNING type, is_default
+	`, addressID, userID).Scan(&addressType, &wasDefault)
+	if err != nil {
+		return err
+	}
+
+	if wasDefault {
+		_, err = tx.Exec(`
+			UPDATE auth.user_addresses SET is_default = true, updated_at = NOW()
+			WHERE id = (
+				SELECT id FROM auth.user_addresses
+				WHERE user_id = $1 AND type = $2
+				ORDER BY created_at DESC, id DESC
+				LIMIT 1
+			)
+		`, userID, addressType)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Look up a user's saved address for copying onto an order
+func savedOrderAddress(userID *int, addressID int) (*PostalAddress, error) {
+	if userID == nil {
+		return nil, errors.New("address not found")
+	}
+	address, err := getUserAddress(*userID, addressID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("address not found")
+		}
+		return nil, err
+	}
+	return &address.PostalAddress, nil
+}
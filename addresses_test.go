@@ -0,0 +1,196 @@
+package main
+
+import "testing"
+
+// TestPostalAddressFormat tests the single-line address copied onto orders
+func TestPostalAddressFormat(t *testing.T) {
+	address := PostalAddress{
+		FirstName:    "Jane",
+		LastName:     "Doe",
+		AddressLine1: "12 Moi Avenue",
+		City:         "Nairobi",
+		County:       "Nairobi",
+		PostalCode:   "00100",
+		Country:      "Kenya",
+		Phone:        "+254700000000",
+	}
+
+	want := "Jane Doe, 12 Moi Avenue, Nairobi, Nairobi, 00100, Kenya, +254700000000"
+	if got := address.Format(); got != want {
+		t.Errorf("Format() = %q, want %q", got, want)
+	}
+}
+
+// TestAddressRequestValidate tests required fields on create and partial updates
+func TestAddressRequestValidate(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	tests := []struct {
+		name     string
+		req      AddressRequest
+		creating bool
+		wantErr  bool
+	}{
+		{
+			name:     "Complete new address",
+			req:      AddressRequest{FirstName: str("Jane"), LastName: str("Doe"), AddressLine1: str("Moi Avenue"), City: str("Nairobi"), County: str("Nairobi")},
+			creating: true,
+		},
+		{
+			name:     "New Kenyan address without county",
+			req:      AddressRequest{FirstName: str("Jane"), LastName: str("Doe"), AddressLine1: str("Moi Avenue"), City: str("Nairobi")},
+			creating: true,
+			wantErr:  true,
+		},
+		{
+			name:     "New foreign address without county",
+			req:      AddressRequest{FirstName: str("Jane"), LastName: str("Doe"), AddressLine1: str("Kampala Road"), City: str("Kampala"), Country: str("Uganda")},
+			creating: true,
+		},
+		{
+			name:     "New address missing last name",
+			req:      AddressRequest{FirstName: str("Jane"), AddressLine1: str("Moi Avenue"), City: str("Nairobi")},
+			creating: true,
+			wantErr:  true,
+		},
+		{
+			name:     "Billing type",
+			req:      AddressRequest{Type: str("billing"), FirstName: str("Jane"), LastName: str("Doe"), AddressLine1: str("Moi Avenue"), City: str("Nairobi"), County: str("Nairobi")},
+			creating: true,
+		},
+		{
+			name:     "Unknown type",
+			req:      AddressRequest{Type: str("office")},
+			creating: false,
+			wantErr:  true,
+		},
+		{
+			name:     "Partial update",
+			req:      AddressRequest{City: str("Mombasa")},
+			creating: false,
+		},
+		{
+			name:     "Update blanking a required field",
+			req:      AddressRequest{AddressLine1: str("  ")},
+			creating: false,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.req.validate(tt.creating)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestValidateCountyUpdate tests partial updates checked against the stored county and country
+func TestValidateCountyUpdate(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	tests := []struct {
+		name                          string
+		req                           AddressRequest
+		currentCounty, currentCountry string
+		wantCounty                    string
+		wantErr                       bool
+	}{
+		{name: "Neither changed", req: AddressRequest{City: str("Mombasa")}, currentCounty: "Nairobi", currentCountry: "Kenya"},
+		{name: "Unknown county", req: AddressRequest{County: str("Gotham")}, currentCounty: "Nairobi", currentCountry: "Kenya", wantErr: true},
+		{name: "County respelled", req: AddressRequest{County: str("muranga")}, currentCountry: "Kenya", wantCounty: "Murang'a"},
+		{name: "Foreign county kept", req: AddressRequest{County: str("Kampala")}, currentCountry: "Uganda", wantCounty: "Kampala"},
+		{name: "Country moved to Kenya", req: AddressRequest{Country: str("Kenya")}, currentCounty: "Kampala", currentCountry: "Uganda", wantErr: true},
+		{name: "Country moved to Kenya with county", req: AddressRequest{Country: str("Kenya"), County: str("Kisumu")}, currentCounty: "Kampala", currentCountry: "Uganda", wantCounty: "Kisumu"},
+		{name: "Stored empty country counts as Kenya", req: AddressRequest{County: str("Gotham")}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.req.validateCountyUpdate(tt.currentCounty, tt.currentCountry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateCountyUpdate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantCounty != "" && (tt.req.County == nil || *tt.req.County != tt.wantCounty) {
+				t.Errorf("County = %v, want %q", tt.req.County, tt.wantCounty)
+			}
+		})
+	}
+}
+
+// TestValidateCounty tests county matching and official spellings
+func TestValidateCounty(t *testing.T) {
+	tests := []struct {
+		county  string
+		country string
+		want    string
+		wantErr bool
+	}{
+		{county: "Nairobi", want: "Nairobi"},
+		{county: "  kisumu ", country: "Kenya", want: "Kisumu"},
+		{county: "muranga", want: "Murang'a"},
+		{county: "Taita Taveta", want: "Taita-Taveta"},
+		{county: "homa-bay", want: "Homa Bay"},
+		{county: "Gotham", wantErr: true},
+		{county: "", wantErr: true},
+		{county: "Wakiso", country: "Uganda", want: "Wakiso"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.county+"/"+tt.country, func(t *testing.T) {
+			got, err := validateCounty(tt.county, tt.country)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateCounty() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("validateCounty() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if len(kenyanCountyKeys) != 47 {
+		t.Errorf("got %d distinct counties, want 47", len(kenyanCountyKeys))
+	}
+}
+
+// TestPostalAddressNormalize tests trimming, defaults and required fields on order addresses
+func TestPostalAddressNormalize(t *testing.T) {
+	address := PostalAddress{
+		FirstName:    " Jane ",
+		LastName:     "Doe",
+		AddressLine1: "12 Moi Avenue",
+		City:         "Mombasa",
+		County:       "mombasa",
+	}
+	if err := address.normalize(); err != nil {
+		t.Fatalf("normalize() error = %v", err)
+	}
+	if address.FirstName != "Jane" || address.County != "Mombasa" || address.Country != "Kenya" {
+		t.Errorf("normalize() = %+v, want trimmed name, official county and country Kenya", address)
+	}
+
+	missing := PostalAddress{FirstName: "Jane", LastName: "Doe", City: "Nairobi", County: "Nairobi"}
+	if err := missing.normalize(); err == nil {
+		t.Error("normalize() without address_line_1 should fail")
+	}
+}
+
+// TestPostalAddressColumnValues tests that empty fields are stored as NULL
+func TestPostalAddressColumnValues(t *testing.T) {
+	var none *PostalAddress
+	for i, v := range none.columnValues() {
+		if v != nil {
+			t.Errorf("nil address value %d = %v, want nil", i, v)
+		}
+	}
+
+	values := (&PostalAddress{FirstName: "Jane", City: "Nairobi"}).columnValues()
+	if len(values) != 10 {
+		t.Fatalf("got %d values, want 10", len(values))
+	}
+	if values[0] != "Jane" || values[5] != "Nairobi" || values[2] != nil {
+		t.Errorf("columnValues() = %v", values)
+	}
+}
@@ -3,7 +3,8 @@ package main
 import (
 	"database/sql"
 	"errors"
-	"os"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -12,18 +13,19 @@ import (
 
 // User struct for authentication
 type User struct {
-	ID            int       `json:"id"`
-	Username      string    `json:"username"`
-	Email         string    `json:"email"`
-	PasswordHash  string    `json:"-"` // Never return password in JSON
-	FirstName     string    `json:"first_name"`
-	LastName      string    `json:"last_name"`
-	Phone         string    `json:"phone"`
-	Role          string    `json:"role"`
-	IsActive      bool      `json:"is_active"`
-	EmailVerified bool      `json:"email_verified"`
-	WalletBalance float64   `json:"wallet_balance"`
-	CreatedAt     time.Time `json:"created_at"`
+	ID            int        `json:"id"`
+	Username      string     `json:"username"`
+	Email         string     `json:"email"`
+	PasswordHash  string     `json:"-"` // Never return password in JSON
+	FirstName     string     `json:"first_name"`
+	LastName      string     `json:"last_name"`
+	Phone         string     `json:"phone"`
+	Role          string     `json:"role"`
+	IsActive      bool       `json:"is_active"`
+	EmailVerified bool       `json:"email_verified"`
+	WalletBalance float64    `json:"wallet_balance"`
+	LastLogin     *time.Time `json:"last_login,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
 }
 
 // WalletTransaction for tracking token movements
@@ -54,12 +56,28 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+// Profile update request; omitted fields are left unchanged
+type UpdateProfileRequest struct {
+	Username  *string `json:"username,omitempty"`
+	FirstName *string `json:"first_name,omitempty"`
+	LastName  *string `json:"last_name,omitempty"`
+	Phone     *string `json:"phone,omitempty"`
+}
+
+// Change password request
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
 // JWT Claims
 type Claims struct {
-	UserID   int    `json:"user_id"`
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Role     string `json:"role"`
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	SessionID int    `json:"sid"`           // server-side session; revoking it invalidates the token
+	MFA       bool   `json:"mfa,omitempty"` // login passed two-factor authentication
 	jwt.RegisteredClaims
 }
 
@@ -75,30 +93,41 @@ func checkPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-// Generate JWT token
-func generateJWT(user *User) (string, error) {
-	// Get JWT secret from environment
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		secret = "your-secret-key" // Default for development
-	}
-
+// Generate short-lived JWT access token for a session
+func generateJWT(user *User, sessionID int, mfaVerified bool) (string, error) {
 	// Create claims
 	claims := Claims{
-		UserID:   user.ID,
-		Username: user.Username,
-		Email:    user.Email,
-		Role:     user.Role,
+		UserID:    user.ID,
+		Username:  user.Username,
+		Email:     user.Email,
+		Role:      user.Role,
+		SessionID: sessionID,
+		MFA:       mfaVerified,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL())),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    "merch-ke-api",
 		},
 	}
 
-	// Create token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+	// Sign with the current key; the kid header tells verifiers which key to use
+	return currentJWTKeys().Sign(claims)
+}
+
+// Parse and validate a JWT access token
+func parseAccessToken(tokenString string) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, currentJWTKeys().Keyfunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid or expired token")
+	}
+
+	claims, ok := token.Claims.(*Claims)
+	if !ok {
+		return nil, errors.New("invalid token claims")
+	}
+
+	return claims, nil
 }
 
 // Create new user in database
@@ -116,21 +145,36 @@ func createUser(req *RegisterRequest) (*User, error) {
 		RETURNING id, username, email, first_name, last_name, phone, role, is_active, email_verified, created_at
 	`
 
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
 	var user User
-	err = db.QueryRow(query, req.Username, req.Email, hashedPassword, req.FirstName, req.LastName, req.Phone).
+	err = tx.QueryRow(query, req.Username, req.Email, hashedPassword, req.FirstName, req.LastName, req.Phone).
 		Scan(&user.ID, &user.Username, &user.Email, &user.FirstName, &user.LastName, &user.Phone, &user.Role, &user.IsActive, &user.EmailVerified, &user.CreatedAt)
 
 	if err != nil {
 		return nil, err
 	}
 
+	// Every account starts with an empty points balance
+	if err = initializeUserPoints(tx, user.ID); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
 	return &user, nil
 }
 
 // Get user by email for login
 func getUserByEmail(email string) (*User, error) {
 	query := `
-		SELECT id, username, email, password_hash, first_name, last_name, phone, role, is_active, email_verified, wallet_balance, created_at
+		SELECT id, username, email, password_hash, first_name, last_name, phone, role, is_active, email_verified, wallet_balance, last_login, created_at
 		FROM auth.users 
 		WHERE email = $1 AND is_active = true
 	`
@@ -139,7 +183,7 @@ func getUserByEmail(email string) (*User, error) {
 	err := db.QueryRow(query, email).Scan(
 		&user.ID, &user.Username, &user.Email, &user.PasswordHash,
 		&user.FirstName, &user.LastName, &user.Phone, &user.Role,
-		&user.IsActive, &user.EmailVerified, &user.WalletBalance, &user.CreatedAt,
+		&user.IsActive, &user.EmailVerified, &user.WalletBalance, &user.LastLogin, &user.CreatedAt,
 	)
 
 	if err != nil {
@@ -155,7 +199,7 @@ func getUserByEmail(email string) (*User, error) {
 // Get user by ID
 func getUserByID(userID int) (*User, error) {
 	query := `
-		SELECT id, username, email, first_name, last_name, phone, role, is_active, email_verified, wallet_balance, created_at
+		SELECT id, username, email, first_name, last_name, phone, role, is_active, email_verified, wallet_balance, last_login, created_at
 		FROM auth.users 
 		WHERE id = $1 AND is_active = true
 	`
@@ -164,7 +208,7 @@ func getUserByID(userID int) (*User, error) {
 	err := db.QueryRow(query, userID).Scan(
 		&user.ID, &user.Username, &user.Email,
 		&user.FirstName, &user.LastName, &user.Phone, &user.Role,
-		&user.IsActive, &user.EmailVerified, &user.WalletBalance, &user.CreatedAt,
+		&user.IsActive, &user.EmailVerified, &user.WalletBalance, &user.LastLogin, &user.CreatedAt,
 	)
 
 	if err != nil {
@@ -177,6 +221,178 @@ func getUserByID(userID int) (*User, error) {
 	return &user, nil
 }
 
+// Update the editable profile fields of a user
+func updateUserProfile(userID int, req *UpdateProfileRequest) (*User, error) {
+	setParts := []string{}
+	args := []interface{}{}
+	argIndex := 1
+
+	if req.Username != nil {
+		setParts = append(setParts, fmt.Sprintf("username = $%d", argIndex))
+		args = append(args, *req.Username)
+		argIndex++
+	}
+	if req.FirstName != nil {
+		setParts = append(setParts, fmt.Sprintf("first_name = $%d", argIndex))
+		args = append(args, *req.FirstName)
+		argIndex++
+	}
+	if req.LastName != nil {
+		setParts = append(setParts, fmt.Sprintf("last_name = $%d", argIndex))
+		args = append(args, *req.LastName)
+		argIndex++
+	}
+	if req.Phone != nil {
+		setParts = append(setParts, fmt.Sprintf("phone = $%d", argIndex))
+		args = append(args, *req.Phone)
+		argIndex++
+	}
+
+	if len(setParts) == 0 {
+		return nil, fmt.Errorf("no fields to update")
+	}
+
+	setParts = append(setParts, "updated_at = NOW()")
+	args = append(args, userID)
+
+	query := fmt.Sprintf(`
+		UPDATE auth.users
+		SET %s
+		WHERE id = $%d AND is_active = true
+	`, strings.Join(setParts, ", "), argIndex)
+
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil, errors.New("user not found")
+	}
+
+	return getUserByID(userID)
+}
+
+// Change a signed-in user's password after checking the current one.
+// Every other session is signed out; the one making the change stays signed in.
+func changeUserPassword(userID, sessionID int, currentPassword, newPassword string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var passwordHash string
+	err = tx.QueryRow(`
+		SELECT password_hash FROM auth.users
+		WHERE id = $1 AND is_active = true
+		FOR UPDATE
+	`, userID).Scan(&passwordHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return errors.New("user not found")
+		}
+		return err
+	}
+
+	if !checkPasswordHash(currentPassword, passwordHash) {
+		return errors.New("current password is incorrect")
+	}
+
+	hashedPassword, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE auth.users SET password_hash = $1, updated_at = NOW() WHERE id = $2`, hashedPassword, userID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := revokeUserSessions(tx, userID, "password_change", &sessionID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Password reset link lifetime, from PASSWORD_RESET_MINUTES (default 60)
+func passwordResetTTL() time.Duration {
+	return time.Duration(getEnvInt("PASSWORD_RESET_MINUTES", 60)) * time.Minute
+}
+
+// Set a new password using a reset token and revoke all of the user's sessions
+func resetPasswordWithToken(token, newPassword string) error {
+	hashedPassword, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeUserToken(tx, "password_reset", token)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE auth.users SET password_hash = $1, updated_at = NOW() WHERE id = $2`, hashedPassword, userID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := revokeUserSessions(tx, userID, "password_reset", nil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Email verification link lifetime, from EMAIL_VERIFICATION_HOURS (default 48)
+func emailVerificationTTL() time.Duration {
+	return time.Duration(getEnvInt("EMAIL_VERIFICATION_HOURS", 48)) * time.Hour
+}
+
+// Create a verification token and email the link to the user
+func sendVerificationEmail(user *User) error {
+	ttl := emailVerificationTTL()
+	token, err := createUserToken(user.ID, "email_verification", ttl)
+	if err != nil {
+		return err
+	}
+
+	sendEmailAsync(EmailMessage{
+		To:      user.Email,
+		Subject: "Verify your Merch Ke email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening the link below:\n\n%s/verify-email?token=%s\n\nThe link expires in %d hours.\n",
+			user.FirstName, appBaseURL(), token, int(ttl.Hours())),
+	})
+	return nil
+}
+
+// Mark a user's email as verified using an emailed token
+func verifyEmailWithToken(token string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeUserToken(tx, "email_verification", token)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE auth.users SET email_verified = true, updated_at = NOW() WHERE id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 // Get wallet balance
 func getWalletBalance(userID int) (float64, error) {
 	var balance float64
@@ -193,11 +409,31 @@ func addWalletTransaction(userID int, amount float64, transactionType, descripti
 	}
 	defer tx.Rollback()
 
+	if _, err := addWalletTransactionTx(tx, userID, amount, transactionType, description, orderID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// InsufficientBalanceError is returned when a debit is larger than the wallet balance
+type InsufficientBalanceError struct {
+	Balance  float64
+	Required float64
+}
+
+func (e *InsufficientBalanceError) Error() string {
+	return "insufficient wallet balance"
+}
+
+// Move tokens in or out of a wallet inside tx (e.g. together with placing an order).
+// Returns the ID of the wallet transaction.
+func addWalletTransactionTx(tx *sql.Tx, userID int, amount float64, transactionType, description string, orderID *int) (int, error) {
 	// Get current balance
 	var currentBalance float64
-	err = tx.QueryRow(`SELECT wallet_balance FROM auth.users WHERE id = $1 FOR UPDATE`, userID).Scan(&currentBalance)
+	err := tx.QueryRow(`SELECT wallet_balance FROM auth.users WHERE id = $1 FOR UPDATE`, userID).Scan(&currentBalance)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Calculate new balance
@@ -207,26 +443,28 @@ func addWalletTransaction(userID int, amount float64, transactionType, descripti
 	} else {
 		newBalance -= amount
 		if newBalance < 0 {
-			return errors.New("insufficient wallet balance")
+			return 0, &InsufficientBalanceError{Balance: currentBalance, Required: amount}
 		}
 	}
 
 	// Update user balance
 	_, err = tx.Exec(`UPDATE auth.users SET wallet_balance = $1 WHERE id = $2`, newBalance, userID)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Insert transaction record
-	_, err = tx.Exec(`
+	var transactionID int
+	err = tx.QueryRow(`
 		INSERT INTO auth.wallet_transactions (user_id, order_id, amount, type, description, balance_after)
 		VALUES ($1, $2, $3, $4, $5, $6)
-	`, userID, orderID, amount, transactionType, description, newBalance)
+		RETURNING id
+	`, userID, orderID, amount, transactionType, description, newBalance).Scan(&transactionID)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return tx.Commit()
+	return transactionID, nil
 }
 
 // Get wallet transactions
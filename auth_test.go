@@ -1,7 +1,6 @@
 package main
 
 import (
-	"os"
 	"testing"
 	"time"
 
@@ -75,10 +74,6 @@ func TestCheckPasswordHash(t *testing.T) {
 
 // TestGenerateJWT tests JWT token generation
 func TestGenerateJWT(t *testing.T) {
-	// Set JWT secret for testing
-	os.Setenv("JWT_SECRET", "test-secret-key-for-unit-testing-purposes-only")
-	defer os.Unsetenv("JWT_SECRET")
-
 	user := &User{
 		ID:       1,
 		Username: "testuser",
@@ -86,7 +81,7 @@ func TestGenerateJWT(t *testing.T) {
 		Role:     "customer",
 	}
 
-	token, err := generateJWT(user)
+	token, err := generateJWT(user, 7, false)
 	if err != nil {
 		t.Fatalf("Failed to generate JWT: %v", err)
 	}
@@ -96,9 +91,7 @@ func TestGenerateJWT(t *testing.T) {
 	}
 
 	// Parse and verify token
-	parsedToken, err := jwt.ParseWithClaims(token, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("JWT_SECRET")), nil
-	})
+	parsedToken, err := jwt.ParseWithClaims(token, &Claims{}, currentJWTKeys().Keyfunc)
 
 	if err != nil {
 		t.Fatalf("Failed to parse JWT: %v", err)
@@ -128,13 +121,18 @@ func TestGenerateJWT(t *testing.T) {
 	if claims.Role != user.Role {
 		t.Errorf("Role = %s, want %s", claims.Role, user.Role)
 	}
-}
 
-// TestGenerateJWTWithDefaultSecret tests JWT generation uses default secret when env var not set
-func TestGenerateJWTWithDefaultSecret(t *testing.T) {
-	// Ensure JWT_SECRET is not set (will use default)
-	os.Unsetenv("JWT_SECRET")
+	if claims.SessionID != 7 {
+		t.Errorf("SessionID = %d, want 7", claims.SessionID)
+	}
+
+	if kid := parsedToken.Header["kid"]; kid != currentJWTKeys().Signing.ID {
+		t.Errorf("kid header = %v, want %s", kid, currentJWTKeys().Signing.ID)
+	}
+}
 
+// TestGenerateJWTWithEphemeralKey tests tokens are signed with a generated Ed25519 key when no key is configured
+func TestGenerateJWTWithEphemeralKey(t *testing.T) {
 	user := &User{
 		ID:       1,
 		Username: "testuser",
@@ -142,22 +140,22 @@ func TestGenerateJWTWithDefaultSecret(t *testing.T) {
 		Role:     "customer",
 	}
 
-	token, err := generateJWT(user)
+	token, err := generateJWT(user, 7, false)
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
 
-	if token == "" {
-		t.Error("Token should not be empty")
+	parsedToken, _, err := jwt.NewParser().ParseUnverified(token, &Claims{})
+	if err != nil {
+		t.Fatalf("Failed to decode token: %v", err)
+	}
+	if alg := parsedToken.Header["alg"]; alg != "EdDSA" {
+		t.Errorf("alg header = %v, want EdDSA", alg)
 	}
 }
 
 // TestParseJWT tests JWT token parsing
 func TestParseJWT(t *testing.T) {
-	// Set JWT secret for testing
-	os.Setenv("JWT_SECRET", "test-secret-key-for-unit-testing-purposes-only")
-	defer os.Unsetenv("JWT_SECRET")
-
 	// Create a valid token
 	user := &User{
 		ID:       1,
@@ -166,12 +164,10 @@ func TestParseJWT(t *testing.T) {
 		Role:     "customer",
 	}
 
-	validToken, _ := generateJWT(user)
+	validToken, _ := generateJWT(user, 7, false)
 
 	// Parse the token
-	parsedToken, err := jwt.ParseWithClaims(validToken, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("JWT_SECRET")), nil
-	})
+	parsedToken, err := jwt.ParseWithClaims(validToken, &Claims{}, currentJWTKeys().Keyfunc)
 
 	if err != nil {
 		t.Fatalf("Failed to parse valid token: %v", err)
@@ -231,3 +227,74 @@ func TestUserStruct(t *testing.T) {
 		t.Error("EmailVerified should be false")
 	}
 }
+
+// TestParseAccessToken tests access token validation and session claim extraction
+func TestParseAccessToken(t *testing.T) {
+	user := &User{ID: 3, Username: "warehouse", Email: "warehouse@example.com", Role: "admin"}
+
+	token, _ := generateJWT(user, 42, false)
+	claims, err := parseAccessToken(token)
+	if err != nil {
+		t.Fatalf("parseAccessToken() error = %v", err)
+	}
+	if claims.UserID != 3 || claims.SessionID != 42 {
+		t.Errorf("claims = user %d session %d, want user 3 session 42", claims.UserID, claims.SessionID)
+	}
+	if claims.MFA {
+		t.Error("MFA claim set for a login without two-factor authentication")
+	}
+
+	mfaToken, _ := generateJWT(user, 42, true)
+	if claims, err := parseAccessToken(mfaToken); err != nil || !claims.MFA {
+		t.Errorf("parseAccessToken() MFA claim missing for a two-factor login (err = %v)", err)
+	}
+
+	// Expired token
+	expiredString, _ := currentJWTKeys().Sign(Claims{
+		UserID:    3,
+		SessionID: 42,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+		},
+	})
+	if _, err := parseAccessToken(expiredString); err == nil {
+		t.Error("parseAccessToken() accepted an expired token")
+	}
+
+	// Shared-secret token claiming to be from our key
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{UserID: 1, Role: "super_admin"})
+	forged.Header["kid"] = currentJWTKeys().Signing.ID
+	forgedString, _ := forged.SignedString([]byte("some-other-secret"))
+	if _, err := parseAccessToken(forgedString); err == nil {
+		t.Error("parseAccessToken() accepted an HS256 token")
+	}
+
+	// Token signed by a key we don't know
+	other, err := newEphemeralKeySet(nil)
+	if err != nil {
+		t.Fatalf("newEphemeralKeySet() error = %v", err)
+	}
+	otherString, _ := other.Sign(Claims{UserID: 1, Role: "super_admin"})
+	if _, err := parseAccessToken(otherString); err == nil {
+		t.Error("parseAccessToken() accepted a token from an unknown key")
+	}
+}
+
+// TestRefreshTokenHashing tests opaque refresh token generation and hashing
+func TestRefreshTokenHashing(t *testing.T) {
+	first, err := generateOpaqueToken()
+	if err != nil {
+		t.Fatalf("generateOpaqueToken() error = %v", err)
+	}
+	second, _ := generateOpaqueToken()
+
+	if first == second {
+		t.Error("generateOpaqueToken() returned the same token twice")
+	}
+	if hashToken(first) != hashToken(first) {
+		t.Error("hashToken() is not deterministic")
+	}
+	if len(hashToken(first)) != 64 || hashToken(first) == first {
+		t.Errorf("hashToken() = %q, want a 64-char sha256 hex digest", hashToken(first))
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors returned by admin account management
+var (
+	errOwnAccountStatus   = errors.New("you can't deactivate your own account")
+	errStaffAccountStatus = errors.New("only a super admin can change a staff account's status")
+)
+
+// Staff accounts (any role but customer) can only be deactivated, reactivated or unlocked
+// by a super admin, so customers:write can't be used to lock out the admins above it
+func canManageAccountStatus(actorRole, targetRole string) bool {
+	return !isStaffRole(targetRole) || actorRole == roleSuperAdmin
+}
+
+// UserSearchParams filters and pages the admin user list
+type UserSearchParams struct {
+	Query  string // matched against names, username, email and phone
+	Role   string // "" for every role
+	Status string // "active", "inactive" or "" for both
+	Page   int    // from 1
+	Limit  int
+}
+
+// Validate the filters and clamp paging to sensible values
+func (p *UserSearchParams) normalize() error {
+	p.Query = strings.TrimSpace(p.Query)
+	if p.Status != "" && p.Status != "active" && p.Status != "inactive" {
+		return errors.New("status must be 'active' or 'inactive'")
+	}
+	if p.Page < 1 {
+		p.Page = 1
+	}
+	if p.Limit <= 0 || p.Limit > 100 {
+		p.Limit = 20
+	}
+	return nil
+}
+
+// LIKE pattern that matches text anywhere, with the query's own wildcards escaped
+func containsPattern(query string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(query)
+	return "%" + escaped + "%"
+}
+
+// Columns read by scanAdminUser, in order. Unlike getUserByID, inactive users are included.
+const adminUserColumns = `
+	id, username, email, COALESCE(first_name, ''), COALESCE(last_name, ''), COALESCE(phone, ''),
+	role, is_active, email_verified, wallet_balance, last_login, created_at
+`
+
+func scanAdminUser(row rowScanner) (*User, error) {
+	var user User
+	err := row.Scan(
+		&user.ID, &user.Username, &user.Email,
+		&user.FirstName, &user.LastName, &user.Phone, &user.Role,
+		&user.IsActive, &user.EmailVerified, &user.WalletBalance, &user.LastLogin, &user.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Search users for the admin area, newest first. Returns one page and the total number of matches.
+func searchUsers(params *UserSearchParams) ([]User, int, error) {
+	conditions := []string{}
+	args := []interface{}{}
+	argIndex := 1
+
+	if params.Query != "" {
+		// Phone numbers are matched without spaces so "0712 345 678" finds "0712345678"
+		conditions = append(conditions, fmt.Sprintf(`(
+			first_name ILIKE $%[1]d OR last_name ILIKE $%[1]d
+			OR CONCAT_WS(' ', first_name, last_name) ILIKE $%[1]d
+			OR username ILIKE $%[1]d OR email ILIKE $%[1]d
+			OR REPLACE(phone, ' ', '') ILIKE $%[2]d
+		)`, argIndex, argIndex+1))
+		args = append(args, containsPattern(params.Query), containsPattern(strings.ReplaceAll(params.Query, " ", "")))
+		argIndex += 2
+	}
+
+	if params.Role != "" {
+		conditions = append(conditions, fmt.Sprintf("role = $%d", argIndex))
+		args = append(args, params.Role)
+		argIndex++
+	}
+
+	switch params.Status {
+	case "active":
+		conditions = append(conditions, "is_active = true")
+	case "inactive":
+		conditions = append(conditions, "is_active = false")
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM auth.users "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM auth.users
+		%s
+		ORDER BY created_at DESC, id DESC
+		LIMIT $%d OFFSET $%d
+	`, adminUserColumns, where, argIndex, argIndex+1)
+	args = append(args, params.Limit, (params.Page-1)*params.Limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanAdminUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, *user)
+	}
+
+	return users, total, rows.Err()
+}
+
+// Get any user, active or not, for the admin area
+func getUserForAdmin(userID int) (*User, error) {
+	user, err := scanAdminUser(db.QueryRow(`
+		SELECT `+adminUserColumns+`
+		FROM auth.users
+		WHERE id = $1
+	`, userID))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("user not found")
+	}
+	return user, err
+}
+
+// CustomerDetail is one user's account with their recent orders, wallet and points
+type CustomerDetail struct {
+	User               *User               `json:"user"`
+	OrderCount         int                 `json:"order_count"`
+	TotalSpent         float64             `json:"total_spent"`
+	RecentOrders       []Order             `json:"recent_orders"`
+	WalletTransactions []WalletTransaction `json:"wallet_transactions"`
+	Points             *PointsSummary      `json:"points"`
+}
+
+// Number of recent orders and wallet transactions shown with a customer
+const customerDetailRecent = 10
+
+// Get a user with the recent activity support staff need to help them
+func getCustomerDetail(userID int) (*CustomerDetail, error) {
+	user, err := getUserForAdmin(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	detail := &CustomerDetail{User: user, RecentOrders: []Order{}}
+
+	err = db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(total_amount) FILTER (WHERE status NOT IN ('cancelled', 'refunded')), 0)
+		FROM orders.orders
+		WHERE user_id = $1
+	`, userID).Scan(&detail.OrderCount, &detail.TotalSpent)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT `+orderColumns+`
+		FROM orders.orders
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, userID, customerDetailRecent)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		detail.RecentOrders = append(detail.RecentOrders, *order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	detail.WalletTransactions, err = getWalletTransactions(userID, customerDetailRecent)
+	if err != nil {
+		return nil, err
+	}
+	if detail.WalletTransactions == nil {
+		detail.WalletTransactions = []WalletTransaction{}
+	}
+
+	detail.Points, err = getPointsSummary(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return detail, nil
+}
+
+// Deactivate or reactivate an account. Deactivating signs the user out everywhere;
+// login already refuses inactive accounts.
+func setUserActive(actorID int, actorRole string, userID int, active bool) (*User, error) {
+	if !active && actorID == userID {
+		return nil, errOwnAccountStatus
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var targetRole string
+	err = tx.QueryRow(`SELECT role FROM auth.users WHERE id = $1 FOR UPDATE`, userID).Scan(&targetRole)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("user not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !canManageAccountStatus(actorRole, targetRole) {
+		return nil, errStaffAccountStatus
+	}
+
+	_, err = tx.Exec(`UPDATE auth.users SET is_active = $1, updated_at = NOW() WHERE id = $2`, active, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !active {
+		if _, err := revokeUserSessions(tx, userID, "account_deactivated", nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return getUserForAdmin(userID)
+}
@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+// TestUserSearchParamsNormalize tests status validation and paging defaults
+func TestUserSearchParamsNormalize(t *testing.T) {
+	tests := []struct {
+		name      string
+		params    UserSearchParams
+		wantErr   bool
+		wantPage  int
+		wantLimit int
+	}{
+		{name: "Defaults", params: UserSearchParams{}, wantPage: 1, wantLimit: 20},
+		{name: "Explicit paging", params: UserSearchParams{Page: 3, Limit: 50}, wantPage: 3, wantLimit: 50},
+		{name: "Limit too large", params: UserSearchParams{Page: 2, Limit: 500}, wantPage: 2, wantLimit: 20},
+		{name: "Negative page", params: UserSearchParams{Page: -4, Limit: 10}, wantPage: 1, wantLimit: 10},
+		{name: "Inactive filter", params: UserSearchParams{Status: "inactive"}, wantPage: 1, wantLimit: 20},
+		{name: "Unknown status", params: UserSearchParams{Status: "banned"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.params.normalize()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tt.params.Page != tt.wantPage || tt.params.Limit != tt.wantLimit {
+				t.Errorf("page/limit = %d/%d, want %d/%d", tt.params.Page, tt.params.Limit, tt.wantPage, tt.wantLimit)
+			}
+		})
+	}
+
+	params := UserSearchParams{Query: "  wanjiku  "}
+	params.normalize()
+	if params.Query != "wanjiku" {
+		t.Errorf("Query = %q, want trimmed", params.Query)
+	}
+}
+
+// TestContainsPattern tests that user input can't inject LIKE wildcards
+func TestContainsPattern(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "wanjiku", want: "%wanjiku%"},
+		{query: "100%", want: `%100\%%`},
+		{query: "first_last", want: `%first\_last%`},
+		{query: `back\slash`, want: `%back\\slash%`},
+	}
+
+	for _, tt := range tests {
+		if got := containsPattern(tt.query); got != tt.want {
+			t.Errorf("containsPattern(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+// TestCanManageAccountStatus tests that only a super admin can change a staff account
+func TestCanManageAccountStatus(t *testing.T) {
+	tests := []struct {
+		actorRole, targetRole string
+		want                  bool
+	}{
+		{actorRole: "support", targetRole: "customer", want: true},
+		{actorRole: "admin", targetRole: "customer", want: true},
+		{actorRole: "support", targetRole: "admin", want: false},
+		{actorRole: "support", targetRole: "support", want: false},
+		{actorRole: "admin", targetRole: "super_admin", want: false},
+		{actorRole: "super_admin", targetRole: "admin", want: true},
+		{actorRole: "super_admin", targetRole: "super_admin", want: true},
+	}
+
+	for _, tt := range tests {
+		if got := canManageAccountStatus(tt.actorRole, tt.targetRole); got != tt.want {
+			t.Errorf("canManageAccountStatus(%q, %q) = %v, want %v", tt.actorRole, tt.targetRole, got, tt.want)
+		}
+	}
+}
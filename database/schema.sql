@@ -71,14 +71,56 @@ CREATE TABLE catalog.product_images (
     file_size INTEGER,
     width INTEGER,
     height INTEGER,
+    thumbnail_url VARCHAR(500),
+    medium_url VARCHAR(500),
     is_primary BOOLEAN DEFAULT false,
     created_at TIMESTAMP DEFAULT NOW()
 );
 
+-- Previous slugs of renamed products and categories, so old URLs can redirect
+CREATE TABLE catalog.slug_history (
+    id SERIAL PRIMARY KEY,
+    entity_type VARCHAR(20) NOT NULL CHECK (entity_type IN ('product', 'category')),
+    entity_id INTEGER NOT NULL,
+    old_slug VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE(entity_type, old_slug)
+);
+
 -- =====================================================
 -- AUTH SCHEMA - Users, Addresses, Points
 -- =====================================================
 
+-- Roles are named sets of admin permissions; auth.users.role names one.
+-- super_admin has every permission implicitly and customer never has any.
+CREATE TABLE auth.roles (
+    name VARCHAR(20) PRIMARY KEY,
+    description VARCHAR(255),
+    is_system BOOLEAN NOT NULL DEFAULT false, -- built-in roles can't be deleted
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE TABLE auth.role_permissions (
+    role_name VARCHAR(20) NOT NULL REFERENCES auth.roles(name) ON DELETE CASCADE,
+    permission VARCHAR(50) NOT NULL CHECK (permission IN ('catalog:write', 'orders:fulfil', 'customers:read', 'customers:write', 'wallet:adjust')),
+    PRIMARY KEY (role_name, permission)
+);
+
+INSERT INTO auth.roles (name, description, is_system) VALUES
+    ('customer', 'Shoppers; no admin access', true),
+    ('admin', 'Store staff with full admin access', true),
+    ('super_admin', 'Every permission, plus managing roles', true),
+    ('warehouse', 'Views and fulfils orders', false);
+
+INSERT INTO auth.role_permissions (role_name, permission) VALUES
+    ('admin', 'catalog:write'),
+    ('admin', 'orders:fulfil'),
+    ('admin', 'customers:read'),
+    ('admin', 'customers:write'),
+    ('admin', 'wallet:adjust'),
+    ('warehouse', 'orders:fulfil');
+
 CREATE TABLE auth.users (
     id SERIAL PRIMARY KEY,
     username VARCHAR(50) UNIQUE NOT NULL,
@@ -87,7 +129,7 @@ CREATE TABLE auth.users (
     first_name VARCHAR(100),
     last_name VARCHAR(100),
     phone VARCHAR(20),
-    role VARCHAR(20) DEFAULT 'customer',
+    role VARCHAR(20) DEFAULT 'customer' REFERENCES auth.roles(name),
     is_active BOOLEAN DEFAULT true,
     email_verified BOOLEAN DEFAULT false,
     wallet_balance DECIMAL(10,2) DEFAULT 1000.00,
@@ -96,10 +138,66 @@ CREATE TABLE auth.users (
     updated_at TIMESTAMP DEFAULT NOW()
 );
 
+-- Login sessions backing refresh tokens; access tokens carry the session id
+CREATE TABLE auth.sessions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+    refresh_token_hash VARCHAR(64) UNIQUE NOT NULL, -- sha256 of the current refresh token
+    previous_token_hash VARCHAR(64), -- last rotated token, kept to detect reuse
+    user_agent VARCHAR(500),
+    ip_address VARCHAR(45),
+    expires_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    revoke_reason VARCHAR(50),
+    mfa_verified BOOLEAN NOT NULL DEFAULT false, -- login passed two-factor authentication
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- TOTP two-factor authentication; enabled_at stays NULL until the first code is confirmed
+CREATE TABLE auth.user_mfa (
+    user_id INTEGER PRIMARY KEY REFERENCES auth.users(id) ON DELETE CASCADE,
+    totp_secret VARCHAR(64) NOT NULL,
+    enabled_at TIMESTAMP,
+    last_used_step BIGINT, -- time step of the last accepted code, so codes can't be replayed
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- One-time 2FA recovery codes; only the sha256 hash is stored
+CREATE TABLE auth.mfa_recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Failed login counters per email and per IP, for backoff and account lockout
+CREATE TABLE auth.login_throttles (
+    id SERIAL PRIMARY KEY,
+    scope VARCHAR(10) NOT NULL CHECK (scope IN ('email', 'ip')),
+    key VARCHAR(255) NOT NULL, -- lower-cased email or client IP
+    failed_attempts INTEGER NOT NULL DEFAULT 0,
+    last_failed_at TIMESTAMP,
+    blocked_until TIMESTAMP,
+    UNIQUE(scope, key)
+);
+
+-- Single-use emailed tokens (password reset, email verification); only the sha256 hash is stored
+CREATE TABLE auth.user_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+    purpose VARCHAR(30) NOT NULL CHECK (purpose IN ('password_reset', 'email_verification', 'mfa_challenge')),
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
 CREATE TABLE auth.user_addresses (
     id SERIAL PRIMARY KEY,
     user_id INTEGER REFERENCES auth.users(id) ON DELETE CASCADE,
-    type VARCHAR(20) DEFAULT 'shipping',
+    type VARCHAR(20) DEFAULT 'shipping' CHECK (type IN ('shipping', 'billing')),
     first_name VARCHAR(100) NOT NULL,
     last_name VARCHAR(100) NOT NULL,
     company VARCHAR(100),
@@ -111,7 +209,8 @@ CREATE TABLE auth.user_addresses (
     country VARCHAR(100) DEFAULT 'Kenya',
     phone VARCHAR(20),
     is_default BOOLEAN DEFAULT false,
-    created_at TIMESTAMP DEFAULT NOW()
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW()
 );
 
 CREATE TABLE auth.user_points (
@@ -128,8 +227,8 @@ CREATE TABLE auth.points_transactions (
     id SERIAL PRIMARY KEY,
     user_id INTEGER REFERENCES auth.users(id) ON DELETE CASCADE,
     order_id INTEGER,
-    transaction_type VARCHAR(20) NOT NULL,
-    points INTEGER NOT NULL,
+    transaction_type VARCHAR(20) NOT NULL, -- 'earned', 'reversed', 'spent', 'restored' or 'expired'
+    points INTEGER NOT NULL, -- signed: negative entries take points away
     description TEXT,
     created_at TIMESTAMP DEFAULT NOW()
 );
@@ -143,7 +242,7 @@ CREATE TABLE orders.orders (
     user_id INTEGER REFERENCES auth.users(id),
     session_id VARCHAR(255),
     order_number VARCHAR(50) UNIQUE NOT NULL,
-    status VARCHAR(20) DEFAULT 'pending',
+    status VARCHAR(20) DEFAULT 'pending' CHECK (status IN ('pending', 'confirmed', 'processing', 'shipped', 'delivered', 'cancelled', 'refunded')),
     payment_status VARCHAR(20) DEFAULT 'pending',
     payment_method VARCHAR(50),
     payment_reference VARCHAR(100),
@@ -151,6 +250,7 @@ CREATE TABLE orders.orders (
     tax_amount DECIMAL(10,2) DEFAULT 0.00,
     shipping_amount DECIMAL(10,2) DEFAULT 0.00,
     discount_amount DECIMAL(10,2) DEFAULT 0.00,
+    points_redeemed INTEGER NOT NULL DEFAULT 0, -- loyalty points behind discount_amount
     total_amount DECIMAL(10,2) NOT NULL,
     notes TEXT,
     shipping_address TEXT,
@@ -166,9 +266,12 @@ CREATE TABLE orders.orders (
     shipping_country VARCHAR(100),
     shipping_phone VARCHAR(20),
     ordered_at TIMESTAMP DEFAULT NOW(),
+    confirmed_at TIMESTAMP,
+    processing_at TIMESTAMP,
     shipped_at TIMESTAMP,
     delivered_at TIMESTAMP,
     cancelled_at TIMESTAMP,
+    refunded_at TIMESTAMP,
     created_at TIMESTAMP DEFAULT NOW(),
     updated_at TIMESTAMP DEFAULT NOW()
 );
@@ -187,24 +290,63 @@ CREATE TABLE orders.order_items (
     created_at TIMESTAMP DEFAULT NOW()
 );
 
+-- Every status an order has been through and who moved it there. Rows are never
+-- updated or deleted (enforced by the trigger below).
+CREATE TABLE orders.order_status_history (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders.orders(id),
+    from_status VARCHAR(20), -- NULL for the entry written when the order is placed
+    to_status VARCHAR(20) NOT NULL,
+    changed_by INTEGER REFERENCES auth.users(id), -- NULL for guests and the system
+    note TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE FUNCTION orders.reject_status_history_change() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'orders.order_status_history is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER order_status_history_append_only
+    BEFORE UPDATE OR DELETE ON orders.order_status_history
+    FOR EACH ROW EXECUTE FUNCTION orders.reject_status_history_change();
+
 CREATE TABLE orders.cart_items (
     id SERIAL PRIMARY KEY,
     user_id INTEGER REFERENCES auth.users(id) ON DELETE CASCADE,
     product_id INTEGER REFERENCES catalog.products(id) ON DELETE CASCADE,
+    variant_id INTEGER NOT NULL REFERENCES catalog.product_variants(id) ON DELETE CASCADE,
     quantity INTEGER NOT NULL DEFAULT 1 CHECK (quantity > 0),
     created_at TIMESTAMP DEFAULT NOW(),
     updated_at TIMESTAMP DEFAULT NOW(),
-    UNIQUE(user_id, product_id)
+    UNIQUE(user_id, variant_id)
 );
 
 CREATE TABLE orders.guest_cart_items (
     id SERIAL PRIMARY KEY,
     session_id VARCHAR(255) NOT NULL,
     product_id INTEGER REFERENCES catalog.products(id) ON DELETE CASCADE,
+    variant_id INTEGER NOT NULL REFERENCES catalog.product_variants(id) ON DELETE CASCADE,
     quantity INTEGER NOT NULL DEFAULT 1 CHECK (quantity > 0),
     created_at TIMESTAMP DEFAULT NOW(),
     updated_at TIMESTAMP DEFAULT NOW(),
-    UNIQUE(session_id, product_id)
+    UNIQUE(session_id, variant_id)
+);
+
+-- Time-limited stock holds taken when a customer starts checkout.
+-- Held quantities are already removed from product_variants.stock_quantity.
+CREATE TABLE orders.stock_reservations (
+    id SERIAL PRIMARY KEY,
+    variant_id INTEGER NOT NULL REFERENCES catalog.product_variants(id) ON DELETE CASCADE,
+    user_id INTEGER REFERENCES auth.users(id) ON DELETE CASCADE,
+    session_id VARCHAR(255),
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    status VARCHAR(20) NOT NULL DEFAULT 'active', -- 'active', 'released' or 'converted'
+    order_id INTEGER REFERENCES orders.orders(id),
+    expires_at TIMESTAMP NOT NULL,
+    released_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
 );
 
 -- =====================================================
@@ -229,14 +371,23 @@ CREATE INDEX idx_catalog_products_fulltext ON catalog.products
 
 -- Auth indexes
 CREATE INDEX idx_auth_addresses_user ON auth.user_addresses(user_id);
+CREATE UNIQUE INDEX idx_auth_addresses_default ON auth.user_addresses(user_id, type) WHERE is_default; -- one default per type
+CREATE INDEX idx_auth_sessions_user ON auth.sessions(user_id) WHERE revoked_at IS NULL;
+CREATE INDEX idx_auth_sessions_previous_token ON auth.sessions(previous_token_hash);
+CREATE INDEX idx_auth_user_tokens_user ON auth.user_tokens(user_id, purpose) WHERE used_at IS NULL;
+CREATE INDEX idx_auth_mfa_recovery_codes_user ON auth.mfa_recovery_codes(user_id, code_hash) WHERE used_at IS NULL;
 CREATE INDEX idx_auth_users_lower_email ON auth.users (lower(email));
-CREATE INDEX idx_auth_points_transactions_user ON auth.points_transactions(user_id);
+CREATE INDEX idx_auth_users_role ON auth.users(role, created_at DESC); -- admin user lists
+CREATE INDEX idx_auth_points_transactions_user ON auth.points_transactions(user_id, created_at DESC); -- points history
 CREATE INDEX idx_auth_points_transactions_order ON auth.points_transactions(order_id);
+-- Each kind of entry (earning, redemption and their reversals) is written at most once per order
+CREATE UNIQUE INDEX idx_auth_points_transactions_order_type ON auth.points_transactions(order_id, transaction_type) WHERE order_id IS NOT NULL;
 
 -- Orders indexes
 CREATE INDEX idx_orders_user ON orders.orders(user_id);
 CREATE INDEX idx_orders_session ON orders.orders(session_id);
 CREATE INDEX idx_orders_status ON orders.orders(status);
+CREATE INDEX idx_orders_status_history_order ON orders.order_status_history(order_id, created_at);
 CREATE INDEX idx_orders_ordered_at ON orders.orders(ordered_at);
 
 CREATE INDEX idx_orders_order_items_order ON orders.order_items(order_id);
@@ -244,8 +395,14 @@ CREATE INDEX idx_orders_order_items_variant ON orders.order_items(variant_id);
 
 CREATE INDEX idx_orders_cart_user ON orders.cart_items(user_id);
 CREATE INDEX idx_orders_cart_product ON orders.cart_items(product_id);
+CREATE INDEX idx_orders_cart_variant ON orders.cart_items(variant_id);
+CREATE INDEX idx_orders_guest_cart_variant ON orders.guest_cart_items(variant_id);
 CREATE INDEX idx_orders_guest_cart_session ON orders.guest_cart_items(session_id);
 
+CREATE INDEX idx_orders_reservations_expiry ON orders.stock_reservations(expires_at) WHERE status = 'active';
+CREATE INDEX idx_orders_reservations_user ON orders.stock_reservations(user_id) WHERE status = 'active';
+CREATE INDEX idx_orders_reservations_session ON orders.stock_reservations(session_id) WHERE status = 'active';
+
 -- Partial index for active products
 CREATE INDEX idx_catalog_products_active_slug ON catalog.products (slug) WHERE is_active;
 
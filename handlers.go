@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"log"
+	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/valyala/fasthttp"
 )
 
 // Register handler
@@ -49,56 +54,663 @@ func registerHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	// Generate JWT token
-	token, err := generateJWT(user)
+	// Email a verification link; the account works without it, so don't fail registration
+	if err := sendVerificationEmail(user); err != nil {
+		log.Printf("⚠️  Failed to send verification email to user %d: %v", user.ID, err)
+	}
+
+	// Start a session and issue tokens
+	tokens, err := issueSessionTokens(user, c.Get(fiber.HeaderUserAgent), clientIP(c), false)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to generate token",
+		})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"message":       "User registered successfully",
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	})
+}
+
+// Login handler
+func loginHandler(c *fiber.Ctx) error {
+	var req LoginRequest
+
+	// Parse request body
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Basic validation
+	if req.Email == "" || req.Password == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Email and password are required",
+		})
+	}
+
+	// Refuse attempts while this email or IP is backing off or locked out, without checking the
+	// password. Otherwise the attempt counts as a failure until the password proves correct.
+	throttle, err := claimLoginAttempt(req.Email, clientIP(c))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to check login attempts",
+			"details": err.Error(),
+		})
+	}
+	if throttle != nil {
+		return loginThrottledResponse(c, throttle)
+	}
+
+	// Get user by email and check password
+	user, err := getUserByEmail(req.Email)
+	if err != nil || !checkPasswordHash(req.Password, user.PasswordHash) {
+		return c.Status(401).JSON(fiber.Map{
+			"error": "Invalid credentials",
+		})
+	}
+	if err := releaseLoginAttempt(req.Email, clientIP(c)); err != nil {
+		log.Printf("⚠️  Failed to release login attempt: %v", err)
+	}
+
+	// Accounts with two-factor authentication get a short-lived challenge instead of tokens
+	mfaEnabled, err := isMFAEnabled(user.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to check two-factor authentication",
+			"details": err.Error(),
+		})
+	}
+	if mfaEnabled {
+		ttl := mfaChallengeTTL()
+		challenge, err := createUserToken(user.ID, "mfa_challenge", ttl)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error":   "Failed to start two-factor login",
+				"details": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"message":      "Two-factor code required",
+			"mfa_required": true,
+			"mfa_token":    challenge,
+			"expires_in":   int(ttl.Seconds()),
+		})
+	}
+
+	if err := recordSuccessfulLogin(user); err != nil {
+		log.Printf("⚠️  Failed to record login for user %d: %v", user.ID, err)
+	}
+
+	// Start a session and issue tokens
+	tokens, err := issueSessionTokens(user, c.Get(fiber.HeaderUserAgent), clientIP(c), false)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to generate token",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":       "Login successful",
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	})
+}
+
+// 429 telling the client how long to wait before logging in again
+func loginThrottledResponse(c *fiber.Ctx, throttle *LoginThrottle) error {
+	retryAfter := int(throttle.RetryAfter.Seconds()) + 1
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+
+	if throttle.Locked {
+		return c.Status(429).JSON(fiber.Map{
+			"error":       "Account temporarily locked after too many failed login attempts",
+			"code":        "account_locked",
+			"retry_after": retryAfter,
+		})
+	}
+	return c.Status(429).JSON(fiber.Map{
+		"error":       "Too many failed login attempts. Please wait before trying again.",
+		"code":        "login_backoff",
+		"retry_after": retryAfter,
+	})
+}
+
+// RefreshRequest carries the refresh token to exchange
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Refresh handler - exchange a refresh token for a new token pair
+func refreshTokenHandler(c *fiber.Ctx) error {
+	var req RefreshRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.RefreshToken == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "refresh_token is required",
+		})
+	}
+
+	tokens, err := rotateRefreshToken(req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, errRefreshTokenReused) {
+			return c.Status(401).JSON(fiber.Map{
+				"error": "Refresh token has already been used. The session has been revoked; please log in again.",
+			})
+		}
+		if errors.Is(err, errInvalidRefreshToken) {
+			return c.Status(401).JSON(fiber.Map{
+				"error": "Invalid or expired refresh token",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to refresh token",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	})
+}
+
+// Logout handler - revoke the current session, or every session with ?all=true
+func logoutHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+	sessionID := c.Locals("sessionID").(int)
+
+	if c.QueryBool("all", false) {
+		revoked, err := revokeUserSessions(db, userID, "logout_all", nil)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error":   "Failed to log out",
+				"details": err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"message":          "Logged out of all sessions",
+			"sessions_revoked": revoked,
+		})
+	}
+
+	if err := revokeSession(userID, sessionID, "logout"); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to log out",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Logged out successfully",
+	})
+}
+
+// ForgotPasswordRequest starts a password reset
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// ResetPasswordRequest completes a password reset
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// Forgot password handler - email a reset link if the account exists
+func forgotPasswordHandler(c *fiber.Ctx) error {
+	var req ForgotPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if strings.TrimSpace(req.Email) == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Email is required",
+		})
+	}
+
+	// Same response whether or not the account exists, so emails can't be enumerated
+	response := fiber.Map{
+		"message": "If an account exists for that email, a password reset link has been sent",
+	}
+
+	user, err := getUserByEmail(strings.TrimSpace(req.Email))
+	if err != nil {
+		if err.Error() == "user not found" {
+			return c.JSON(response)
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to start password reset",
+			"details": err.Error(),
+		})
+	}
+
+	ttl := passwordResetTTL()
+	token, err := createUserToken(user.ID, "password_reset", ttl)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to start password reset",
+			"details": err.Error(),
+		})
+	}
+
+	sendEmailAsync(EmailMessage{
+		To:      user.Email,
+		Subject: "Reset your Merch Ke password",
+		Body: fmt.Sprintf("Hi %s,\n\nWe received a request to reset your password. Open the link below to choose a new one:\n\n%s/reset-password?token=%s\n\nThe link expires in %d minutes and can only be used once. If you didn't ask for this, you can ignore this email.\n",
+			user.FirstName, appBaseURL(), token, int(ttl.Minutes())),
+	})
+
+	return c.JSON(response)
+}
+
+// Reset password handler - set a new password with an emailed token
+func resetPasswordHandler(c *fiber.Ctx) error {
+	var req ResetPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.Token == "" || req.Password == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Token and password are required",
+		})
+	}
+
+	if len(req.Password) < 6 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Password must be at least 6 characters long",
+		})
+	}
+
+	if err := resetPasswordWithToken(req.Token, req.Password); err != nil {
+		if errors.Is(err, errInvalidUserToken) {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Reset link is invalid or has expired",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to reset password",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Password has been reset. Please log in with your new password.",
+	})
+}
+
+// VerifyEmailRequest carries the token from the verification email
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// Verify email handler - confirm an email address with an emailed token
+func verifyEmailHandler(c *fiber.Ctx) error {
+	var req VerifyEmailRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.Token == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Token is required",
+		})
+	}
+
+	if err := verifyEmailWithToken(req.Token); err != nil {
+		if errors.Is(err, errInvalidUserToken) {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Verification link is invalid or has expired",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to verify email",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Email verified successfully",
+	})
+}
+
+// Resend verification handler - email a fresh verification link
+func resendVerificationHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	user, err := getUserByID(userID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	if user.EmailVerified {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Email is already verified",
+		})
+	}
+
+	if err := sendVerificationEmail(user); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to send verification email",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Verification email sent",
+	})
+}
+
+// Profile handler (protected route)
+func profileHandler(c *fiber.Ctx) error {
+	// Get user from context (set by auth middleware)
+	userID := c.Locals("userID").(int)
+
+	user, err := getUserByID(userID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"user": user,
+	})
+}
+
+// Update profile handler - change name, username or phone
+func updateProfileHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	var req UpdateProfileRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.Username != nil && strings.TrimSpace(*req.Username) == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Username cannot be empty",
+		})
+	}
+
+	user, err := updateUserProfile(userID, &req)
+	if err != nil {
+		if err.Error() == "no fields to update" {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "No fields provided for update",
+			})
+		}
+		if err.Error() == "user not found" {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		if strings.Contains(err.Error(), "duplicate key") {
+			return c.Status(409).JSON(fiber.Map{
+				"error": "Username is already taken",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to update profile",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Profile updated successfully",
+		"user":    user,
+	})
+}
+
+// Change password handler - requires the current password; other sessions are signed out
+func changePasswordHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+	sessionID := c.Locals("sessionID").(int)
+
+	var req ChangePasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Current password and new password are required",
+		})
+	}
+
+	if len(req.NewPassword) < 6 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Password must be at least 6 characters long",
+		})
+	}
+
+	if err := changeUserPassword(userID, sessionID, req.CurrentPassword, req.NewPassword); err != nil {
+		if err.Error() == "current password is incorrect" {
+			return c.Status(401).JSON(fiber.Map{
+				"error": "Current password is incorrect",
+			})
+		}
+		if err.Error() == "user not found" {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to change password",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Password changed successfully. Other sessions have been signed out.",
+	})
+}
+
+// MFAVerifyRequest is the second login step: the challenge from login plus an authenticator or recovery code
+type MFAVerifyRequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// MFACodeRequest carries a code for enabling or disabling two-factor authentication
+type MFACodeRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// Two-factor login handler - exchange the login challenge and a code for tokens
+func mfaVerifyHandler(c *fiber.Ctx) error {
+	var req MFAVerifyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.MFAToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "mfa_token and a code or recovery_code are required",
+		})
+	}
+
+	userID, err := peekUserToken("mfa_challenge", req.MFAToken)
+	if err != nil {
+		if errors.Is(err, errInvalidUserToken) {
+			return c.Status(401).JSON(fiber.Map{
+				"error": "Two-factor challenge is invalid or has expired. Please log in again.",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to check two-factor challenge",
+			"details": err.Error(),
+		})
+	}
+
+	user, err := getUserByID(userID)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{
+			"error": "Invalid credentials",
+		})
+	}
+
+	// Wrong codes count as failed logins, so guessing codes hits the same backoff and lockout
+	throttle, err := claimLoginAttempt(user.Email, clientIP(c))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to check login attempts",
+			"details": err.Error(),
+		})
+	}
+	if throttle != nil {
+		return loginThrottledResponse(c, throttle)
+	}
+
+	err = completeMFALogin(req.MFAToken, userID, req.Code, req.RecoveryCode)
+	if !errors.Is(err, errInvalidMFACode) {
+		// Only a wrong code is a failed attempt
+		if err := releaseLoginAttempt(user.Email, clientIP(c)); err != nil {
+			log.Printf("⚠️  Failed to release login attempt: %v", err)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, errInvalidMFACode) {
+			return c.Status(401).JSON(fiber.Map{
+				"error": "Invalid two-factor code",
+			})
+		}
+		if errors.Is(err, errInvalidUserToken) || errors.Is(err, errMFANotEnabled) {
+			return c.Status(401).JSON(fiber.Map{
+				"error": "Two-factor challenge is invalid or has expired. Please log in again.",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to verify two-factor code",
+			"details": err.Error(),
+		})
+	}
+
+	if err := recordSuccessfulLogin(user); err != nil {
+		log.Printf("⚠️  Failed to record login for user %d: %v", user.ID, err)
+	}
+
+	tokens, err := issueSessionTokens(user, c.Get(fiber.HeaderUserAgent), clientIP(c), true)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to generate token",
 		})
 	}
 
-	return c.Status(201).JSON(fiber.Map{
-		"message": "User registered successfully",
-		"user":    user,
-		"token":   token,
+	return c.JSON(fiber.Map{
+		"message":       "Login successful",
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
 	})
 }
 
-// Login handler
-func loginHandler(c *fiber.Ctx) error {
-	var req LoginRequest
+// Two-factor setup handler - create a secret for the authenticator app
+func mfaSetupHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+	email := c.Locals("email").(string)
 
-	// Parse request body
+	secret, err := beginMFASetup(userID)
+	if err != nil {
+		if errors.Is(err, errMFAAlreadyOn) {
+			return c.Status(409).JSON(fiber.Map{
+				"error": "Two-factor authentication is already enabled",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to start two-factor setup",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":          "Scan the provisioning URI with your authenticator app, then confirm with a code",
+		"secret":           secret,
+		"provisioning_uri": totpProvisioningURI(totpIssuer(), email, secret),
+	})
+}
+
+// Two-factor enable handler - confirm setup with a code and receive recovery codes
+func mfaEnableHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+	sessionID := c.Locals("sessionID").(int)
+
+	var req MFACodeRequest
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{
 			"error": "Invalid request body",
 		})
 	}
 
-	// Basic validation
-	if req.Email == "" || req.Password == "" {
+	if req.Code == "" {
 		return c.Status(400).JSON(fiber.Map{
-			"error": "Email and password are required",
+			"error": "code is required",
 		})
 	}
 
-	// Get user by email
-	user, err := getUserByEmail(req.Email)
+	recoveryCodes, err := enableMFA(userID, sessionID, req.Code)
 	if err != nil {
-		return c.Status(401).JSON(fiber.Map{
-			"error": "Invalid credentials",
+		switch {
+		case errors.Is(err, errInvalidMFACode):
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid two-factor code",
+			})
+		case errors.Is(err, errMFASetupMissing):
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Start two-factor setup first",
+			})
+		case errors.Is(err, errMFAAlreadyOn):
+			return c.Status(409).JSON(fiber.Map{
+				"error": "Two-factor authentication is already enabled",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to enable two-factor authentication",
+			"details": err.Error(),
 		})
 	}
 
-	// Check password
-	if !checkPasswordHash(req.Password, user.PasswordHash) {
-		return c.Status(401).JSON(fiber.Map{
-			"error": "Invalid credentials",
+	// This session just proved the second factor, so hand back a token that says so
+	user, err := getUserByID(userID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "User not found",
 		})
 	}
-
-	// Generate JWT token
-	token, err := generateJWT(user)
+	token, err := generateJWT(user, sessionID, true)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to generate token",
@@ -106,26 +718,57 @@ func loginHandler(c *fiber.Ctx) error {
 	}
 
 	return c.JSON(fiber.Map{
-		"message": "Login successful",
-		"user":    user,
-		"token":   token,
+		"message":        "Two-factor authentication enabled. Store these recovery codes somewhere safe; they won't be shown again.",
+		"recovery_codes": recoveryCodes,
+		"token":          token,
+		"expires_in":     int(accessTokenTTL().Seconds()),
 	})
 }
 
-// Profile handler (protected route)
-func profileHandler(c *fiber.Ctx) error {
-	// Get user from context (set by auth middleware)
+// Two-factor disable handler - requires the password and a current code or recovery code
+func mfaDisableHandler(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(int)
+	email := c.Locals("email").(string)
 
-	user, err := getUserByID(userID)
-	if err != nil {
-		return c.Status(404).JSON(fiber.Map{
-			"error": "User not found",
+	var req MFACodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.Password == "" || (req.Code == "" && req.RecoveryCode == "") {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "password and a code or recovery_code are required",
+		})
+	}
+
+	user, err := getUserByEmail(email)
+	if err != nil || user.ID != userID || !checkPasswordHash(req.Password, user.PasswordHash) {
+		return c.Status(401).JSON(fiber.Map{
+			"error": "Password is incorrect",
+		})
+	}
+
+	if err := disableMFA(userID, req.Code, req.RecoveryCode); err != nil {
+		if errors.Is(err, errInvalidMFACode) {
+			return c.Status(401).JSON(fiber.Map{
+				"error": "Invalid two-factor code",
+			})
+		}
+		if errors.Is(err, errMFANotEnabled) {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Two-factor authentication is not enabled",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to disable two-factor authentication",
+			"details": err.Error(),
 		})
 	}
 
 	return c.JSON(fiber.Map{
-		"user": user,
+		"message": "Two-factor authentication disabled",
 	})
 }
 
@@ -148,30 +791,34 @@ func authMiddleware(c *fiber.Ctx) error {
 	}
 
 	// Parse and validate token
-	secret := getJWTSecret()
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
-
-	if err != nil || !token.Valid {
+	claims, err := parseAccessToken(tokenString)
+	if err != nil {
 		return c.Status(401).JSON(fiber.Map{
 			"error": "Invalid or expired token",
 		})
 	}
 
-	// Extract claims
-	claims, ok := token.Claims.(*Claims)
-	if !ok {
+	// Reject tokens whose session was logged out or revoked
+	active, err := isSessionActive(claims.SessionID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to check session",
+			"details": err.Error(),
+		})
+	}
+	if !active {
 		return c.Status(401).JSON(fiber.Map{
-			"error": "Invalid token claims",
+			"error": "Session has been revoked. Please log in again.",
 		})
 	}
 
 	// Store user info in context
 	c.Locals("userID", claims.UserID)
+	c.Locals("sessionID", claims.SessionID)
 	c.Locals("username", claims.Username)
 	c.Locals("email", claims.Email)
 	c.Locals("role", claims.Role)
+	c.Locals("mfa", claims.MFA)
 
 	return c.Next()
 }
@@ -180,15 +827,108 @@ func authMiddleware(c *fiber.Ctx) error {
 func adminMiddleware(c *fiber.Ctx) error {
 	role := c.Locals("role").(string)
 
-	if role != "admin" && role != "super_admin" {
+	// Any staff role gets in; each route then checks its own permission
+	if !isStaffRole(role) {
 		return c.Status(403).JSON(fiber.Map{
 			"error": "Admin access required",
 		})
 	}
 
+	// When policy requires it, admin tokens must come from a login that passed 2FA
+	if adminRequires2FA() {
+		if mfa, _ := c.Locals("mfa").(bool); !mfa {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "Two-factor authentication required for admin access",
+				"code":  "mfa_required",
+			})
+		}
+	}
+
+	return c.Next()
+}
+
+// Permission middleware (after adminMiddleware). The role's permissions are read on
+// every request, so edits to a role take effect immediately.
+func requirePermission(permission string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		role, _ := c.Locals("role").(string)
+
+		granted, err := roleHasPermission(role, permission)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error":   "Failed to check permissions",
+				"details": err.Error(),
+			})
+		}
+		if !granted {
+			return c.Status(403).JSON(fiber.Map{
+				"error":      "You don't have permission to do this",
+				"code":       "permission_denied",
+				"permission": permission,
+			})
+		}
+
+		return c.Next()
+	}
+}
+
+// Super admin middleware (after adminMiddleware), for managing roles
+func superAdminMiddleware(c *fiber.Ctx) error {
+	if role, _ := c.Locals("role").(string); role != roleSuperAdmin {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Super admin access required",
+		})
+	}
 	return c.Next()
 }
 
+// Request paths allowed bodies up to the upload limit instead of the default. Routing
+// ignores case and a trailing slash, so this does too.
+var largeBodyPaths = regexp.MustCompile(`(?i)^/api/admin/products/\d+/images/upload/?$`)
+
+// Per-request body limit. fasthttp calls this once the headers are read and refuses larger
+// bodies with 413 before reading them. Image uploads get MAX_UPLOAD_MB plus room for the
+// multipart encoding; the zero config leaves every other request at the default limit.
+func requestBodyConfig(header *fasthttp.RequestHeader) fasthttp.RequestConfig {
+	path, _, _ := strings.Cut(string(header.RequestURI()), "?")
+	if string(header.Method()) == fiber.MethodPost && largeBodyPaths.MatchString(path) {
+		return fasthttp.RequestConfig{MaxRequestBodySize: maxUploadBytes() + 1024*1024}
+	}
+	return fasthttp.RequestConfig{}
+}
+
+// Verified email middleware (after auth or optional auth). When the given setting is
+// true, signed-in users must have verified their email. Guests have no account email to
+// verify, so guest checkout is deliberately exempt (documented in the API docs).
+func requireVerifiedEmail(settingKey string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !getEnvBool(settingKey, false) {
+			return c.Next()
+		}
+
+		userID, ok := c.Locals("userID").(int)
+		if !ok {
+			return c.Next()
+		}
+
+		user, err := getUserByID(userID)
+		if err != nil {
+			return c.Status(401).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+
+		if !user.EmailVerified {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "Please verify your email address first",
+				"code":  "email_not_verified",
+			})
+		}
+
+		return c.Next()
+	}
+}
+
 // Optional auth middleware (allows both authenticated and guest users)
 func optionalAuthMiddleware(c *fiber.Ctx) error {
 	// Get token from Authorization header
@@ -206,40 +946,36 @@ func optionalAuthMiddleware(c *fiber.Ctx) error {
 	}
 
 	// Parse and validate token
-	secret := getJWTSecret()
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
-
-	if err != nil || !token.Valid {
+	claims, err := parseAccessToken(tokenString)
+	if err != nil {
 		// Invalid token - proceed as guest user
 		return c.Next()
 	}
 
-	// Extract claims
-	claims, ok := token.Claims.(*Claims)
-	if !ok {
-		// Invalid claims - proceed as guest user
+	// Revoked session - proceed as guest user
+	if active, err := isSessionActive(claims.SessionID); err != nil || !active {
 		return c.Next()
 	}
 
 	// Store user info in context (user is authenticated)
 	c.Locals("user", claims)
 	c.Locals("userID", claims.UserID)
+	c.Locals("sessionID", claims.SessionID)
 	c.Locals("username", claims.Username)
 	c.Locals("email", claims.Email)
 	c.Locals("role", claims.Role)
+	c.Locals("mfa", claims.MFA)
 
 	return c.Next()
 }
 
-// Helper function to get JWT secret
-func getJWTSecret() string {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		secret = "your-secret-key" // Default for development
-	}
-	return secret
+// Public keys other services use to verify our access tokens. Old keys stay listed
+// while tokens signed with them may still be live.
+func jwksHandler(c *fiber.Ctx) error {
+	c.Set("Cache-Control", "public, max-age=300")
+	return c.JSON(fiber.Map{
+		"keys": currentJWTKeys().JWKS(),
+	})
 }
 
 // Admin: Create new product
@@ -440,12 +1176,189 @@ func adminGetProductsHandler(c *fiber.Ctx) error {
 				"details": err.Error(),
 			})
 		}
-		products = append(products, p)
+		products = append(products, p)
+	}
+
+	return c.JSON(fiber.Map{
+		"products": products,
+		"total":    len(products),
+	})
+}
+
+// =====================================================
+// ADMIN PRODUCT VARIANT HANDLERS
+// =====================================================
+
+// Admin: Get all variants for a product (including inactive)
+func adminGetProductVariantsHandler(c *fiber.Ctx) error {
+	productID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid product ID",
+		})
+	}
+
+	variants, err := getProductVariants(productID, false)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to fetch variants",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"variants": variants,
+		"total":    len(variants),
+	})
+}
+
+// Admin: Create variant for a product
+func adminCreateProductVariantHandler(c *fiber.Ctx) error {
+	productID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid product ID",
+		})
+	}
+
+	var req CreateVariantRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Basic validation
+	if strings.TrimSpace(req.SKU) == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "SKU is required",
+		})
+	}
+
+	if req.StockQuantity < 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Stock quantity cannot be negative",
+		})
+	}
+
+	variant, err := createProductVariant(productID, &req)
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return c.Status(409).JSON(fiber.Map{
+				"error": "Variant with this SKU already exists",
+			})
+		}
+		if strings.Contains(err.Error(), "foreign key") {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Product not found",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to create variant",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"message": "Variant created successfully",
+		"variant": variant,
+	})
+}
+
+// Admin: Update variant
+func adminUpdateProductVariantHandler(c *fiber.Ctx) error {
+	productID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid product ID",
+		})
+	}
+
+	variantID, err := strconv.Atoi(c.Params("variantId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid variant ID",
+		})
+	}
+
+	var req UpdateVariantRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.StockQuantity != nil && *req.StockQuantity < 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Stock quantity cannot be negative",
+		})
+	}
+
+	variant, err := updateProductVariant(productID, variantID, &req)
+	if err != nil {
+		if err.Error() == "no fields to update" {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "No fields provided for update",
+			})
+		}
+		if strings.Contains(err.Error(), "duplicate key") {
+			return c.Status(409).JSON(fiber.Map{
+				"error": "Variant with this SKU already exists",
+			})
+		}
+		if err.Error() == "sql: no rows in result set" {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Variant not found",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to update variant",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Variant updated successfully",
+		"variant": variant,
+	})
+}
+
+// Admin: Delete variant
+func adminDeleteProductVariantHandler(c *fiber.Ctx) error {
+	productID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid product ID",
+		})
+	}
+
+	variantID, err := strconv.Atoi(c.Params("variantId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid variant ID",
+		})
+	}
+
+	err = deleteProductVariant(productID, variantID)
+	if err != nil {
+		if err.Error() == "variant not found" {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Variant not found",
+			})
+		}
+		if strings.HasPrefix(err.Error(), "cannot delete variant") {
+			return c.Status(409).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to delete variant",
+			"details": err.Error(),
+		})
 	}
 
 	return c.JSON(fiber.Map{
-		"products": products,
-		"total":    len(products),
+		"message": "Variant deleted successfully",
 	})
 }
 
@@ -515,6 +1428,11 @@ func adminUpdateCategoryHandler(c *fiber.Ctx) error {
 	// Update category
 	category, err := updateCategory(id, &req)
 	if err != nil {
+		if strings.Contains(err.Error(), "its descendants") {
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
 		if strings.Contains(err.Error(), "no rows") {
 			return c.Status(404).JSON(fiber.Map{
 				"error": "Category not found",
@@ -548,41 +1466,38 @@ func adminDeleteCategoryHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check if category has products
-	var productCount int
-	err = db.QueryRow("SELECT COUNT(*) FROM catalog.products WHERE category_id = $1", id).Scan(&productCount)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "Failed to check category usage",
-			"details": err.Error(),
-		})
-	}
-
-	if productCount > 0 {
-		return c.Status(400).JSON(fiber.Map{
-			"error": fmt.Sprintf("Cannot delete category: %d products are using this category. Please reassign or delete those products first.", productCount),
-		})
-	}
-
-	// Check if category has subcategories
-	var subcategoryCount int
-	err = db.QueryRow("SELECT COUNT(*) FROM catalog.categories WHERE parent_id = $1", id).Scan(&subcategoryCount)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "Failed to check subcategories",
-			"details": err.Error(),
-		})
-	}
-
-	if subcategoryCount > 0 {
-		return c.Status(400).JSON(fiber.Map{
-			"error": fmt.Sprintf("Cannot delete category: %d subcategories exist. Please delete or reassign them first.", subcategoryCount),
-		})
+	// Optional category to move products and subcategories to
+	var reassignTo *int
+	if reassignStr := c.Query("reassign_to"); reassignStr != "" {
+		target, err := strconv.Atoi(reassignStr)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid reassign_to category ID",
+			})
+		}
+		reassignTo = &target
 	}
 
-	// Delete category
-	err = deleteCategory(id)
+	result, err := deleteCategory(id, reassignTo)
 	if err != nil {
+		var inUseErr *CategoryInUseError
+		if errors.As(err, &inUseErr) {
+			return c.Status(409).JSON(fiber.Map{
+				"error":         "Category is still in use. Reassign or remove its products and subcategories, or pass reassign_to.",
+				"products":      inUseErr.Products,
+				"subcategories": inUseErr.Subcategories,
+			})
+		}
+		if err.Error() == "sql: no rows in result set" {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Category not found",
+			})
+		}
+		if strings.HasPrefix(err.Error(), "cannot reassign") || err.Error() == "reassign_to category not found" {
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
 		return c.Status(500).JSON(fiber.Map{
 			"error":   "Failed to delete category",
 			"details": err.Error(),
@@ -590,7 +1505,8 @@ func adminDeleteCategoryHandler(c *fiber.Ctx) error {
 	}
 
 	return c.JSON(fiber.Map{
-		"message": "Category deleted successfully",
+		"message":    "Category deleted successfully",
+		"reassigned": result,
 	})
 }
 
@@ -641,119 +1557,439 @@ func adminCreateProductImageHandler(c *fiber.Ctx) error {
 	productID := c.Params("productId")
 	prodID, err := strconv.Atoi(productID)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"error": "Invalid product ID",
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid product ID",
+		})
+	}
+
+	var req ProductImageRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Validation
+	if req.ImageURL == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Image URL is required",
+		})
+	}
+
+	// Create the image
+	image, err := createProductImage(prodID, nil, &req)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to create product image",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"message": "Product image created successfully",
+		"image":   image,
+	})
+}
+
+// Admin: Upload a product image file (multipart/form-data)
+func adminUploadProductImageHandler(c *fiber.Ctx) error {
+	// Parse product ID from URL
+	prodID, err := strconv.Atoi(c.Params("productId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid product ID",
+		})
+	}
+
+	fileHeader, err := c.FormFile("image")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "An image file is required in the 'image' form field",
+		})
+	}
+
+	if fileHeader.Size > int64(maxUploadBytes()) {
+		return c.Status(413).JSON(fiber.Map{
+			"error": fmt.Sprintf("Image is larger than the %d MB limit", maxUploadBytes()/(1024*1024)),
+		})
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Could not read uploaded file",
+		})
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Could not read uploaded file",
+		})
+	}
+
+	// Validate the content and build renditions before touching storage or the database
+	upload, err := processImageUpload(data)
+	if err != nil {
+		return c.Status(415).JSON(fiber.Map{
+			"error":   "Unsupported or corrupt image. Allowed types: JPEG, PNG, GIF",
+			"details": err.Error(),
+		})
+	}
+
+	exists, err := productExists(prodID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to check product",
+			"details": err.Error(),
+		})
+	}
+	if !exists {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Product not found",
+		})
+	}
+
+	baseKey, err := newUploadKey(prodID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to store image",
+			"details": err.Error(),
+		})
+	}
+
+	// Store the original and each rendition, cleaning up if any step fails
+	savedKeys := []string{}
+	cleanup := func() {
+		for _, key := range savedKeys {
+			imageStorage.Delete(key)
+		}
+	}
+
+	originalKey := baseKey + upload.Extension
+	originalURL, err := imageStorage.Save(originalKey, bytes.NewReader(data))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to store image",
+			"details": err.Error(),
+		})
+	}
+	savedKeys = append(savedKeys, originalKey)
+
+	renditionURLs := map[string]string{}
+	for name, encoded := range upload.Renditions {
+		key := renditionKey(baseKey, name, upload.ContentType)
+		url, err := imageStorage.Save(key, bytes.NewReader(encoded))
+		if err != nil {
+			cleanup()
+			return c.Status(500).JSON(fiber.Map{
+				"error":   "Failed to store image rendition",
+				"details": err.Error(),
+			})
+		}
+		savedKeys = append(savedKeys, key)
+		renditionURLs[name] = url
+	}
+
+	req := ProductImageRequest{
+		ImageURL:     originalURL,
+		ImagePath:    originalKey,
+		ImageType:    c.FormValue("image_type", "gallery"),
+		AltText:      c.FormValue("alt_text"),
+		DisplayOrder: 1,
+		IsPrimary:    c.FormValue("is_primary") == "true",
+	}
+	if order := c.FormValue("display_order"); order != "" {
+		if req.DisplayOrder, err = strconv.Atoi(order); err != nil {
+			cleanup()
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid display_order",
+			})
+		}
+	}
+
+	image, err := createUploadedProductImage(prodID, &req, upload, renditionURLs["thumbnail"], renditionURLs["medium"])
+	if err != nil {
+		cleanup()
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to create product image",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"message": "Product image uploaded successfully",
+		"image":   image,
+	})
+}
+
+// Get product images
+func getProductImagesHandler(c *fiber.Ctx) error {
+	// Parse product ID from URL
+	productID := c.Params("productId")
+	prodID, err := strconv.Atoi(productID)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid product ID",
+		})
+	}
+
+	images, err := getProductImages(prodID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to get product images",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"images": images,
+		"total":  len(images),
+	})
+}
+
+// Update product image (admin only)
+func adminUpdateProductImageHandler(c *fiber.Ctx) error {
+	// Parse image ID from URL
+	imageID := c.Params("imageId")
+	imgID, err := strconv.Atoi(imageID)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid image ID",
+		})
+	}
+
+	var req ProductImageRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Update the image
+	image, err := updateProductImage(imgID, &req)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to update product image",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Product image updated successfully",
+		"image":   image,
+	})
+}
+
+// Delete product image (admin only)
+func adminDeleteProductImageHandler(c *fiber.Ctx) error {
+	// Parse image ID from URL
+	imageID := c.Params("imageId")
+	imgID, err := strconv.Atoi(imageID)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid image ID",
+		})
+	}
+
+	imagePath, err := deleteProductImage(imgID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to delete product image",
+			"details": err.Error(),
+		})
+	}
+
+	// The row is gone, so a file that fails to delete is only logged
+	for _, key := range storedImageKeys(imagePath) {
+		if err := imageStorage.Delete(key); err != nil {
+			log.Printf("⚠️  Failed to delete stored image %s: %v", key, err)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Product image deleted successfully",
+	})
+}
+
+// =====================================================
+// ADMIN ROLE HANDLERS
+// =====================================================
+
+// Super admin: List permissions that can be given to roles
+func adminGetPermissionsHandler(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"permissions": allPermissions,
+	})
+}
+
+// Super admin: List roles
+func adminGetRolesHandler(c *fiber.Ctx) error {
+	roles, err := getRoles()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to fetch roles",
+			"details": err.Error(),
 		})
 	}
 
-	var req ProductImageRequest
+	return c.JSON(fiber.Map{
+		"roles": roles,
+		"count": len(roles),
+	})
+}
+
+// Super admin: Create a role
+func adminCreateRoleHandler(c *fiber.Ctx) error {
+	var req RoleRequest
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{
 			"error": "Invalid request body",
 		})
 	}
 
-	// Validation
-	if req.ImageURL == "" {
+	if err := req.validate(true); err != nil {
 		return c.Status(400).JSON(fiber.Map{
-			"error": "Image URL is required",
+			"error":   "Invalid role",
+			"details": err.Error(),
 		})
 	}
 
-	// Create the image
-	image, err := createProductImage(prodID, nil, &req)
+	role, err := createRole(&req)
 	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return c.Status(409).JSON(fiber.Map{
+				"error": "A role with this name already exists",
+			})
+		}
 		return c.Status(500).JSON(fiber.Map{
-			"error":   "Failed to create product image",
+			"error":   "Failed to create role",
 			"details": err.Error(),
 		})
 	}
 
 	return c.Status(201).JSON(fiber.Map{
-		"message": "Product image created successfully",
-		"image":   image,
+		"message": "Role created successfully",
+		"role":    role,
 	})
 }
 
-// Get product images
-func getProductImagesHandler(c *fiber.Ctx) error {
-	// Parse product ID from URL
-	productID := c.Params("productId")
-	prodID, err := strconv.Atoi(productID)
-	if err != nil {
+// Super admin: Update a role's description or permissions
+func adminUpdateRoleHandler(c *fiber.Ctx) error {
+	var req RoleRequest
+	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{
-			"error": "Invalid product ID",
+			"error": "Invalid request body",
 		})
 	}
 
-	images, err := getProductImages(prodID)
+	if err := req.validate(false); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "Invalid role",
+			"details": err.Error(),
+		})
+	}
+
+	role, err := updateRole(c.Params("name"), &req)
 	if err != nil {
+		switch {
+		case errors.Is(err, errRoleNotFound):
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Role not found",
+			})
+		case errors.Is(err, errRoleBuiltIn):
+			return c.Status(409).JSON(fiber.Map{
+				"error": "The permissions of this built-in role can't be changed",
+			})
+		}
 		return c.Status(500).JSON(fiber.Map{
-			"error":   "Failed to get product images",
+			"error":   "Failed to update role",
 			"details": err.Error(),
 		})
 	}
 
 	return c.JSON(fiber.Map{
-		"images": images,
-		"total":  len(images),
+		"message": "Role updated successfully",
+		"role":    role,
 	})
 }
 
-// Update product image (admin only)
-func adminUpdateProductImageHandler(c *fiber.Ctx) error {
-	// Parse image ID from URL
-	imageID := c.Params("imageId")
-	imgID, err := strconv.Atoi(imageID)
-	if err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"error": "Invalid image ID",
-		})
-	}
-
-	var req ProductImageRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
-	}
-
-	// Update the image
-	image, err := updateProductImage(imgID, &req)
-	if err != nil {
+// Super admin: Delete a custom role
+func adminDeleteRoleHandler(c *fiber.Ctx) error {
+	if err := deleteRole(c.Params("name")); err != nil {
+		switch {
+		case errors.Is(err, errRoleNotFound):
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Role not found",
+			})
+		case errors.Is(err, errRoleBuiltIn):
+			return c.Status(409).JSON(fiber.Map{
+				"error": "Built-in roles can't be deleted",
+			})
+		case errors.Is(err, errRoleInUse):
+			return c.Status(409).JSON(fiber.Map{
+				"error": "Role is still assigned to users",
+			})
+		}
 		return c.Status(500).JSON(fiber.Map{
-			"error":   "Failed to update product image",
+			"error":   "Failed to delete role",
 			"details": err.Error(),
 		})
 	}
 
 	return c.JSON(fiber.Map{
-		"message": "Product image updated successfully",
-		"image":   image,
+		"message": "Role deleted successfully",
 	})
 }
 
-// Delete product image (admin only)
-func adminDeleteProductImageHandler(c *fiber.Ctx) error {
-	// Parse image ID from URL
-	imageID := c.Params("imageId")
-	imgID, err := strconv.Atoi(imageID)
+// Super admin: Assign a role to a user. Their sessions are revoked so new tokens carry the new role.
+func adminAssignRoleHandler(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
 		return c.Status(400).JSON(fiber.Map{
-			"error": "Invalid image ID",
+			"error": "Invalid user ID",
+		})
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.Role == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Role is required",
 		})
 	}
 
-	err = deleteProductImage(imgID)
+	user, err := assignUserRole(c.Locals("userID").(int), userID, req.Role)
 	if err != nil {
+		switch {
+		case errors.Is(err, errOwnRoleChange):
+			return c.Status(400).JSON(fiber.Map{
+				"error": "You can't change your own role",
+			})
+		case errors.Is(err, errRoleNotFound):
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Role not found",
+			})
+		case err.Error() == "user not found":
+			return c.Status(404).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
 		return c.Status(500).JSON(fiber.Map{
-			"error":   "Failed to delete product image",
+			"error":   "Failed to assign role",
 			"details": err.Error(),
 		})
 	}
 
 	return c.JSON(fiber.Map{
-		"message": "Product image deleted successfully",
+		"message": "Role assigned successfully",
+		"user":    user,
 	})
 }
 
@@ -772,9 +2008,9 @@ func addToCartHandler(c *fiber.Ctx) error {
 	}
 
 	// Validation
-	if req.ProductID <= 0 {
+	if req.VariantID <= 0 && req.ProductID <= 0 {
 		return c.Status(400).JSON(fiber.Map{
-			"error": "Valid product_id is required",
+			"error": "Valid variant_id is required",
 		})
 	}
 
@@ -782,6 +2018,25 @@ func addToCartHandler(c *fiber.Ctx) error {
 		req.Quantity = 1 // Default to 1
 	}
 
+	// Work out which size/colour is being added
+	variant, err := resolveCartVariant(req.ProductID, req.VariantID)
+	if err != nil {
+		if err.Error() == "variant not found" {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Variant not found",
+			})
+		}
+		if strings.HasPrefix(err.Error(), "variant") || strings.HasPrefix(err.Error(), "product has no") {
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to add item to cart",
+			"details": err.Error(),
+		})
+	}
+
 	// Check if user is authenticated
 	user := c.Locals("user")
 
@@ -790,7 +2045,7 @@ func addToCartHandler(c *fiber.Ctx) error {
 		userClaims := user.(*Claims)
 		userID := userClaims.UserID
 
-		err := addToUserCart(userID, req.ProductID, req.Quantity)
+		err := addToUserCart(userID, variant.ProductID, variant.ID, req.Quantity)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
 				"error":   "Failed to add item to cart",
@@ -810,7 +2065,7 @@ func addToCartHandler(c *fiber.Ctx) error {
 			})
 		}
 
-		err := addToGuestCart(sessionID, req.ProductID, req.Quantity)
+		err := addToGuestCart(sessionID, variant.ProductID, variant.ID, req.Quantity)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
 				"error":   "Failed to add item to cart",
@@ -865,10 +2120,10 @@ func getCartHandler(c *fiber.Ctx) error {
 
 // Update cart item quantity
 func updateCartHandler(c *fiber.Ctx) error {
-	productID, err := strconv.Atoi(c.Params("productId"))
+	variantID, err := strconv.Atoi(c.Params("variantId"))
 	if err != nil {
 		return c.Status(400).JSON(fiber.Map{
-			"error": "Invalid product ID",
+			"error": "Invalid variant ID",
 		})
 	}
 
@@ -889,7 +2144,7 @@ func updateCartHandler(c *fiber.Ctx) error {
 		userClaims := user.(*Claims)
 		userID := userClaims.UserID
 
-		err := updateCartItemQuantity(&userID, nil, productID, req.Quantity)
+		err := updateCartItemQuantity(&userID, nil, variantID, req.Quantity)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
 				"error":   "Failed to update cart item",
@@ -905,7 +2160,7 @@ func updateCartHandler(c *fiber.Ctx) error {
 			})
 		}
 
-		err := updateCartItemQuantity(nil, &sessionID, productID, req.Quantity)
+		err := updateCartItemQuantity(nil, &sessionID, variantID, req.Quantity)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
 				"error":   "Failed to update cart item",
@@ -926,10 +2181,10 @@ func updateCartHandler(c *fiber.Ctx) error {
 
 // Remove item from cart
 func removeFromCartHandler(c *fiber.Ctx) error {
-	productID, err := strconv.Atoi(c.Params("productId"))
+	variantID, err := strconv.Atoi(c.Params("variantId"))
 	if err != nil {
 		return c.Status(400).JSON(fiber.Map{
-			"error": "Invalid product ID",
+			"error": "Invalid variant ID",
 		})
 	}
 
@@ -940,7 +2195,7 @@ func removeFromCartHandler(c *fiber.Ctx) error {
 		userClaims := user.(*Claims)
 		userID := userClaims.UserID
 
-		err := removeFromCart(&userID, nil, productID)
+		err := removeFromCart(&userID, nil, variantID)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
 				"error":   "Failed to remove item from cart",
@@ -956,7 +2211,7 @@ func removeFromCartHandler(c *fiber.Ctx) error {
 			})
 		}
 
-		err := removeFromCart(nil, &sessionID, productID)
+		err := removeFromCart(nil, &sessionID, variantID)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
 				"error":   "Failed to remove item from cart",
@@ -972,25 +2227,46 @@ func removeFromCartHandler(c *fiber.Ctx) error {
 
 // Get user points (authenticated users only)
 func getUserPointsHandler(c *fiber.Ctx) error {
-	user := c.Locals("user")
-	if user == nil {
-		return c.Status(401).JSON(fiber.Map{
-			"error": "Authentication required",
+	userID := c.Locals("userID").(int)
+
+	points, err := getPointsSummary(userID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to get user points",
+			"details": err.Error(),
 		})
 	}
 
-	userClaims := user.(*Claims)
-	userID := userClaims.UserID
+	return c.JSON(points)
+}
+
+// Get the user's points history, newest first (authenticated users only)
+func getPointsTransactionsHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	page := c.QueryInt("page", 1)
+	if page < 1 {
+		page = 1
+	}
+	limit := c.QueryInt("limit", 20)
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
 
-	points, err := getUserPoints(userID)
+	transactions, total, err := getPointsTransactions(userID, page, limit)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
-			"error":   "Failed to get user points",
+			"error":   "Failed to get points history",
 			"details": err.Error(),
 		})
 	}
 
-	return c.JSON(points)
+	return c.JSON(fiber.Map{
+		"transactions": transactions,
+		"total":        total,
+		"page":         page,
+		"limit":        limit,
+	})
 }
 
 // Migrate guest cart to user cart (called during login/register)
@@ -1009,19 +2285,183 @@ func migrateCartHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	userClaims := user.(*Claims)
-	userID := userClaims.UserID
+	userClaims := user.(*Claims)
+	userID := userClaims.UserID
+
+	err := migrateGuestCartToUser(sessionID, userID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to migrate cart",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Guest cart migrated successfully",
+	})
+}
+
+// =====================================================
+// ADDRESS BOOK HANDLERS
+// =====================================================
+
+// Get the signed-in user's saved addresses
+func getAddressesHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	addresses, err := getUserAddresses(userID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to fetch addresses",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"addresses": addresses,
+		"total":     len(addresses),
+	})
+}
+
+// Get a single saved address
+func getAddressHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	addressID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid address ID",
+		})
+	}
+
+	address, err := getUserAddress(userID, addressID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Address not found",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to fetch address",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"address": address,
+	})
+}
+
+// Save a new address
+func createAddressHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	var req AddressRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := req.validate(true); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	address, err := createUserAddress(userID, &req)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to create address",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"message": "Address created successfully",
+		"address": address,
+	})
+}
+
+// Update a saved address
+func updateAddressHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	addressID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid address ID",
+		})
+	}
+
+	var req AddressRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := req.validate(false); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	address, err := updateUserAddress(userID, addressID, &req)
+	if err != nil {
+		var invalidErr *AddressValidationError
+		if errors.As(err, &invalidErr) {
+			return c.Status(400).JSON(fiber.Map{
+				"error": invalidErr.Error(),
+			})
+		}
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Address not found",
+			})
+		}
+		if err.Error() == "no fields to update" {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "No fields provided for update",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to update address",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Address updated successfully",
+		"address": address,
+	})
+}
+
+// Delete a saved address
+func deleteAddressHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
 
-	err := migrateGuestCartToUser(sessionID, userID)
+	addressID, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid address ID",
+		})
+	}
+
+	if err := deleteUserAddress(userID, addressID); err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Address not found",
+			})
+		}
 		return c.Status(500).JSON(fiber.Map{
-			"error":   "Failed to migrate cart",
+			"error":   "Failed to delete address",
 			"details": err.Error(),
 		})
 	}
 
 	return c.JSON(fiber.Map{
-		"message": "Guest cart migrated successfully",
+		"message": "Address deleted successfully",
 	})
 }
 
@@ -1059,9 +2499,77 @@ func createOrderHandler(c *fiber.Ctx) error {
 		})
 	}
 
+	// Saved addresses belong to an account, so guests must send the address itself
+	if userID == nil && (req.AddressID != nil || req.BillingAddressID != nil) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Saved addresses require authentication",
+		})
+	}
+
+	// So does the wallet
+	if userID == nil && isWalletPayment(req.PaymentMethod) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Wallet payment requires authentication",
+		})
+	}
+
+	// And so do loyalty points
+	if userID == nil && req.RedeemPoints > 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Redeeming points requires authentication",
+		})
+	}
+	if req.RedeemPoints < 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "redeem_points can't be negative",
+		})
+	}
+
+	if req.Shipping != nil && req.AddressID == nil {
+		if err := req.Shipping.normalize(); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error":   "Invalid shipping address",
+				"details": err.Error(),
+			})
+		}
+	}
+
 	// Create order
 	order, err := createOrderFromCart(userID, sessionIDPtr, &req)
 	if err != nil {
+		if err.Error() == "address not found" {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Address not found",
+			})
+		}
+		var stockErr *OutOfStockError
+		if errors.As(err, &stockErr) {
+			return c.Status(409).JSON(fiber.Map{
+				"error": "Some items are out of stock",
+				"items": stockErr.Items,
+			})
+		}
+		var balanceErr *InsufficientBalanceError
+		if errors.As(err, &balanceErr) {
+			return c.Status(402).JSON(fiber.Map{
+				"error":    "Insufficient wallet balance",
+				"balance":  balanceErr.Balance,
+				"required": balanceErr.Required,
+			})
+		}
+		var pointsErr *InsufficientPointsError
+		if errors.As(err, &pointsErr) {
+			return c.Status(400).JSON(fiber.Map{
+				"error":     "Not enough loyalty points",
+				"balance":   pointsErr.Balance,
+				"requested": pointsErr.Requested,
+			})
+		}
+		if err.Error() == "cart is empty" {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Cart is empty",
+			})
+		}
 		return c.Status(500).JSON(fiber.Map{
 			"error":   "Failed to create order",
 			"details": err.Error(),
@@ -1168,60 +2676,181 @@ func adminGetOrderHandler(c *fiber.Ctx) error {
 		})
 	}
 
+	history, err := getOrderStatusHistory(orderID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to fetch order history",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"order":          order,
+		"status_history": history,
+	})
+}
+
+// Read search and paging query parameters for the admin user lists
+func parseUserSearchParams(c *fiber.Ctx) (*UserSearchParams, error) {
+	params := &UserSearchParams{
+		Query:  c.Query("q"),
+		Role:   c.Query("role"),
+		Status: c.Query("status"),
+		Page:   c.QueryInt("page", 1),
+		Limit:  c.QueryInt("limit", 20),
+	}
+	return params, params.normalize()
+}
+
+// Admin: Search users of any role by name, username, email or phone
+func adminSearchUsersHandler(c *fiber.Ctx) error {
+	params, err := parseUserSearchParams(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	users, total, err := searchUsers(params)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to fetch users",
+			"details": err.Error(),
+		})
+	}
+
 	return c.JSON(fiber.Map{
-		"order": order,
+		"users": users,
+		"total": total,
+		"page":  params.Page,
+		"limit": params.Limit,
 	})
 }
 
-// Admin: Get customers
+// Admin: Search customers (users with the customer role)
 func adminGetCustomersHandler(c *fiber.Ctx) error {
-	query := `
-		SELECT id, username, email, first_name, last_name, phone, role, created_at
-		FROM auth.users
-		WHERE role = 'customer'
-		ORDER BY created_at DESC
-	`
+	params, err := parseUserSearchParams(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	params.Role = roleCustomer
 
-	rows, err := db.Query(query)
+	customers, total, err := searchUsers(params)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error":   "Failed to fetch customers",
 			"details": err.Error(),
 		})
 	}
-	defer rows.Close()
 
-	type Customer struct {
-		ID        int     `json:"id"`
-		Username  string  `json:"username"`
-		Email     string  `json:"email"`
-		FirstName *string `json:"first_name,omitempty"`
-		LastName  *string `json:"last_name,omitempty"`
-		Phone     *string `json:"phone,omitempty"`
-		Role      string  `json:"role"`
-		CreatedAt string  `json:"created_at"`
+	return c.JSON(fiber.Map{
+		"customers": customers,
+		"total":     total,
+		"page":      params.Page,
+		"limit":     params.Limit,
+	})
+}
+
+// Admin: Get one user with their recent orders, wallet and points
+func adminGetUserHandler(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
 	}
 
-	var customers []Customer
-	for rows.Next() {
-		var customer Customer
-		err := rows.Scan(
-			&customer.ID, &customer.Username, &customer.Email,
-			&customer.FirstName, &customer.LastName, &customer.Phone,
-			&customer.Role, &customer.CreatedAt,
-		)
+	detail, err := getCustomerDetail(userID)
+	if err != nil {
+		if err.Error() == "user not found" {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to fetch user",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(detail)
+}
+
+// Admin: Deactivate or reactivate an account
+func setUserActiveHandler(active bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid user ID",
+			})
+		}
+
+		role, _ := c.Locals("role").(string)
+		user, err := setUserActive(c.Locals("userID").(int), role, userID, active)
 		if err != nil {
+			switch {
+			case errors.Is(err, errOwnAccountStatus):
+				return c.Status(400).JSON(fiber.Map{
+					"error": "You can't deactivate your own account",
+				})
+			case errors.Is(err, errStaffAccountStatus):
+				return c.Status(403).JSON(fiber.Map{
+					"error": "Only a super admin can deactivate or reactivate a staff account",
+				})
+			case err.Error() == "user not found":
+				return c.Status(404).JSON(fiber.Map{
+					"error": "User not found",
+				})
+			}
 			return c.Status(500).JSON(fiber.Map{
-				"error":   "Failed to scan customer",
+				"error":   "Failed to update account",
 				"details": err.Error(),
 			})
 		}
-		customers = append(customers, customer)
+
+		message := "Account reactivated"
+		if !active {
+			message = "Account deactivated and signed out"
+		}
+		return c.JSON(fiber.Map{
+			"message": message,
+			"user":    user,
+		})
+	}
+}
+
+// Admin: Unlock a user's login after a lockout or backoff
+func adminUnlockUserHandler(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	role, _ := c.Locals("role").(string)
+	if err := unlockUserLogin(role, userID); err != nil {
+		if errors.Is(err, errStaffAccountStatus) {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "Only a super admin can unlock a staff account",
+			})
+		}
+		if err.Error() == "user not found" {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to unlock user",
+			"details": err.Error(),
+		})
 	}
 
 	return c.JSON(fiber.Map{
-		"customers": customers,
-		"total":     len(customers),
+		"message": "User login unlocked",
 	})
 }
 
@@ -1241,8 +2870,32 @@ func adminUpdateOrderStatusHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	err = updateOrderStatus(orderID, &req)
+	err = updateOrderStatus(orderID, c.Locals("userID").(int), &req)
 	if err != nil {
+		var transitionErr *OrderTransitionError
+		if errors.As(err, &transitionErr) {
+			return c.Status(409).JSON(fiber.Map{
+				"error":          "Invalid status transition",
+				"details":        transitionErr.Error(),
+				"current_status": transitionErr.From,
+				"allowed":        transitionErr.Allowed,
+			})
+		}
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Order not found",
+			})
+		}
+		if err.Error() == "invalid order status" {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid status. Use one of: pending, confirmed, processing, shipped, delivered, cancelled, refunded",
+			})
+		}
+		if err.Error() == "no fields to update" {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "No fields provided for update",
+			})
+		}
 		return c.Status(500).JSON(fiber.Map{
 			"error":   "Failed to update order status",
 			"details": err.Error(),
@@ -1254,6 +2907,123 @@ func adminUpdateOrderStatusHandler(c *fiber.Ctx) error {
 	})
 }
 
+// =====================================================
+// CHECKOUT RESERVATION HANDLERS
+// =====================================================
+
+// Work out whose cart a request refers to (authenticated user or guest session)
+func getCartOwner(c *fiber.Ctx) (*int, *string) {
+	if user := c.Locals("user"); user != nil {
+		userID := user.(*Claims).UserID
+		return &userID, nil
+	}
+
+	if sessionID := c.Get("X-Session-ID", ""); sessionID != "" {
+		return nil, &sessionID
+	}
+
+	return nil, nil
+}
+
+// Start checkout: hold stock for everything in the cart
+func createReservationHandler(c *fiber.Ctx) error {
+	userID, sessionID := getCartOwner(c)
+	if userID == nil && sessionID == nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Either authentication or session ID required",
+		})
+	}
+
+	reservation, err := reserveCartStock(userID, sessionID)
+	if err != nil {
+		var stockErr *OutOfStockError
+		if errors.As(err, &stockErr) {
+			return c.Status(409).JSON(fiber.Map{
+				"error": "Some items are out of stock",
+				"items": stockErr.Items,
+			})
+		}
+		if err.Error() == "cart is empty" {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Cart is empty",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to reserve stock",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"message":     "Stock reserved",
+		"reservation": reservation,
+	})
+}
+
+// Get the current checkout hold
+func getReservationHandler(c *fiber.Ctx) error {
+	userID, sessionID := getCartOwner(c)
+	if userID == nil && sessionID == nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Either authentication or session ID required",
+		})
+	}
+
+	reservation, err := getOwnerReservation(userID, sessionID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "No active reservation",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to get reservation",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"reservation": reservation,
+	})
+}
+
+// Abandon checkout: release the hold immediately
+func releaseReservationHandler(c *fiber.Ctx) error {
+	userID, sessionID := getCartOwner(c)
+	if userID == nil && sessionID == nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Either authentication or session ID required",
+		})
+	}
+
+	if err := releaseCheckoutReservation(userID, sessionID); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to release reservation",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Reservation released",
+	})
+}
+
+// Admin: List active stock holds
+func adminGetReservationsHandler(c *fiber.Ctx) error {
+	reservations, err := getActiveReservations()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to fetch reservations",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"reservations": reservations,
+		"total":        len(reservations),
+	})
+}
+
 // =====================================================
 // WALLET HANDLERS
 // =====================================================
@@ -1324,6 +3094,69 @@ func addTokensHandler(c *fiber.Ctx) error {
 	})
 }
 
+// Admin: Credit or debit a customer's wallet (refunds, goodwill credits, corrections)
+func adminAdjustWalletHandler(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	var req struct {
+		Amount float64 `json:"amount"`
+		Type   string  `json:"type"` // "credit" or "debit"
+		Reason string  `json:"reason"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.Amount <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Amount must be greater than 0",
+		})
+	}
+	if req.Type != "credit" && req.Type != "debit" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Type must be 'credit' or 'debit'",
+		})
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Reason is required",
+		})
+	}
+
+	description := fmt.Sprintf("Adjustment by admin #%d: %s", c.Locals("userID").(int), req.Reason)
+	if err := addWalletTransaction(userID, req.Amount, req.Type, description, nil); err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			return c.Status(404).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		case errors.As(err, new(*InsufficientBalanceError)):
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Debit is larger than the wallet balance",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to adjust wallet",
+			"details": err.Error(),
+		})
+	}
+
+	balance, _ := getWalletBalance(userID)
+
+	return c.JSON(fiber.Map{
+		"message": "Wallet adjusted successfully",
+		"balance": balance,
+	})
+}
+
 // =====================================================
 // VALIDATION MIDDLEWARE
 // =====================================================
@@ -1399,9 +3232,9 @@ func validateCartInput(c *fiber.Ctx) error {
 	if err := c.BodyParser(&req); err == nil {
 		c.Locals("parsedRequest", req)
 
-		if req.ProductID <= 0 {
+		if req.VariantID <= 0 && req.ProductID <= 0 {
 			return c.Status(400).JSON(fiber.Map{
-				"error": "Valid product ID is required",
+				"error": "Valid variant ID is required",
 			})
 		}
 
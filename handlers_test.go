@@ -2,12 +2,20 @@ package main
 
 import (
 	"bytes"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
 )
 
 // TestHealthCheck tests the health check endpoint
@@ -45,10 +53,6 @@ func TestHealthCheck(t *testing.T) {
 
 // TestRegisterHandlerValidation tests registration input validation
 func TestRegisterHandlerValidation(t *testing.T) {
-	// Set JWT secret for testing
-	os.Setenv("JWT_SECRET", "test-secret-key-for-unit-testing-purposes-only")
-	defer os.Unsetenv("JWT_SECRET")
-
 	tests := []struct {
 		name           string
 		payload        map[string]interface{}
@@ -206,9 +210,6 @@ func TestAuthMiddlewareNoToken(t *testing.T) {
 
 // TestAuthMiddlewareInvalidToken tests auth middleware with invalid token
 func TestAuthMiddlewareInvalidToken(t *testing.T) {
-	os.Setenv("JWT_SECRET", "test-secret-key-for-unit-testing-purposes-only")
-	defer os.Unsetenv("JWT_SECRET")
-
 	app := fiber.New()
 
 	// Protected route
@@ -232,9 +233,6 @@ func TestAuthMiddlewareInvalidToken(t *testing.T) {
 
 // TestAdminMiddlewareNoAdmin tests admin middleware with non-admin user
 func TestAdminMiddlewareNoAdmin(t *testing.T) {
-	os.Setenv("JWT_SECRET", "test-secret-key-for-unit-testing-purposes-only")
-	defer os.Unsetenv("JWT_SECRET")
-
 	app := fiber.New()
 
 	// Mock middleware that sets role as customer (not admin)
@@ -261,9 +259,6 @@ func TestAdminMiddlewareNoAdmin(t *testing.T) {
 
 // TestAdminMiddlewareWithAdmin tests admin middleware with admin user
 func TestAdminMiddlewareWithAdmin(t *testing.T) {
-	os.Setenv("JWT_SECRET", "test-secret-key-for-unit-testing-purposes-only")
-	defer os.Unsetenv("JWT_SECRET")
-
 	app := fiber.New()
 
 	// Mock middleware that sets role as admin
@@ -377,3 +372,993 @@ func TestInvalidContentType(t *testing.T) {
 		t.Errorf("Status code = %d, want 400", resp.StatusCode)
 	}
 }
+
+// TestAdminCreateVariantValidation tests variant creation input validation
+func TestAdminCreateVariantValidation(t *testing.T) {
+	tests := []struct {
+		name           string
+		productID      string
+		payload        map[string]interface{}
+		expectedStatus int
+	}{
+		{
+			name:           "Invalid product ID",
+			productID:      "abc",
+			payload:        map[string]interface{}{"sku": "TEE-M"},
+			expectedStatus: 400,
+		},
+		{
+			name:           "Missing SKU",
+			productID:      "1",
+			payload:        map[string]interface{}{"size": "M"},
+			expectedStatus: 400,
+		},
+		{
+			name:           "Negative stock",
+			productID:      "1",
+			payload:        map[string]interface{}{"sku": "TEE-M", "stock_quantity": -1},
+			expectedStatus: 400,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Post("/api/admin/products/:id/variants", adminCreateProductVariantHandler)
+
+			body, _ := json.Marshal(tt.payload)
+			req := httptest.NewRequest("POST", "/api/admin/products/"+tt.productID+"/variants", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Status code = %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+		})
+	}
+}
+
+// TestAddToCartRequiresVariant tests that add to cart needs a variant or product
+func TestAddToCartRequiresVariant(t *testing.T) {
+	app := fiber.New()
+	app.Post("/api/cart", addToCartHandler)
+
+	body, _ := json.Marshal(map[string]interface{}{"quantity": 2})
+	req := httptest.NewRequest("POST", "/api/cart", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Session-ID", "guest-session-1")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != 400 {
+		t.Errorf("Status code = %d, want 400", resp.StatusCode)
+	}
+}
+
+// TestUpdateCartInvalidVariantID tests cart update with a non-numeric variant ID
+func TestUpdateCartInvalidVariantID(t *testing.T) {
+	app := fiber.New()
+	app.Put("/api/cart/:variantId", updateCartHandler)
+
+	body, _ := json.Marshal(map[string]interface{}{"quantity": 2})
+	req := httptest.NewRequest("PUT", "/api/cart/abc", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != 400 {
+		t.Errorf("Status code = %d, want 400", resp.StatusCode)
+	}
+}
+
+// TestReservationRequiresCartOwner tests reservation endpoints without a user or session
+func TestReservationRequiresCartOwner(t *testing.T) {
+	app := fiber.New()
+	app.Post("/api/checkout/reservation", createReservationHandler)
+	app.Get("/api/checkout/reservation", getReservationHandler)
+	app.Delete("/api/checkout/reservation", releaseReservationHandler)
+
+	for _, method := range []string{"POST", "GET", "DELETE"} {
+		t.Run(method, func(t *testing.T) {
+			req := httptest.NewRequest(method, "/api/checkout/reservation", nil)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != 400 {
+				t.Errorf("Status code = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestSearchProductsValidation tests search query validation
+func TestSearchProductsValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{name: "Missing query", url: "/api/products/search"},
+		{name: "Blank query", url: "/api/products/search?q=%20%20"},
+		{name: "Punctuation only", url: "/api/products/search?q=%26%7C"},
+		{name: "Invalid category", url: "/api/products/search?q=mug&category_id=abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Get("/api/products/search", searchProductsHandler)
+
+			req := httptest.NewRequest("GET", tt.url, nil)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != 400 {
+				t.Errorf("Status code = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestProductsListValidation tests listing filter and cursor validation
+func TestProductsListValidation(t *testing.T) {
+	newestCursor := encodeProductCursor(productCursor{Sort: "newest", Value: "2025-01-01T00:00:00Z", ID: 5})
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{name: "Unknown sort", url: "/api/products?sort=popular"},
+		{name: "Invalid category", url: "/api/products?category_id=tees"},
+		{name: "Invalid min price", url: "/api/products?min_price=cheap"},
+		{name: "Negative max price", url: "/api/products?max_price=-1"},
+		{name: "Inverted price range", url: "/api/products?min_price=2000&max_price=500"},
+		{name: "Garbage cursor", url: "/api/products?cursor=not-a-cursor"},
+		{name: "Cursor from another sort", url: "/api/products?sort=price_asc&cursor=" + newestCursor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Get("/api/products", productsHandler)
+
+			req := httptest.NewRequest("GET", tt.url, nil)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != 400 {
+				t.Errorf("Status code = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestCategoryTreeValidation tests breadcrumb and parent cycle validation
+func TestCategoryTreeValidation(t *testing.T) {
+	app := fiber.New()
+	app.Get("/api/categories/:id/breadcrumbs", categoryBreadcrumbsHandler)
+	app.Put("/api/admin/categories/:id", adminUpdateCategoryHandler)
+
+	req := httptest.NewRequest("GET", "/api/categories/apparel/breadcrumbs", nil)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	if resp.StatusCode != 400 {
+		t.Errorf("Breadcrumbs status code = %d, want 400", resp.StatusCode)
+	}
+
+	req = httptest.NewRequest("PUT", "/api/admin/categories/3", bytes.NewBufferString(`{"parent_id": 3}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	if resp.StatusCode != 400 {
+		t.Errorf("Self-parent status code = %d, want 400", resp.StatusCode)
+	}
+}
+
+// TestSlugPath tests redirect locations for renamed products and categories
+func TestSlugPath(t *testing.T) {
+	tests := []struct {
+		entityType string
+		slug       string
+		want       string
+	}{
+		{entityType: "product", slug: "go-gopher-tshirt", want: "/api/products/slug/go-gopher-tshirt"},
+		{entityType: "category", slug: "tech-apparel", want: "/api/categories/slug/tech-apparel"},
+		{entityType: "product", slug: "mug/large", want: "/api/products/slug/mug%2Flarge"},
+	}
+
+	for _, tt := range tests {
+		if got := slugPath(tt.entityType, tt.slug); got != tt.want {
+			t.Errorf("slugPath(%q, %q) = %q, want %q", tt.entityType, tt.slug, got, tt.want)
+		}
+	}
+}
+
+// TestAdminDeleteCategoryValidation tests category and reassign_to ID validation
+func TestAdminDeleteCategoryValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{name: "Invalid category ID", url: "/api/admin/categories/apparel"},
+		{name: "Invalid reassign_to", url: "/api/admin/categories/3?reassign_to=clothing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Delete("/api/admin/categories/:id", adminDeleteCategoryHandler)
+
+			req := httptest.NewRequest("DELETE", tt.url, nil)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != 400 {
+				t.Errorf("Status code = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestAdminUploadProductImageValidation tests upload checks that run before storage
+func TestAdminUploadProductImageValidation(t *testing.T) {
+	multipartBody := func(field, filename, content string) (*bytes.Buffer, string) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		if field != "" {
+			part, _ := writer.CreateFormFile(field, filename)
+			part.Write([]byte(content))
+		}
+		writer.WriteField("alt_text", "Front view")
+		writer.Close()
+		return body, writer.FormDataContentType()
+	}
+
+	tests := []struct {
+		name       string
+		url        string
+		field      string
+		content    string
+		wantStatus int
+	}{
+		{name: "Invalid product ID", url: "/api/admin/products/abc/images/upload", field: "image", content: "x", wantStatus: 400},
+		{name: "Missing file", url: "/api/admin/products/1/images/upload", field: "", wantStatus: 400},
+		{name: "Not an image", url: "/api/admin/products/1/images/upload", field: "image", content: "%PDF-1.4 fake", wantStatus: 415},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Post("/api/admin/products/:productId/images/upload", adminUploadProductImageHandler)
+
+			body, contentType := multipartBody(tt.field, "upload.jpg", tt.content)
+			req := httptest.NewRequest("POST", tt.url, body)
+			req.Header.Set("Content-Type", contentType)
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("Status code = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// TestRefreshAndLogoutValidation tests refresh body validation and logout auth
+func TestRefreshAndLogoutValidation(t *testing.T) {
+	app := fiber.New()
+	app.Post("/api/auth/refresh", refreshTokenHandler)
+	app.Post("/api/auth/logout", authMiddleware, logoutHandler)
+
+	req := httptest.NewRequest("POST", "/api/auth/refresh", bytes.NewBufferString(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	if resp.StatusCode != 400 {
+		t.Errorf("Refresh without token status = %d, want 400", resp.StatusCode)
+	}
+
+	req = httptest.NewRequest("POST", "/api/auth/logout", nil)
+	resp, err = app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	if resp.StatusCode != 401 {
+		t.Errorf("Logout without token status = %d, want 401", resp.StatusCode)
+	}
+}
+
+// TestPasswordResetValidation tests forgot/reset password input validation
+func TestPasswordResetValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		body string
+	}{
+		{name: "Forgot without email", url: "/api/auth/forgot-password", body: `{"email": "  "}`},
+		{name: "Reset without token", url: "/api/auth/reset-password", body: `{"password": "newpassword"}`},
+		{name: "Reset with short password", url: "/api/auth/reset-password", body: `{"token": "abc", "password": "123"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Post("/api/auth/forgot-password", forgotPasswordHandler)
+			app.Post("/api/auth/reset-password", resetPasswordHandler)
+
+			req := httptest.NewRequest("POST", tt.url, bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != 400 {
+				t.Errorf("Status code = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestRequireVerifiedEmailPassThrough tests that the gate is off by default and ignores guests
+func TestRequireVerifiedEmailPassThrough(t *testing.T) {
+	tests := []struct {
+		name    string
+		setting string
+	}{
+		{name: "Setting off", setting: ""},
+		{name: "Setting on, guest user", setting: "true"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("REQUIRE_VERIFIED_EMAIL_CHECKOUT", tt.setting)
+			defer os.Unsetenv("REQUIRE_VERIFIED_EMAIL_CHECKOUT")
+
+			app := fiber.New()
+			app.Post("/api/orders", requireVerifiedEmail("REQUIRE_VERIFIED_EMAIL_CHECKOUT"), func(c *fiber.Ctx) error {
+				return c.SendStatus(201)
+			})
+
+			req := httptest.NewRequest("POST", "/api/orders", nil)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != 201 {
+				t.Errorf("Status code = %d, want 201", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestVerifyEmailValidation tests that a verification token is required
+func TestVerifyEmailValidation(t *testing.T) {
+	app := fiber.New()
+	app.Post("/api/auth/verify-email", verifyEmailHandler)
+
+	req := httptest.NewRequest("POST", "/api/auth/verify-email", bytes.NewBufferString(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != 400 {
+		t.Errorf("Status code = %d, want 400", resp.StatusCode)
+	}
+}
+
+// TestAccountSettingsValidation tests request validation for profile, password and address changes
+func TestAccountSettingsValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+	}{
+		{name: "Profile with empty username", method: "PUT", url: "/api/auth/profile", body: `{"username": " "}`},
+		{name: "Change password without current password", method: "POST", url: "/api/auth/change-password", body: `{"new_password": "newpassword"}`},
+		{name: "Change password with short new password", method: "POST", url: "/api/auth/change-password", body: `{"current_password": "oldpassword", "new_password": "123"}`},
+		{name: "Address without city", method: "POST", url: "/api/auth/addresses", body: `{"first_name": "Jane", "last_name": "Doe", "address_line_1": "Moi Avenue"}`},
+		{name: "Address with unknown type", method: "POST", url: "/api/auth/addresses", body: `{"type": "office", "first_name": "Jane", "last_name": "Doe", "address_line_1": "Moi Avenue", "city": "Nairobi"}`},
+		{name: "Address update clearing first name", method: "PUT", url: "/api/auth/addresses/1", body: `{"first_name": ""}`},
+		{name: "Address update with invalid ID", method: "PUT", url: "/api/auth/addresses/abc", body: `{"city": "Mombasa"}`},
+		{name: "Address delete with invalid ID", method: "DELETE", url: "/api/auth/addresses/abc", body: ``},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Use(func(c *fiber.Ctx) error {
+				c.Locals("userID", 1)
+				c.Locals("sessionID", 7)
+				return c.Next()
+			})
+			app.Put("/api/auth/profile", updateProfileHandler)
+			app.Post("/api/auth/change-password", changePasswordHandler)
+			app.Post("/api/auth/addresses", createAddressHandler)
+			app.Put("/api/auth/addresses/:id", updateAddressHandler)
+			app.Delete("/api/auth/addresses/:id", deleteAddressHandler)
+
+			req := httptest.NewRequest(tt.method, tt.url, bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != 400 {
+				t.Errorf("Status code = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestGuestCheckoutRejectsSavedAddress tests that guests can't check out with an address_id
+func TestGuestCheckoutRejectsSavedAddress(t *testing.T) {
+	app := fiber.New()
+	app.Post("/api/orders", createOrderHandler)
+
+	req := httptest.NewRequest("POST", "/api/orders", bytes.NewBufferString(`{"address_id": 3}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Session-ID", "guest-session")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != 400 {
+		t.Errorf("Status code = %d, want 400", resp.StatusCode)
+	}
+}
+
+// TestGuestCheckoutRejectsWalletPayment tests that guests can't pay from a wallet
+func TestGuestCheckoutRejectsWalletPayment(t *testing.T) {
+	app := fiber.New()
+	app.Post("/api/orders", createOrderHandler)
+
+	req := httptest.NewRequest("POST", "/api/orders", bytes.NewBufferString(`{"payment_method": " Wallet "}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Session-ID", "guest-session")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != 400 {
+		t.Errorf("Status code = %d, want 400", resp.StatusCode)
+	}
+}
+
+// TestCheckoutRedeemPointsValidation tests that guests can't redeem points and amounts can't be negative
+func TestCheckoutRedeemPointsValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		userID int
+		body   string
+	}{
+		{name: "Guest", body: `{"redeem_points": 200}`},
+		{name: "Negative", userID: 1, body: `{"redeem_points": -50}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Post("/api/orders", func(c *fiber.Ctx) error {
+				if tt.userID != 0 {
+					c.Locals("user", &Claims{UserID: tt.userID})
+				}
+				return c.Next()
+			}, createOrderHandler)
+
+			req := httptest.NewRequest("POST", "/api/orders", bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Session-ID", "guest-session")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != 400 {
+				t.Errorf("Status code = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestCreateOrderShippingValidation tests that structured shipping addresses are checked before checkout
+func TestCreateOrderShippingValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "Unknown county", body: `{"shipping": {"first_name": "Jane", "last_name": "Doe", "address_line_1": "Moi Avenue", "city": "Nairobi", "county": "Gotham"}}`},
+		{name: "Missing county", body: `{"shipping": {"first_name": "Jane", "last_name": "Doe", "address_line_1": "Moi Avenue", "city": "Nairobi"}}`},
+		{name: "Missing address line", body: `{"shipping": {"first_name": "Jane", "last_name": "Doe", "city": "Nairobi", "county": "Nairobi"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Post("/api/orders", createOrderHandler)
+
+			req := httptest.NewRequest("POST", "/api/orders", bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Session-ID", "guest-session")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != 400 {
+				t.Errorf("Status code = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestLoginThrottledResponse tests the 429 body and Retry-After header
+func TestLoginThrottledResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		throttle LoginThrottle
+		wantCode string
+	}{
+		{name: "Backoff", throttle: LoginThrottle{RetryAfter: 4 * time.Second}, wantCode: "login_backoff"},
+		{name: "Locked", throttle: LoginThrottle{RetryAfter: 15 * time.Minute, Locked: true}, wantCode: "account_locked"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Post("/api/auth/login", func(c *fiber.Ctx) error {
+				return loginThrottledResponse(c, &tt.throttle)
+			})
+
+			resp, err := app.Test(httptest.NewRequest("POST", "/api/auth/login", nil))
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != 429 {
+				t.Errorf("Status code = %d, want 429", resp.StatusCode)
+			}
+			if resp.Header.Get("Retry-After") == "" {
+				t.Error("Retry-After header not set")
+			}
+
+			var body map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&body)
+			if body["code"] != tt.wantCode {
+				t.Errorf("code = %v, want %s", body["code"], tt.wantCode)
+			}
+		})
+	}
+}
+
+// TestAdminMiddlewareRequires2FA tests that admin tokens without 2FA are refused when policy requires it
+func TestAdminMiddlewareRequires2FA(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		mfa        bool
+		wantStatus int
+	}{
+		{name: "Policy off", policy: "", mfa: false, wantStatus: 200},
+		{name: "Policy on, no 2FA", policy: "true", mfa: false, wantStatus: 403},
+		{name: "Policy on, passed 2FA", policy: "true", mfa: true, wantStatus: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("ADMIN_REQUIRE_2FA", tt.policy)
+			defer os.Unsetenv("ADMIN_REQUIRE_2FA")
+
+			app := fiber.New()
+			app.Use(func(c *fiber.Ctx) error {
+				c.Locals("role", "admin")
+				c.Locals("mfa", tt.mfa)
+				return c.Next()
+			})
+			app.Get("/api/admin/test", adminMiddleware, func(c *fiber.Ctx) error {
+				return c.JSON(fiber.Map{"message": "admin access granted"})
+			})
+
+			resp, err := app.Test(httptest.NewRequest("GET", "/api/admin/test", nil))
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("Status code = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// TestMFAValidation tests request validation for the two-factor endpoints
+func TestMFAValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		body string
+	}{
+		{name: "Verify without challenge", url: "/api/auth/2fa/verify", body: `{"code": "123456"}`},
+		{name: "Verify without code", url: "/api/auth/2fa/verify", body: `{"mfa_token": "abc"}`},
+		{name: "Enable without code", url: "/api/auth/2fa/enable", body: `{}`},
+		{name: "Disable without password", url: "/api/auth/2fa/disable", body: `{"code": "123456"}`},
+		{name: "Disable without code", url: "/api/auth/2fa/disable", body: `{"password": "secret"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Use(func(c *fiber.Ctx) error {
+				c.Locals("userID", 1)
+				c.Locals("sessionID", 7)
+				c.Locals("email", "admin@example.com")
+				return c.Next()
+			})
+			app.Post("/api/auth/2fa/verify", mfaVerifyHandler)
+			app.Post("/api/auth/2fa/enable", mfaEnableHandler)
+			app.Post("/api/auth/2fa/disable", mfaDisableHandler)
+
+			req := httptest.NewRequest("POST", tt.url, bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != 400 {
+				t.Errorf("Status code = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestAdminPermissionMiddleware tests staff access, per-route permissions and super admin routes
+func TestAdminPermissionMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		role       string
+		middleware []fiber.Handler
+		wantStatus int
+	}{
+		{name: "Custom staff role enters admin area", role: "warehouse", middleware: []fiber.Handler{adminMiddleware}, wantStatus: 200},
+		{name: "Customer kept out of admin area", role: "customer", middleware: []fiber.Handler{adminMiddleware}, wantStatus: 403},
+		{name: "Super admin has every permission", role: "super_admin", middleware: []fiber.Handler{adminMiddleware, requirePermission(permWalletAdjust)}, wantStatus: 200},
+		{name: "Customer has no permissions", role: "customer", middleware: []fiber.Handler{requirePermission(permCatalogWrite)}, wantStatus: 403},
+		{name: "Super admin manages roles", role: "super_admin", middleware: []fiber.Handler{superAdminMiddleware}, wantStatus: 200},
+		{name: "Admin can't manage roles", role: "admin", middleware: []fiber.Handler{superAdminMiddleware}, wantStatus: 403},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Use(func(c *fiber.Ctx) error {
+				c.Locals("role", tt.role)
+				return c.Next()
+			})
+			handlers := append(tt.middleware, func(c *fiber.Ctx) error {
+				return c.JSON(fiber.Map{"message": "ok"})
+			})
+			app.Get("/api/admin/test", handlers...)
+
+			resp, err := app.Test(httptest.NewRequest("GET", "/api/admin/test", nil))
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("Status code = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// TestAdminRoleAndWalletValidation tests request validation for role management and wallet adjustments
+func TestAdminRoleAndWalletValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+	}{
+		{name: "Create role with bad name", method: "POST", url: "/api/admin/roles", body: `{"name": "Bad Name", "permissions": []}`},
+		{name: "Create role with unknown permission", method: "POST", url: "/api/admin/roles", body: `{"name": "packer", "permissions": ["orders:delete"]}`},
+		{name: "Update role with nothing", method: "PUT", url: "/api/admin/roles/packer", body: `{}`},
+		{name: "Assign role to bad user ID", method: "PUT", url: "/api/admin/users/abc/role", body: `{"role": "warehouse"}`},
+		{name: "Assign empty role", method: "PUT", url: "/api/admin/users/5/role", body: `{}`},
+		{name: "Adjust wallet with zero amount", method: "POST", url: "/api/admin/users/5/wallet/adjust", body: `{"amount": 0, "type": "credit", "reason": "refund"}`},
+		{name: "Adjust wallet with bad type", method: "POST", url: "/api/admin/users/5/wallet/adjust", body: `{"amount": 10, "type": "bonus", "reason": "refund"}`},
+		{name: "Adjust wallet without reason", method: "POST", url: "/api/admin/users/5/wallet/adjust", body: `{"amount": 10, "type": "credit", "reason": " "}`},
+	}
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("userID", 1)
+		c.Locals("role", "super_admin")
+		return c.Next()
+	})
+	app.Post("/api/admin/roles", adminCreateRoleHandler)
+	app.Put("/api/admin/roles/:name", adminUpdateRoleHandler)
+	app.Put("/api/admin/users/:id/role", adminAssignRoleHandler)
+	app.Post("/api/admin/users/:id/wallet/adjust", adminAdjustWalletHandler)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != 400 {
+				t.Errorf("Status code = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestAdminUserManagementValidation tests request validation for admin user search and account status
+func TestAdminUserManagementValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		url    string
+	}{
+		{name: "Search with unknown status", method: "GET", url: "/api/admin/users?status=banned"},
+		{name: "Customers with unknown status", method: "GET", url: "/api/admin/customers?status=banned"},
+		{name: "Detail with bad ID", method: "GET", url: "/api/admin/users/abc"},
+		{name: "Deactivate with bad ID", method: "POST", url: "/api/admin/users/abc/deactivate"},
+		{name: "Deactivate own account", method: "POST", url: "/api/admin/users/1/deactivate"},
+		{name: "Reactivate with bad ID", method: "POST", url: "/api/admin/users/abc/reactivate"},
+	}
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("userID", 1)
+		c.Locals("role", "admin")
+		return c.Next()
+	})
+	app.Get("/api/admin/customers", adminGetCustomersHandler)
+	app.Get("/api/admin/users", adminSearchUsersHandler)
+	app.Get("/api/admin/users/:id", adminGetUserHandler)
+	app.Post("/api/admin/users/:id/deactivate", setUserActiveHandler(false))
+	app.Post("/api/admin/users/:id/reactivate", setUserActiveHandler(true))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := app.Test(httptest.NewRequest(tt.method, tt.url, nil))
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != 400 {
+				t.Errorf("Status code = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestStaffAccountStatusRequiresSuperAdmin tests that customers:write can't deactivate,
+// reactivate or unlock staff accounts
+func TestStaffAccountStatusRequiresSuperAdmin(t *testing.T) {
+	useTestDB(t, func(query string, args []driver.Value) *testRows {
+		switch {
+		case strings.Contains(query, "SELECT role FROM auth.users"):
+			return &testRows{columns: []string{"role"}, values: [][]driver.Value{{"admin"}}}
+		case strings.Contains(query, "FROM auth.users"):
+			return &testRows{
+				columns: []string{"id", "username", "email", "first_name", "last_name", "phone", "role", "is_active", "email_verified", "wallet_balance", "last_login", "created_at"},
+				values:  [][]driver.Value{{args[0], "boss", "boss@example.com", "", "", "", "admin", true, true, float64(0), nil, time.Now()}},
+			}
+		}
+		return nil
+	})
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("userID", 1)
+		c.Locals("role", "support")
+		return c.Next()
+	})
+	app.Post("/api/admin/users/:id/deactivate", setUserActiveHandler(false))
+	app.Post("/api/admin/users/:id/reactivate", setUserActiveHandler(true))
+	app.Post("/api/admin/users/:id/unlock", adminUnlockUserHandler)
+
+	for _, url := range []string{"/api/admin/users/2/deactivate", "/api/admin/users/2/reactivate", "/api/admin/users/2/unlock"} {
+		resp, err := app.Test(httptest.NewRequest("POST", url, nil))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+
+		if resp.StatusCode != 403 {
+			t.Errorf("POST %s status code = %d, want 403", url, resp.StatusCode)
+		}
+	}
+}
+
+// TestAdminUpdateOrderStatusValidation tests that unknown statuses are rejected before any update
+func TestAdminUpdateOrderStatusValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		body string
+	}{
+		{name: "Invalid order ID", url: "/api/admin/orders/abc/status", body: `{"status": "shipped"}`},
+		{name: "Unknown status", url: "/api/admin/orders/1/status", body: `{"status": "lost"}`},
+		{name: "Nothing to update", url: "/api/admin/orders/1/status", body: `{}`},
+	}
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("userID", 1)
+		return c.Next()
+	})
+	app.Put("/api/admin/orders/:id/status", adminUpdateOrderStatusHandler)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", tt.url, bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != 400 {
+				t.Errorf("Status code = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestRequestBodyConfig tests the default body limit and the larger one for image uploads
+func TestRequestBodyConfig(t *testing.T) {
+	app := fiber.New()
+	app.Server().HeaderReceived = requestBodyConfig
+	app.All("/*", func(c *fiber.Ctx) error {
+		return c.SendString(strconv.Itoa(len(c.Body())))
+	})
+
+	chunked := func(req *http.Request) *http.Request {
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		return req
+	}
+
+	tests := []struct {
+		name     string
+		req      *http.Request
+		wantCode int
+		tooLarge bool
+	}{
+		{name: "Small body", req: httptest.NewRequest("POST", "/api/cart", strings.NewReader(`{"quantity":1}`)), wantCode: 200},
+		{name: "Chunked body", req: chunked(httptest.NewRequest("POST", "/api/cart", strings.NewReader(`{"quantity":1}`))), wantCode: 200},
+		{name: "Large body", req: httptest.NewRequest("POST", "/api/cart", bytes.NewReader(make([]byte, fiber.DefaultBodyLimit+1))), tooLarge: true},
+		{name: "Large upload", req: httptest.NewRequest("POST", "/api/admin/products/7/images/upload", bytes.NewReader(make([]byte, fiber.DefaultBodyLimit+1))), wantCode: 200},
+		{name: "Large upload with query", req: httptest.NewRequest("POST", "/api/admin/products/7/images/upload/?x=1", bytes.NewReader(make([]byte, fiber.DefaultBodyLimit+1))), wantCode: 200},
+		{name: "Large body on another admin route", req: httptest.NewRequest("POST", "/api/admin/products/7/images", bytes.NewReader(make([]byte, fiber.DefaultBodyLimit+1))), tooLarge: true},
+		{name: "Upload over the limit", req: httptest.NewRequest("POST", "/api/admin/products/7/images/upload", bytes.NewReader(make([]byte, maxUploadBytes()+2*1024*1024))), tooLarge: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// fasthttp answers 413 and reports the oversized body as the connection's error
+			resp, err := app.Test(tt.req, -1)
+			if tt.tooLarge {
+				if !errors.Is(err, fasthttp.ErrBodyTooLarge) {
+					t.Errorf("error = %v, want %v", err, fasthttp.ErrBodyTooLarge)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("Status code = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+		})
+	}
+}
+
+// TestPointsHandlersWithAuth tests the points endpoints behind authMiddleware
+func TestPointsHandlersWithAuth(t *testing.T) {
+	useTestDB(t, func(query string, args []driver.Value) *testRows {
+		switch {
+		case strings.Contains(query, "FROM auth.sessions"):
+			return &testRows{columns: []string{"active"}, values: [][]driver.Value{{true}}}
+		case strings.Contains(query, "FROM auth.user_points"):
+			return &testRows{columns: []string{"user_id", "points_balance", "total_earned", "total_spent"}, values: [][]driver.Value{{args[0], int64(120), int64(300), int64(180)}}}
+		case strings.Contains(query, "SUM(total_amount)"):
+			return &testRows{columns: []string{"spend"}, values: [][]driver.Value{{float64(0)}}}
+		case strings.Contains(query, "COUNT(*) FROM auth.points_transactions"):
+			return &testRows{columns: []string{"count"}, values: [][]driver.Value{{int64(1)}}}
+		case strings.Contains(query, "FROM auth.points_transactions"):
+			return &testRows{
+				columns: []string{"id", "order_id", "transaction_type", "points", "description", "created_at"},
+				values:  [][]driver.Value{{int64(9), int64(4), "earned", int64(40), "Order ORD-4", time.Now()}},
+			}
+		}
+		return nil
+	})
+
+	token, err := generateJWT(&User{ID: 7, Username: "wanjiku", Email: "wanjiku@example.com", Role: "customer"}, 1, false)
+	if err != nil {
+		t.Fatalf("generateJWT() error = %v", err)
+	}
+
+	app := fiber.New()
+	app.Get("/api/points", authMiddleware, getUserPointsHandler)
+	app.Get("/api/points/transactions", authMiddleware, getPointsTransactionsHandler)
+
+	tests := []struct {
+		name     string
+		path     string
+		token    string
+		wantCode int
+		wantKey  string
+	}{
+		{name: "Summary", path: "/api/points", token: token, wantCode: 200, wantKey: "tier"},
+		{name: "History", path: "/api/points/transactions", token: token, wantCode: 200, wantKey: "transactions"},
+		{name: "No token", path: "/api/points/transactions", wantCode: 401, wantKey: "error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("Status code = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+
+			var result map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&result)
+			if _, ok := result[tt.wantKey]; !ok {
+				t.Errorf("Response %v has no %q", result, tt.wantKey)
+			}
+		})
+	}
+}
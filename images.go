@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // registers the GIF decoder with image.Decode
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Content types accepted for product image uploads, with the file extension they are stored under
+var allowedImageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// Longest side, in pixels, of each generated rendition
+var imageRenditions = []struct {
+	Name    string
+	MaxSide int
+}{
+	{Name: "thumbnail", MaxSide: 200},
+	{Name: "medium", MaxSide: 800},
+}
+
+// ProcessedImage is a validated upload plus its resized renditions
+type ProcessedImage struct {
+	ContentType string
+	Extension   string
+	Width       int
+	Height      int
+	Size        int
+	Renditions  map[string][]byte // encoded bytes keyed by rendition name
+}
+
+// Largest image accepted, in pixels. Compressed files can declare huge dimensions in a few
+// KB, and decoding allocates for every pixel, so dimensions are checked before decoding.
+const maxImagePixels = 40_000_000
+
+// Largest accepted upload in bytes, from MAX_UPLOAD_MB (default 10)
+func maxUploadBytes() int {
+	return getEnvInt("MAX_UPLOAD_MB", 10) * 1024 * 1024
+}
+
+// Random storage key prefix for a product's upload, e.g. products/12/3f9c...
+func newUploadKey(productID int) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("products/%d/%s", productID, hex.EncodeToString(b)), nil
+}
+
+// Storage key of an upload's rendition, e.g. products/12/3f9c..._thumbnail.jpg
+func renditionKey(baseKey, name, contentType string) string {
+	return baseKey + "_" + name + renditionExtension(contentType)
+}
+
+// Keys of originals written by the upload handler; images added by URL have other paths
+var uploadKeyPattern = regexp.MustCompile(`^products/\d+/[0-9a-f]{32}\.(jpg|png|gif)$`)
+
+// Storage keys of an uploaded image's original and renditions, or none if the image
+// was not uploaded through storage
+func storedImageKeys(imagePath string) []string {
+	if !uploadKeyPattern.MatchString(imagePath) {
+		return nil
+	}
+
+	ext := imagePath[strings.LastIndex(imagePath, "."):]
+	baseKey := strings.TrimSuffix(imagePath, ext)
+	var contentType string
+	for ct, e := range allowedImageTypes {
+		if e == ext {
+			contentType = ct
+		}
+	}
+
+	keys := []string{imagePath}
+	for _, rendition := range imageRenditions {
+		keys = append(keys, renditionKey(baseKey, rendition.Name, contentType))
+	}
+	return keys
+}
+
+// Check the upload's real content type by sniffing its bytes; the client's header is not trusted
+func detectImageType(data []byte) (string, error) {
+	contentType := http.DetectContentType(data)
+	if _, ok := allowedImageTypes[contentType]; !ok {
+		return "", fmt.Errorf("unsupported image type: %s", contentType)
+	}
+	return contentType, nil
+}
+
+// Validate an uploaded image, read its dimensions and build the thumbnail and medium renditions
+func processImageUpload(data []byte) (*ProcessedImage, error) {
+	contentType, err := detectImageType(data)
+	if err != nil {
+		return nil, err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode image: %v", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return nil, fmt.Errorf("image is %dx%d; the limit is %d megapixels", config.Width, config.Height, maxImagePixels/1_000_000)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode image: %v", err)
+	}
+
+	bounds := src.Bounds()
+	processed := &ProcessedImage{
+		ContentType: contentType,
+		Extension:   allowedImageTypes[contentType],
+		Width:       bounds.Dx(),
+		Height:      bounds.Dy(),
+		Size:        len(data),
+		Renditions:  make(map[string][]byte, len(imageRenditions)),
+	}
+
+	for _, rendition := range imageRenditions {
+		encoded, err := encodeRendition(resizeImage(src, rendition.MaxSide), contentType)
+		if err != nil {
+			return nil, err
+		}
+		processed.Renditions[rendition.Name] = encoded
+	}
+
+	return processed, nil
+}
+
+// Renditions of JPEGs stay JPEG; PNGs and GIFs become PNG so transparency survives
+func renditionExtension(contentType string) string {
+	if contentType == "image/jpeg" {
+		return ".jpg"
+	}
+	return ".png"
+}
+
+func encodeRendition(img image.Image, contentType string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Scale an image down so its longest side is at most maxSide, keeping the aspect ratio.
+// Each output pixel averages the (premultiplied) source pixels it covers. Smaller images are returned as-is.
+func resizeImage(src image.Image, maxSide int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW <= maxSide && srcH <= maxSide {
+		return src
+	}
+
+	dstW, dstH := maxSide, maxSide
+	if srcW >= srcH {
+		dstH = max(1, srcH*maxSide/srcW)
+	} else {
+		dstW = max(1, srcW*maxSide/srcH)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0 := bounds.Min.Y + y*srcH/dstH
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*srcH/dstH)
+		for x := 0; x < dstW; x++ {
+			x0 := bounds.Min.X + x*srcW/dstW
+			x1 := max(x0+1, bounds.Min.X+(x+1)*srcW/dstW)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.RGBA64Model.Convert(src.At(sx, sy)).(color.RGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					b += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(b / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+
+	return dst
+}
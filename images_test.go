@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// encodeTestPNG builds a solid-colour PNG of the given size
+func encodeTestPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: 200, G: 30, B: 30, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+// TestDetectImageType tests content sniffing for uploads
+func TestDetectImageType(t *testing.T) {
+	if got, err := detectImageType(encodeTestPNG(t, 2, 2)); err != nil || got != "image/png" {
+		t.Errorf("detectImageType(png) = %q, %v; want image/png", got, err)
+	}
+
+	if _, err := detectImageType([]byte("<html><body>not an image</body></html>")); err == nil {
+		t.Error("detectImageType(html) expected error")
+	}
+}
+
+// TestResizeImage tests aspect-preserving downscaling
+func TestResizeImage(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		maxSide       int
+		wantW, wantH  int
+	}{
+		{name: "Landscape", width: 1000, height: 500, maxSide: 200, wantW: 200, wantH: 100},
+		{name: "Portrait", width: 300, height: 900, maxSide: 300, wantW: 100, wantH: 300},
+		{name: "Already small", width: 120, height: 80, maxSide: 200, wantW: 120, wantH: 80},
+		{name: "Very thin", width: 2000, height: 3, maxSide: 200, wantW: 200, wantH: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := image.NewRGBA(image.Rect(0, 0, tt.width, tt.height))
+			got := resizeImage(src, tt.maxSide).Bounds()
+			if got.Dx() != tt.wantW || got.Dy() != tt.wantH {
+				t.Errorf("resizeImage() = %dx%d, want %dx%d", got.Dx(), got.Dy(), tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+// TestProcessImageUpload tests dimensions, size and renditions of an upload
+func TestProcessImageUpload(t *testing.T) {
+	data := encodeTestPNG(t, 1600, 1200)
+
+	processed, err := processImageUpload(data)
+	if err != nil {
+		t.Fatalf("processImageUpload() error = %v", err)
+	}
+
+	if processed.Width != 1600 || processed.Height != 1200 || processed.Size != len(data) {
+		t.Errorf("processImageUpload() = %dx%d (%d bytes), want 1600x1200 (%d bytes)", processed.Width, processed.Height, processed.Size, len(data))
+	}
+	if processed.Extension != ".png" {
+		t.Errorf("Extension = %q, want .png", processed.Extension)
+	}
+
+	wantSides := map[string]int{"thumbnail": 200, "medium": 800}
+	for name, side := range wantSides {
+		encoded, ok := processed.Renditions[name]
+		if !ok {
+			t.Fatalf("missing %s rendition", name)
+		}
+		cfg, err := png.DecodeConfig(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("%s rendition is not a PNG: %v", name, err)
+		}
+		if cfg.Width != side {
+			t.Errorf("%s width = %d, want %d", name, cfg.Width, side)
+		}
+	}
+
+	if _, err := processImageUpload([]byte("GIF89a-but-truncated")); err == nil {
+		t.Error("processImageUpload(corrupt gif) expected error")
+	}
+}
+
+// TestProcessImageUploadPixelLimit tests that huge declared dimensions are refused before decoding
+func TestProcessImageUploadPixelLimit(t *testing.T) {
+	// A tiny PNG whose header claims 50000x50000 pixels
+	data := encodeTestPNG(t, 1, 1)
+	ihdr := data[12 : 12+4+13] // chunk type and data
+	binary.BigEndian.PutUint32(ihdr[4:8], 50000)
+	binary.BigEndian.PutUint32(ihdr[8:12], 50000)
+	binary.BigEndian.PutUint32(data[12+4+13:], crc32.ChecksumIEEE(ihdr))
+
+	_, err := processImageUpload(data)
+	if err == nil || !strings.Contains(err.Error(), "megapixels") {
+		t.Errorf("processImageUpload() error = %v, want the pixel limit", err)
+	}
+}
+
+// TestStoredImageKeys tests finding the files to delete for uploaded images only
+func TestStoredImageKeys(t *testing.T) {
+	base := "products/7/0123456789abcdef0123456789abcdef"
+
+	tests := []struct {
+		imagePath string
+		want      []string
+	}{
+		{imagePath: base + ".jpg", want: []string{base + ".jpg", base + "_thumbnail.jpg", base + "_medium.jpg"}},
+		{imagePath: base + ".gif", want: []string{base + ".gif", base + "_thumbnail.png", base + "_medium.png"}},
+		{imagePath: "https://cdn.example.com/hoodie.jpg"},
+		{imagePath: "products/7/../../etc/passwd"},
+		{imagePath: ""},
+	}
+
+	for _, tt := range tests {
+		got := storedImageKeys(tt.imagePath)
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("storedImageKeys(%q) = %v, want %v", tt.imagePath, got, tt.want)
+		}
+	}
+}
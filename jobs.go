@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Expire unused loyalty points on a fixed interval, starting straight away so a
+// long interval isn't reset by every restart. POINTS_EXPIRY_DAYS=0 turns expiry off.
+func startPointsExpirySweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for ; ; <-ticker.C {
+			rules := currentPointsRules()
+			if rules.ExpiryDays == 0 {
+				continue
+			}
+
+			cutoff := time.Now().AddDate(0, 0, -rules.ExpiryDays)
+			expired, err := expirePoints(cutoff)
+			if err != nil {
+				log.Printf("⚠️  Points expiry failed: %v", err)
+				continue
+			}
+			if expired > 0 {
+				log.Printf("⏳ Expired unused points for %d user(s)", expired)
+			}
+		}
+	}()
+}
+
+// Release expired checkout reservations on a fixed interval
+func startReservationSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			released, err := releaseExpiredReservations()
+			if err != nil {
+				log.Printf("⚠️  Reservation sweep failed: %v", err)
+				continue
+			}
+			if released > 0 {
+				log.Printf("🔓 Released %d expired stock reservation(s)", released)
+			}
+		}
+	}()
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTKey is one asymmetric key used to sign or verify access tokens
+type JWTKey struct {
+	ID        string            // "kid" header value, derived from the public key
+	Method    jwt.SigningMethod // RS256 or EdDSA
+	Public    crypto.PublicKey
+	Private   crypto.Signer // nil for verify-only keys kept around during rotation
+	Ephemeral bool          // generated at startup for development
+}
+
+// JWTKeySet holds the key new tokens are signed with plus every key tokens may still be verified with
+type JWTKeySet struct {
+	Signing *JWTKey
+	Verify  []*JWTKey // signing key first, then older keys
+}
+
+var (
+	jwtKeys     *JWTKeySet
+	jwtKeysOnce sync.Once
+)
+
+// Load signing keys at startup. In production (APP_ENV=production) a missing or broken key is fatal;
+// elsewhere a throwaway Ed25519 key is generated so development works without setup.
+func initJWTKeys() {
+	keys, err := loadJWTKeysFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to load JWT signing keys: %v", err)
+	}
+	jwtKeys = keys
+	if keys.Signing.Ephemeral {
+		log.Printf("⚠️  No JWT_PRIVATE_KEY configured; using an ephemeral %s key (tokens won't survive a restart)", keys.Signing.Method.Alg())
+	} else {
+		log.Printf("🔑 JWT signing with %s key %s (%d verification key(s))", keys.Signing.Method.Alg(), keys.Signing.ID, len(keys.Verify))
+	}
+}
+
+// Key set in use, loading it on first use when initJWTKeys hasn't run (e.g. in tests)
+func currentJWTKeys() *JWTKeySet {
+	jwtKeysOnce.Do(func() {
+		if jwtKeys != nil {
+			return
+		}
+		keys, err := loadJWTKeysFromEnv()
+		if err != nil {
+			log.Fatalf("Failed to load JWT signing keys: %v", err)
+		}
+		jwtKeys = keys
+	})
+	return jwtKeys
+}
+
+// Read JWT_PRIVATE_KEY (or JWT_PRIVATE_KEY_FILE) and the optional older public keys in
+// JWT_PUBLIC_KEYS (or JWT_PUBLIC_KEYS_FILE)
+func loadJWTKeysFromEnv() (*JWTKeySet, error) {
+	privatePEM, err := readKeyMaterial("JWT_PRIVATE_KEY")
+	if err != nil {
+		return nil, err
+	}
+	publicPEM, err := readKeyMaterial("JWT_PUBLIC_KEYS")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(privatePEM) == 0 {
+		if os.Getenv("APP_ENV") == "production" {
+			return nil, errors.New("JWT_PRIVATE_KEY or JWT_PRIVATE_KEY_FILE must be set in production")
+		}
+		return newEphemeralKeySet(publicPEM)
+	}
+
+	return parseJWTKeySet(privatePEM, publicPEM)
+}
+
+// Key material from an environment variable, or from the file named by <name>_FILE.
+// Escaped newlines are accepted so a PEM fits on one line in .env files.
+func readKeyMaterial(name string) ([]byte, error) {
+	if value := os.Getenv(name); value != "" {
+		return []byte(strings.ReplaceAll(value, `\n`, "\n")), nil
+	}
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s_FILE: %v", name, err)
+		}
+		return data, nil
+	}
+	return nil, nil
+}
+
+func newEphemeralKeySet(publicPEM []byte) (*JWTKeySet, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	key, err := newJWTKey(private)
+	if err != nil {
+		return nil, err
+	}
+	key.Ephemeral = true
+	return buildKeySet(key, publicPEM)
+}
+
+// Build a key set from a PEM private key (PKCS#8, or PKCS#1 for RSA) and zero or more PEM public keys
+func parseJWTKeySet(privatePEM, publicPEM []byte) (*JWTKeySet, error) {
+	block, _ := pem.Decode(privatePEM)
+	if block == nil {
+		return nil, errors.New("JWT private key is not PEM encoded")
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported JWT private key type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing JWT private key: %v", err)
+	}
+
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("JWT private key can't sign")
+	}
+	key, err := newJWTKey(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	return buildKeySet(key, publicPEM)
+}
+
+func buildKeySet(signing *JWTKey, publicPEM []byte) (*JWTKeySet, error) {
+	keys := &JWTKeySet{Signing: signing, Verify: []*JWTKey{signing}}
+
+	for rest := publicPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("unsupported JWT public key type %q", block.Type)
+		}
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing JWT public key: %v", err)
+		}
+		key, err := newJWTVerifyKey(public)
+		if err != nil {
+			return nil, err
+		}
+		if keys.Find(key.ID) == nil {
+			keys.Verify = append(keys.Verify, key)
+		}
+	}
+
+	return keys, nil
+}
+
+func newJWTKey(signer crypto.Signer) (*JWTKey, error) {
+	key, err := newJWTVerifyKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	key.Private = signer
+	return key, nil
+}
+
+// Pick the algorithm for a public key and derive its kid (a truncated SHA-256 of the key)
+func newJWTVerifyKey(public crypto.PublicKey) (*JWTKey, error) {
+	var method jwt.SigningMethod
+	switch k := public.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA JWT keys must be at least 2048 bits, got %d", k.N.BitLen())
+		}
+		method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported JWT key type %T; use RSA or Ed25519", public)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+
+	return &JWTKey{
+		ID:     base64.RawURLEncoding.EncodeToString(sum[:12]),
+		Method: method,
+		Public: public,
+	}, nil
+}
+
+// Find a verification key by kid
+func (ks *JWTKeySet) Find(kid string) *JWTKey {
+	for _, key := range ks.Verify {
+		if key.ID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+// Sign claims with the current key, setting the kid header
+func (ks *JWTKeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.Signing.Method, claims)
+	token.Header["kid"] = ks.Signing.ID
+	return token.SignedString(ks.Signing.Private)
+}
+
+// Key lookup for jwt.Parse: the kid must be known and the token's algorithm must match that key
+func (ks *JWTKeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key := ks.Find(kid)
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("algorithm %s does not match key %s", token.Method.Alg(), kid)
+	}
+	return key.Public, nil
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA modulus
+	E   string `json:"e,omitempty"`   // RSA exponent
+	Crv string `json:"crv,omitempty"` // OKP curve
+	X   string `json:"x,omitempty"`   // OKP public key
+}
+
+// Public keys for /.well-known/jwks.json
+func (ks *JWTKeySet) JWKS() []JWK {
+	jwks := make([]JWK, 0, len(ks.Verify))
+	for _, key := range ks.Verify {
+		jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch public := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks
+}
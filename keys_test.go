@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func pemBlock(t *testing.T, blockType string, der []byte, err error) []byte {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("marshal %s: %v", blockType, err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+// TestParseJWTKeySet tests loading RSA and Ed25519 signing keys plus older verification keys
+func TestParseJWTKeySet(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey() error = %v", err)
+	}
+	oldPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	rsaPEM := pemBlock(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), nil)
+	der, err := x509.MarshalPKIXPublicKey(oldPublic)
+	oldPEM := pemBlock(t, "PUBLIC KEY", der, err)
+
+	keys, err := parseJWTKeySet(rsaPEM, oldPEM)
+	if err != nil {
+		t.Fatalf("parseJWTKeySet() error = %v", err)
+	}
+	if keys.Signing.Method != jwt.SigningMethodRS256 {
+		t.Errorf("signing method = %s, want RS256", keys.Signing.Method.Alg())
+	}
+	if len(keys.Verify) != 2 {
+		t.Fatalf("verify keys = %d, want 2", len(keys.Verify))
+	}
+	if keys.Verify[1].Private != nil || keys.Verify[1].Method != jwt.SigningMethodEdDSA {
+		t.Error("older public key should be a verify-only EdDSA key")
+	}
+
+	// PKCS#8 Ed25519 key with escaped newlines, as it would appear in a .env file
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, err = x509.MarshalPKCS8PrivateKey(edKey)
+	edPEM := pemBlock(t, "PRIVATE KEY", der, err)
+	t.Setenv("JWT_PRIVATE_KEY", strings.ReplaceAll(string(edPEM), "\n", `\n`))
+	envKeys, err := loadJWTKeysFromEnv()
+	if err != nil {
+		t.Fatalf("loadJWTKeysFromEnv() error = %v", err)
+	}
+	if envKeys.Signing.Method != jwt.SigningMethodEdDSA || envKeys.Signing.Ephemeral {
+		t.Error("JWT_PRIVATE_KEY should load a configured EdDSA key")
+	}
+
+	// Small RSA keys and garbage are rejected
+	weak, _ := rsa.GenerateKey(rand.Reader, 1024)
+	if _, err := parseJWTKeySet(pemBlock(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(weak), nil), nil); err == nil {
+		t.Error("parseJWTKeySet() accepted a 1024-bit RSA key")
+	}
+	if _, err := parseJWTKeySet([]byte("not a key"), nil); err == nil {
+		t.Error("parseJWTKeySet() accepted data that isn't PEM")
+	}
+}
+
+// TestJWTKeyRotation tests tokens from a retired key still verify while it is listed
+func TestJWTKeyRotation(t *testing.T) {
+	oldKeys, err := newEphemeralKeySet(nil)
+	if err != nil {
+		t.Fatalf("newEphemeralKeySet() error = %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(oldKeys.Signing.Public)
+	oldPEM := pemBlock(t, "PUBLIC KEY", der, err)
+
+	newKeys, err := newEphemeralKeySet(oldPEM)
+	if err != nil {
+		t.Fatalf("newEphemeralKeySet() error = %v", err)
+	}
+
+	claims := Claims{UserID: 5}
+	oldToken, _ := oldKeys.Sign(claims)
+	if _, err := jwt.ParseWithClaims(oldToken, &Claims{}, newKeys.Keyfunc); err != nil {
+		t.Errorf("token from the retired key rejected: %v", err)
+	}
+	newToken, _ := newKeys.Sign(claims)
+	if _, err := jwt.ParseWithClaims(newToken, &Claims{}, oldKeys.Keyfunc); err == nil {
+		t.Error("old key set accepted a token from a key it doesn't list")
+	}
+
+	// Known kid but the wrong algorithm
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	hs.Header["kid"] = newKeys.Signing.ID
+	hsToken, _ := hs.SignedString([]byte("secret"))
+	if _, err := jwt.ParseWithClaims(hsToken, &Claims{}, newKeys.Keyfunc); err == nil {
+		t.Error("Keyfunc accepted an algorithm that doesn't match the key")
+	}
+}
+
+// TestJWKS tests the published key format
+func TestJWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keys, err := parseJWTKeySet(pemBlock(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), nil), nil)
+	if err != nil {
+		t.Fatalf("parseJWTKeySet() error = %v", err)
+	}
+	edKeys, _ := newEphemeralKeySet(nil)
+	keys.Verify = append(keys.Verify, edKeys.Signing)
+
+	jwks := keys.JWKS()
+	if len(jwks) != 2 {
+		t.Fatalf("JWKS() = %d keys, want 2", len(jwks))
+	}
+	if k := jwks[0]; k.Kty != "RSA" || k.Alg != "RS256" || k.E != "AQAB" || k.N == "" || k.Kid != keys.Signing.ID {
+		t.Errorf("RSA JWK = %+v", k)
+	}
+	if k := jwks[1]; k.Kty != "OKP" || k.Crv != "Ed25519" || k.Alg != "EdDSA" || len(k.X) != 43 {
+		t.Errorf("Ed25519 JWK = %+v", k)
+	}
+}
+
+// TestJWTKeysRequiredInProduction tests production refuses to start without a configured key
+func TestJWTKeysRequiredInProduction(t *testing.T) {
+	os.Unsetenv("JWT_PRIVATE_KEY")
+	os.Unsetenv("JWT_PRIVATE_KEY_FILE")
+	t.Setenv("APP_ENV", "production")
+	if _, err := loadJWTKeysFromEnv(); err == nil {
+		t.Error("loadJWTKeysFromEnv() succeeded in production with no key")
+	}
+
+	t.Setenv("APP_ENV", "development")
+	keys, err := loadJWTKeysFromEnv()
+	if err != nil || !keys.Signing.Ephemeral {
+		t.Errorf("development should fall back to an ephemeral key (err = %v)", err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EmailMessage is a plain-text email
+type EmailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email (password resets, verification links)
+type Mailer interface {
+	Send(msg EmailMessage) error
+}
+
+// Mailer used by the auth handlers
+var mailer Mailer = &LogMailer{}
+
+// Pick the mail backend at startup. A bad MAIL_DRIVER is fatal.
+func initMailer() {
+	m, err := loadMailerFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid mail settings: %v", err)
+	}
+	mailer = m
+}
+
+// Mail backend from MAIL_DRIVER: "smtp", or "log" (default) for development and tests.
+// The log driver writes reset and verification links, tokens included, where anyone
+// reading the logs can use them, so production (APP_ENV=production) must use smtp.
+func loadMailerFromEnv() (Mailer, error) {
+	driver := os.Getenv("MAIL_DRIVER")
+	switch driver {
+	case "", "log":
+		if os.Getenv("APP_ENV") == "production" {
+			return nil, errors.New("MAIL_DRIVER must be smtp in production")
+		}
+		return &LogMailer{Dir: os.Getenv("MAIL_LOG_DIR")}, nil
+	case "smtp":
+		return &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     getEnvInt("SMTP_PORT", 587),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_DRIVER %q", driver)
+	}
+}
+
+// SMTPMailer sends email through an SMTP server with PLAIN auth
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg EmailMessage) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	addr := fmt.Sprintf("%s:%d", m.Host, m.Port)
+	return smtp.SendMail(addr, auth, m.From, []string{msg.To}, buildEmail(m.From, msg, time.Now()))
+}
+
+// LogMailer writes each message to a .eml file in Dir, or to the log when Dir is empty
+type LogMailer struct {
+	Dir string
+}
+
+func (m *LogMailer) Send(msg EmailMessage) error {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@merch.ke"
+	}
+	data := buildEmail(from, msg, time.Now())
+
+	if m.Dir == "" {
+		log.Printf("📧 Email to %s\n%s", msg.To, data)
+		return nil
+	}
+
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_").Replace(msg.To))
+	return os.WriteFile(filepath.Join(m.Dir, name), data, 0644)
+}
+
+// Render a message with the headers SMTP servers expect
+func buildEmail(from string, msg EmailMessage, date time.Time) []byte {
+	// Strip line breaks from header values so user input can't inject headers
+	clean := strings.NewReplacer("\r", "", "\n", "")
+
+	var b strings.Builder
+	b.WriteString("From: " + clean.Replace(from) + "\r\n")
+	b.WriteString("To: " + clean.Replace(msg.To) + "\r\n")
+	b.WriteString("Subject: " + clean.Replace(msg.Subject) + "\r\n")
+	b.WriteString("Date: " + date.Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// Send an email in the background so response times don't reveal whether an account exists
+func sendEmailAsync(msg EmailMessage) {
+	go func() {
+		if err := mailer.Send(msg); err != nil {
+			log.Printf("⚠️  Failed to send email to %s: %v", msg.To, err)
+		}
+	}()
+}
+
+// Public URL of the storefront, used to build links in emails
+func appBaseURL() string {
+	base := os.Getenv("APP_BASE_URL")
+	if base == "" {
+		base = "http://localhost:3000"
+	}
+	return strings.TrimRight(base, "/")
+}
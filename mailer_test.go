@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBuildEmail tests headers and header injection protection
+func TestBuildEmail(t *testing.T) {
+	msg := EmailMessage{
+		To:      "jane@example.com\r\nBcc: everyone@example.com",
+		Subject: "Reset your password",
+		Body:    "Line one\nLine two",
+	}
+
+	data := string(buildEmail("no-reply@merch.ke", msg, time.Date(2025, 10, 1, 9, 0, 0, 0, time.UTC)))
+
+	if !strings.Contains(data, "Subject: Reset your password\r\n") {
+		t.Errorf("missing subject header in:\n%s", data)
+	}
+	if strings.Contains(data, "\r\nBcc:") {
+		t.Error("line breaks in the recipient were not stripped")
+	}
+	if !strings.HasSuffix(data, "\r\n\r\nLine one\r\nLine two") {
+		t.Errorf("body not separated or not CRLF-normalised:\n%q", data)
+	}
+}
+
+// TestLogMailer tests that the development mailer writes messages to disk
+func TestLogMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := &LogMailer{Dir: dir}
+
+	if err := m.Send(EmailMessage{To: "jane@example.com", Subject: "Hello", Body: "Token: abc123"}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected one .eml file, got %d (%v)", len(entries), err)
+	}
+	if !strings.HasSuffix(entries[0].Name(), "jane_at_example.com.eml") {
+		t.Errorf("file name = %q", entries[0].Name())
+	}
+
+	data, _ := os.ReadFile(dir + "/" + entries[0].Name())
+	if !strings.Contains(string(data), "Token: abc123") {
+		t.Errorf("message body missing from file:\n%s", data)
+	}
+}
+
+// TestLoadMailerFromEnv tests driver selection and that production can't log emails
+func TestLoadMailerFromEnv(t *testing.T) {
+	tests := []struct {
+		env, driver string
+		wantErr     bool
+	}{
+		{env: "development", driver: "", wantErr: false},
+		{env: "development", driver: "log", wantErr: false},
+		{env: "production", driver: "", wantErr: true},
+		{env: "production", driver: "log", wantErr: true},
+		{env: "production", driver: "smtp", wantErr: false},
+		{env: "development", driver: "pigeon", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("APP_ENV", tt.env)
+		t.Setenv("MAIL_DRIVER", tt.driver)
+		if _, err := loadMailerFromEnv(); (err != nil) != tt.wantErr {
+			t.Errorf("loadMailerFromEnv() with APP_ENV=%s MAIL_DRIVER=%q error = %v, wantErr %v", tt.env, tt.driver, err, tt.wantErr)
+		}
+	}
+}
@@ -1,79 +1,182 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 )
 
 func main() {
+	// Token signing keys (fatal in production when none is configured)
+	initJWTKeys()
+
+	// Loyalty points earning rules (fatal when misconfigured)
+	initPointsRules()
+
 	// Initialize database connection
 	initDatabase()
 	defer closeDatabase()
 
+	// Background jobs
+	startReservationSweeper(getEnvDuration("RESERVATION_SWEEP_SECONDS", 60, time.Second))
+	startPointsExpirySweeper(getEnvDuration("POINTS_EXPIRY_SWEEP_HOURS", 24, time.Hour))
+
+	// Storage for uploaded product images
+	initStorage()
+
+	// Outgoing email (password resets, email verification)
+	initMailer()
+
+	// Client IPs behind a load balancer (fatal when the proxies aren't listed)
+	proxies, err := trustedProxies()
+	if err != nil {
+		log.Fatalf("Invalid proxy settings: %v", err)
+	}
+
 	app := fiber.New(fiber.Config{
 		AppName: "Merch Ke API",
+		// Behind a load balancer set PROXY_HEADER (e.g. X-Forwarded-For) so login throttling sees
+		// client IPs. The header is only read from TRUSTED_PROXIES; anyone else could forge it.
+		ProxyHeader:             os.Getenv("PROXY_HEADER"),
+		EnableTrustedProxyCheck: len(proxies) > 0,
+		TrustedProxies:          proxies,
+		EnableIPValidation:      true,
 	})
 
+	// Image uploads may exceed the default body limit; every other route keeps it
+	app.Server().HeaderReceived = requestBodyConfig
+
 	app.Use(cors.New())
 
+	// Serve locally stored uploads
+	if local, ok := imageStorage.(*LocalStorage); ok && strings.HasPrefix(local.BaseURL, "/") {
+		app.Static(local.BaseURL, local.Dir)
+	}
+
 	// Public routes
 	app.Get("/health", healthHandler)
+	app.Get("/.well-known/jwks.json", jwksHandler) // Public keys for verifying access tokens
 	app.Get("/api/products", productsHandler)
+	app.Get("/api/products/search", searchProductsHandler) // Must come before /api/products/:id
+	app.Get("/api/products/slug/:slug", productBySlugHandler)
 	app.Get("/api/products/:id", singleProductHandler)
 	app.Get("/api/products/:productId/images", getProductImagesHandler) // Get product images
 	app.Get("/api/categories", categoriesHandler)
+	app.Get("/api/categories/tree", categoryTreeHandler)
+	app.Get("/api/categories/slug/:slug", categoryBySlugHandler)
+	app.Get("/api/categories/:id/breadcrumbs", categoryBreadcrumbsHandler)
 
 	// Authentication routes
 	app.Post("/api/auth/register", registerHandler)
 	app.Post("/api/auth/login", loginHandler)
+	app.Post("/api/auth/refresh", refreshTokenHandler)
+	app.Post("/api/auth/forgot-password", forgotPasswordHandler)
+	app.Post("/api/auth/reset-password", resetPasswordHandler)
+	app.Post("/api/auth/verify-email", verifyEmailHandler)
+	app.Post("/api/auth/2fa/verify", mfaVerifyHandler) // Second login step
 
 	// Protected routes (require authentication)
 	app.Get("/api/auth/profile", authMiddleware, profileHandler)
+	app.Put("/api/auth/profile", authMiddleware, updateProfileHandler)
+	app.Post("/api/auth/change-password", authMiddleware, changePasswordHandler)
+	app.Post("/api/auth/logout", authMiddleware, logoutHandler)
+	app.Post("/api/auth/resend-verification", authMiddleware, resendVerificationHandler)
+	app.Post("/api/auth/2fa/setup", authMiddleware, mfaSetupHandler)
+	app.Post("/api/auth/2fa/enable", authMiddleware, mfaEnableHandler)
+	app.Post("/api/auth/2fa/disable", authMiddleware, mfaDisableHandler)
+
+	// Address book routes (authenticated users only)
+	app.Get("/api/auth/addresses", authMiddleware, getAddressesHandler)
+	app.Post("/api/auth/addresses", authMiddleware, createAddressHandler)
+	app.Get("/api/auth/addresses/:id", authMiddleware, getAddressHandler)
+	app.Put("/api/auth/addresses/:id", authMiddleware, updateAddressHandler)
+	app.Delete("/api/auth/addresses/:id", authMiddleware, deleteAddressHandler)
 
 	// Cart routes (work for both authenticated and guest users)
 	app.Post("/api/cart", optionalAuthMiddleware, addToCartHandler)
 	app.Get("/api/cart", optionalAuthMiddleware, getCartHandler)
-	app.Put("/api/cart/:productId", optionalAuthMiddleware, updateCartHandler)
-	app.Delete("/api/cart/:productId", optionalAuthMiddleware, removeFromCartHandler)
+	app.Put("/api/cart/:variantId", optionalAuthMiddleware, updateCartHandler)
+	app.Delete("/api/cart/:variantId", optionalAuthMiddleware, removeFromCartHandler)
 
 	// Cart migration route (for when guest users register/login)
 	app.Post("/api/cart/migrate", authMiddleware, migrateCartHandler)
 
 	// Points routes (authenticated users only)
 	app.Get("/api/points", authMiddleware, getUserPointsHandler)
+	app.Get("/api/points/transactions", authMiddleware, getPointsTransactionsHandler) // Paginated points history
+
+	// Checkout reservation routes (hold stock while the customer pays)
+	app.Post("/api/checkout/reservation", optionalAuthMiddleware, createReservationHandler)
+	app.Get("/api/checkout/reservation", optionalAuthMiddleware, getReservationHandler)
+	app.Delete("/api/checkout/reservation", optionalAuthMiddleware, releaseReservationHandler)
+
+	// Signed-in users can be required to verify their email before checkout or wallet top-ups
+	verifiedForCheckout := requireVerifiedEmail("REQUIRE_VERIFIED_EMAIL_CHECKOUT")
+	verifiedForWallet := requireVerifiedEmail("REQUIRE_VERIFIED_EMAIL_WALLET")
 
 	// Order routes
-	app.Post("/api/orders", optionalAuthMiddleware, createOrderHandler) // Create order from cart
-	app.Get("/api/orders/:id", optionalAuthMiddleware, getOrderHandler) // Get specific order
-	app.Get("/api/orders", authMiddleware, getUserOrdersHandler)        // Get user's orders
+	app.Post("/api/orders", optionalAuthMiddleware, verifiedForCheckout, createOrderHandler) // Create order from cart
+	app.Get("/api/orders/:id", optionalAuthMiddleware, getOrderHandler)                      // Get specific order
+	app.Get("/api/orders", authMiddleware, getUserOrdersHandler)                             // Get user's orders
 
 	// Wallet routes (authenticated users only)
 	app.Get("/api/wallet/balance", authMiddleware, getWalletBalanceHandler)
 	app.Get("/api/wallet/transactions", authMiddleware, getWalletTransactionsHandler)
-	app.Post("/api/wallet/add-tokens", authMiddleware, addTokensHandler) // For demo: add tokens
+	app.Post("/api/wallet/add-tokens", authMiddleware, verifiedForWallet, addTokensHandler) // For demo: add tokens
 
-	// Admin routes (require admin privileges)
+	// Admin routes (staff roles only; each route checks the permission it needs)
 	admin := app.Group("/api/admin", authMiddleware, adminMiddleware)
-	admin.Post("/products", adminCreateProductHandler)
-	admin.Put("/products/:id", adminUpdateProductHandler)
-	admin.Delete("/products/:id", adminDeleteProductHandler)
-	admin.Get("/products", adminGetProductsHandler)
-	admin.Post("/categories", adminCreateCategoryHandler)
-	admin.Put("/categories/:id", adminUpdateCategoryHandler)
-	admin.Delete("/categories/:id", adminDeleteCategoryHandler)
-	admin.Get("/categories", adminGetCategoriesHandler)
+	canEditCatalog := requirePermission(permCatalogWrite)
+	canFulfilOrders := requirePermission(permOrdersFulfil)
+	canReadCustomers := requirePermission(permCustomersRead)
+	canWriteCustomers := requirePermission(permCustomersWrite)
+	canAdjustWallets := requirePermission(permWalletAdjust)
+
+	admin.Post("/products", canEditCatalog, adminCreateProductHandler)
+	admin.Put("/products/:id", canEditCatalog, adminUpdateProductHandler)
+	admin.Delete("/products/:id", canEditCatalog, adminDeleteProductHandler)
+	admin.Get("/products", canEditCatalog, adminGetProductsHandler)
+	// Product variant management
+	admin.Get("/products/:id/variants", canEditCatalog, adminGetProductVariantsHandler)
+	admin.Post("/products/:id/variants", canEditCatalog, adminCreateProductVariantHandler)
+	admin.Put("/products/:id/variants/:variantId", canEditCatalog, adminUpdateProductVariantHandler)
+	admin.Delete("/products/:id/variants/:variantId", canEditCatalog, adminDeleteProductVariantHandler)
+	admin.Post("/categories", canEditCatalog, adminCreateCategoryHandler)
+	admin.Put("/categories/:id", canEditCatalog, adminUpdateCategoryHandler)
+	admin.Delete("/categories/:id", canEditCatalog, adminDeleteCategoryHandler)
+	admin.Get("/categories", canEditCatalog, adminGetCategoriesHandler)
 	// Product image management
-	admin.Post("/products/:productId/images", adminCreateProductImageHandler) // Create product image
-	admin.Put("/images/:imageId", adminUpdateProductImageHandler)             // Update product image
-	admin.Delete("/images/:imageId", adminDeleteProductImageHandler)          // Delete product image
-	admin.Get("/orders", adminGetOrdersHandler)                               // Get all orders
-	admin.Get("/orders/:id", adminGetOrderHandler)                            // Get single order
-	admin.Put("/orders/:id/status", adminUpdateOrderStatusHandler)            // Update order status
-	admin.Get("/customers", adminGetCustomersHandler)                         // Get all customers
+	admin.Post("/products/:productId/images/upload", canEditCatalog, adminUploadProductImageHandler) // Upload image file with renditions
+	admin.Post("/products/:productId/images", canEditCatalog, adminCreateProductImageHandler)        // Create product image
+	admin.Put("/images/:imageId", canEditCatalog, adminUpdateProductImageHandler)                    // Update product image
+	admin.Delete("/images/:imageId", canEditCatalog, adminDeleteProductImageHandler)                 // Delete product image
+	// Orders and fulfilment
+	admin.Get("/orders", canFulfilOrders, adminGetOrdersHandler)                    // Get all orders
+	admin.Get("/orders/:id", canFulfilOrders, adminGetOrderHandler)                 // Get single order
+	admin.Put("/orders/:id/status", canFulfilOrders, adminUpdateOrderStatusHandler) // Update order status
+	admin.Get("/reservations", canFulfilOrders, adminGetReservationsHandler)        // Active stock holds
+	// Customers
+	admin.Get("/customers", canReadCustomers, adminGetCustomersHandler)                 // Search customers
+	admin.Get("/users", canReadCustomers, adminSearchUsersHandler)                      // Search users of any role
+	admin.Get("/users/:id", canReadCustomers, adminGetUserHandler)                      // User with orders, wallet and points
+	admin.Post("/users/:id/deactivate", canWriteCustomers, setUserActiveHandler(false)) // Disable account and sign out
+	admin.Post("/users/:id/reactivate", canWriteCustomers, setUserActiveHandler(true))  // Re-enable account
+	admin.Post("/users/:id/unlock", canWriteCustomers, adminUnlockUserHandler)          // Clear login lockout
+	admin.Post("/users/:id/wallet/adjust", canAdjustWallets, adminAdjustWalletHandler)  // Credit or debit a wallet
+	// Roles (super admin only)
+	admin.Get("/permissions", superAdminMiddleware, adminGetPermissionsHandler)
+	admin.Get("/roles", superAdminMiddleware, adminGetRolesHandler)
+	admin.Post("/roles", superAdminMiddleware, adminCreateRoleHandler)
+	admin.Put("/roles/:name", superAdminMiddleware, adminUpdateRoleHandler)
+	admin.Delete("/roles/:name", superAdminMiddleware, adminDeleteRoleHandler)
+	admin.Put("/users/:id/role", superAdminMiddleware, adminAssignRoleHandler)
 
 	// Get port from environment variable (Cloud Run sets this)
 	port := os.Getenv("PORT")
@@ -93,7 +196,62 @@ func healthHandler(c *fiber.Ctx) error {
 }
 
 func productsHandler(c *fiber.Ctx) error {
-	products, err := getProductsFromDB()
+	params := ProductListParams{
+		Sort:         c.Query("sort", "newest"),
+		FeaturedOnly: c.QueryBool("featured", false),
+		InStockOnly:  c.QueryBool("in_stock", false),
+		Limit:        c.QueryInt("limit", 20),
+	}
+
+	if _, ok := productSortOptions[params.Sort]; !ok {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid sort. Use one of: newest, price_asc, price_desc, name",
+		})
+	}
+
+	if params.Limit <= 0 || params.Limit > 100 {
+		params.Limit = 20
+	}
+
+	if categoryStr := c.Query("category_id"); categoryStr != "" {
+		id, err := strconv.Atoi(categoryStr)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid category ID",
+			})
+		}
+		params.CategoryID = &id
+	}
+
+	for key, target := range map[string]**float64{"min_price": &params.MinPrice, "max_price": &params.MaxPrice} {
+		if priceStr := c.Query(key); priceStr != "" {
+			price, err := strconv.ParseFloat(priceStr, 64)
+			if err != nil || price < 0 {
+				return c.Status(400).JSON(fiber.Map{
+					"error": "Invalid " + key,
+				})
+			}
+			*target = &price
+		}
+	}
+
+	if params.MinPrice != nil && params.MaxPrice != nil && *params.MinPrice > *params.MaxPrice {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "min_price cannot be greater than max_price",
+		})
+	}
+
+	if cursorStr := c.Query("cursor"); cursorStr != "" {
+		cursor, err := decodeProductCursor(cursorStr)
+		if err != nil || cursor.Sort != params.Sort {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid cursor",
+			})
+		}
+		params.Cursor = cursor
+	}
+
+	products, nextCursor, err := getProductsFromDB(&params)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error":   "Failed to fetch products",
@@ -101,9 +259,16 @@ func productsHandler(c *fiber.Ctx) error {
 		})
 	}
 
+	var next interface{}
+	if nextCursor != "" {
+		next = nextCursor
+	}
+
 	return c.JSON(fiber.Map{
-		"products": products,
-		"total":    len(products),
+		"products":    products,
+		"total":       len(products),
+		"limit":       params.Limit,
+		"next_cursor": next,
 	})
 }
 
@@ -132,9 +297,120 @@ func singleProductHandler(c *fiber.Ctx) error {
 		})
 	}
 
+	return sendProductDetail(c, product)
+}
+
+func productBySlugHandler(c *fiber.Ctx) error {
+	slug := c.Params("slug")
+
+	product, err := getProductBySlug(slug)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return redirectOldSlug(c, "product", slug, "Product not found")
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to fetch product",
+			"details": err.Error(),
+		})
+	}
+
+	return sendProductDetail(c, product)
+}
+
+// Respond with a product and its purchasable variants
+func sendProductDetail(c *fiber.Ctx, product *Product) error {
+	// Attach purchasable variants with their effective price
+	variants, err := getProductVariants(product.ID, true)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to fetch product variants",
+			"details": err.Error(),
+		})
+	}
+	product.Variants = variants
+
 	return c.JSON(product)
 }
 
+// Redirect a renamed product or category to its current slug, or 404 if the slug was never used
+func redirectOldSlug(c *fiber.Ctx, entityType, slug, notFoundMessage string) error {
+	current, err := resolveOldSlug(entityType, slug)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return c.Status(404).JSON(fiber.Map{
+				"error": notFoundMessage,
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to resolve slug",
+			"details": err.Error(),
+		})
+	}
+
+	location := slugPath(entityType, current)
+	c.Set(fiber.HeaderLocation, location)
+	return c.Status(301).JSON(fiber.Map{
+		"error":       "This slug has changed",
+		"slug":        current,
+		"redirect_to": location,
+	})
+}
+
+// Public lookup path for a product or category slug
+func slugPath(entityType, slug string) string {
+	prefix := "/api/products/slug/"
+	if entityType == "category" {
+		prefix = "/api/categories/slug/"
+	}
+	return prefix + url.PathEscape(slug)
+}
+
+func searchProductsHandler(c *fiber.Ctx) error {
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Search query (q) is required",
+		})
+	}
+
+	tsQuery := buildSearchTSQuery(q)
+	if tsQuery == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Search query must contain letters or numbers",
+		})
+	}
+
+	var categoryID *int
+	if categoryStr := c.Query("category_id"); categoryStr != "" {
+		id, err := strconv.Atoi(categoryStr)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid category ID",
+			})
+		}
+		categoryID = &id
+	}
+
+	limit := c.QueryInt("limit", 20)
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	results, err := searchProducts(tsQuery, categoryID, limit)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to search products",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"query":    q,
+		"products": results,
+		"total":    len(results),
+	})
+}
+
 func categoriesHandler(c *fiber.Ctx) error {
 	categories, err := getCategoriesFromDB()
 	if err != nil {
@@ -150,6 +426,63 @@ func categoriesHandler(c *fiber.Ctx) error {
 	})
 }
 
+func categoryBySlugHandler(c *fiber.Ctx) error {
+	slug := c.Params("slug")
+
+	category, err := getCategoryBySlug(slug)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return redirectOldSlug(c, "category", slug, "Category not found")
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to fetch category",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(category)
+}
+
+func categoryTreeHandler(c *fiber.Ctx) error {
+	tree, err := getCategoryTree()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to fetch category tree",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"categories": tree,
+	})
+}
+
+func categoryBreadcrumbsHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid category ID",
+		})
+	}
+
+	breadcrumbs, err := getCategoryBreadcrumbs(id)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Category not found",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to fetch breadcrumbs",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"breadcrumbs": breadcrumbs,
+	})
+}
+
 func parseID(id string) int {
 	if id == "1" {
 		return 1
@@ -159,3 +492,47 @@ func parseID(id string) int {
 	}
 	return 0
 }
+
+// Read an integer setting from the environment, falling back to a default
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Read a positive duration setting, given in whole units, from the environment. Zero and
+// negative values fall back to the default too, since they would stop a ticker from starting.
+func getEnvDuration(key string, fallback int, unit time.Duration) time.Duration {
+	value := getEnvInt(key, fallback)
+	if value <= 0 {
+		log.Printf("⚠️  %s must be positive; using %d", key, fallback)
+		value = fallback
+	}
+	return time.Duration(value) * unit
+}
+
+// Load balancer IPs or CIDR ranges allowed to set PROXY_HEADER, from the comma-separated
+// TRUSTED_PROXIES. Required whenever PROXY_HEADER is set.
+func trustedProxies() ([]string, error) {
+	proxies := []string{}
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if os.Getenv("PROXY_HEADER") != "" && len(proxies) == 0 {
+		return nil, fmt.Errorf("TRUSTED_PROXIES is required when PROXY_HEADER is set")
+	}
+	return proxies, nil
+}
+
+// Read a boolean setting from the environment, falling back to a default
+func getEnvBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
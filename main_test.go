@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestGetEnvDuration tests that zero, negative and invalid durations fall back to the default
+func TestGetEnvDuration(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: 60 * time.Second},
+		{value: "15", want: 15 * time.Second},
+		{value: "0", want: 60 * time.Second},
+		{value: "-5", want: 60 * time.Second},
+		{value: "soon", want: 60 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("TEST_SWEEP_SECONDS", tt.value)
+		if got := getEnvDuration("TEST_SWEEP_SECONDS", 60, time.Second); got != tt.want {
+			t.Errorf("getEnvDuration(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+// TestTrustedProxies tests that a proxy header needs the proxies it may come from
+func TestTrustedProxies(t *testing.T) {
+	tests := []struct {
+		header, proxies string
+		want            []string
+		wantErr         bool
+	}{
+		{header: "", proxies: "", want: []string{}},
+		{header: "X-Forwarded-For", proxies: "", wantErr: true},
+		{header: "X-Forwarded-For", proxies: " , ", wantErr: true},
+		{header: "X-Forwarded-For", proxies: "10.0.0.0/8, 192.168.1.10", want: []string{"10.0.0.0/8", "192.168.1.10"}},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("PROXY_HEADER", tt.header)
+		t.Setenv("TRUSTED_PROXIES", tt.proxies)
+		got, err := trustedProxies()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("trustedProxies(%q, %q) error = %v, wantErr %v", tt.header, tt.proxies, err, tt.wantErr)
+			continue
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("trustedProxies(%q, %q) = %v, want %v", tt.header, tt.proxies, got, tt.want)
+		}
+	}
+}
@@ -2,28 +2,103 @@ package main
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
+
+	"github.com/lib/pq"
 )
 
 // Product struct to match database
 type Product struct {
-	ID               int       `json:"id"`
-	Name             string    `json:"name"`
-	Slug             string    `json:"slug"`
-	Description      string    `json:"description"`
-	ShortDescription string    `json:"short_description"`
-	CategoryID       int       `json:"category_id"`
-	BasePrice        float64   `json:"base_price"`
-	SKUPrefix        string    `json:"sku_prefix"`
-	ImageURL         string    `json:"image_url,omitempty"`
-	IsActive         bool      `json:"is_active"`
-	IsFeatured       bool      `json:"is_featured"`
-	Weight           float64   `json:"weight"`
-	Dimensions       string    `json:"dimensions"`
-	CreatedAt        time.Time `json:"created_at"`
-	UpdatedAt        time.Time `json:"updated_at"`
+	ID               int              `json:"id"`
+	Name             string           `json:"name"`
+	Slug             string           `json:"slug"`
+	Description      string           `json:"description"`
+	ShortDescription string           `json:"short_description"`
+	CategoryID       int              `json:"category_id"`
+	BasePrice        float64          `json:"base_price"`
+	SKUPrefix        string           `json:"sku_prefix"`
+	ImageURL         string           `json:"image_url,omitempty"`
+	IsActive         bool             `json:"is_active"`
+	IsFeatured       bool             `json:"is_featured"`
+	Weight           float64          `json:"weight"`
+	Dimensions       string           `json:"dimensions"`
+	CreatedAt        time.Time        `json:"created_at"`
+	UpdatedAt        time.Time        `json:"updated_at"`
+	Variants         []ProductVariant `json:"variants,omitempty"`
+}
+
+// ProductVariant struct for sizes, colours and other purchasable options
+type ProductVariant struct {
+	ID                int       `json:"id"`
+	ProductID         int       `json:"product_id"`
+	SKU               string    `json:"sku"`
+	Size              *string   `json:"size,omitempty"`
+	Color             *string   `json:"color,omitempty"`
+	Material          *string   `json:"material,omitempty"`
+	PriceAdjustment   float64   `json:"price_adjustment"`
+	Price             float64   `json:"price"` // base_price + price_adjustment
+	StockQuantity     int       `json:"stock_quantity"`
+	LowStockThreshold int       `json:"low_stock_threshold"`
+	IsActive          bool      `json:"is_active"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// CreateVariantRequest struct for admin variant creation
+type CreateVariantRequest struct {
+	SKU               string  `json:"sku"`
+	Size              *string `json:"size,omitempty"`
+	Color             *string `json:"color,omitempty"`
+	Material          *string `json:"material,omitempty"`
+	PriceAdjustment   float64 `json:"price_adjustment"`
+	StockQuantity     int     `json:"stock_quantity"`
+	LowStockThreshold *int    `json:"low_stock_threshold,omitempty"`
+}
+
+// UpdateVariantRequest struct for variant updates
+type UpdateVariantRequest struct {
+	SKU               *string  `json:"sku,omitempty"`
+	Size              *string  `json:"size,omitempty"`
+	Color             *string  `json:"color,omitempty"`
+	Material          *string  `json:"material,omitempty"`
+	PriceAdjustment   *float64 `json:"price_adjustment,omitempty"`
+	StockQuantity     *int     `json:"stock_quantity,omitempty"`
+	LowStockThreshold *int     `json:"low_stock_threshold,omitempty"`
+	IsActive          *bool    `json:"is_active,omitempty"`
+}
+
+// ProductListParams holds the filters, sort and page position for product listings
+type ProductListParams struct {
+	CategoryID   *int     // includes child categories
+	MinPrice     *float64 // on base_price
+	MaxPrice     *float64
+	FeaturedOnly bool
+	InStockOnly  bool   // at least one active variant with stock
+	Sort         string // newest, price_asc, price_desc, name
+	Limit        int
+	Cursor       *productCursor
+}
+
+// productCursor marks the last product of a page under a given sort
+type productCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+// ProductSearchResult is a product with its search rank and highlighted text
+type ProductSearchResult struct {
+	Product
+	Rank          float64 `json:"rank"`
+	NameHighlight string  `json:"name_highlight"`
+	Snippet       string  `json:"snippet"`
 }
 
 // ProductImage struct for product images
@@ -39,6 +114,8 @@ type ProductImage struct {
 	FileSize     *int      `json:"file_size,omitempty"`
 	Width        *int      `json:"width,omitempty"`
 	Height       *int      `json:"height,omitempty"`
+	ThumbnailURL *string   `json:"thumbnail_url,omitempty"`
+	MediumURL    *string   `json:"medium_url,omitempty"`
 	IsPrimary    bool      `json:"is_primary"`
 	CreatedAt    time.Time `json:"created_at"`
 }
@@ -83,33 +160,233 @@ type Category struct {
 	UpdatedAt   time.Time `json:"updated_at"`
 }
 
-// Get all products from database
-func getProductsFromDB() ([]Product, error) {
-	query := `
-		SELECT p.id, p.name, p.slug, p.description, p.category_id, p.base_price, p.is_active, p.is_featured,
+// CategoryNode is a category in the nested tree with its product counts
+type CategoryNode struct {
+	Category
+	ProductCount      int             `json:"product_count"`       // active products directly in this category
+	TotalProductCount int             `json:"total_product_count"` // including all descendants
+	Children          []*CategoryNode `json:"children"`
+}
+
+// Sort orders accepted by the product listing, mapped to their ORDER BY column and direction
+var productSortOptions = map[string]struct {
+	Column string
+	Desc   bool
+}{
+	"newest":     {Column: "p.created_at", Desc: true},
+	"price_asc":  {Column: "p.base_price", Desc: false},
+	"price_desc": {Column: "p.base_price", Desc: true},
+	"name":       {Column: "p.name", Desc: false},
+}
+
+// SQL matching a category and all of its descendants; %s is the placeholder for the root ID
+const categorySubtreeSQL = `
+	WITH RECURSIVE subtree AS (
+		SELECT id FROM catalog.categories WHERE id = %s
+		UNION ALL
+		SELECT c.id FROM catalog.categories c JOIN subtree s ON c.parent_id = s.id
+	)
+	SELECT id FROM subtree
+`
+
+// Encode the position after the last product on a page
+func encodeProductCursor(cursor productCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decode a next_cursor value handed out by a previous page
+func decodeProductCursor(encoded string) (*productCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	var cursor productCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.ID <= 0 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	if _, ok := productSortOptions[cursor.Sort]; !ok {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	// The value is cast in SQL, so it has to match the sort column's type
+	switch cursor.Sort {
+	case "price_asc", "price_desc":
+		price, err := strconv.ParseFloat(cursor.Value, 64)
+		if err != nil || math.IsNaN(price) || math.IsInf(price, 0) {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+	case "newest":
+		if _, err := time.Parse(time.RFC3339Nano, cursor.Value); err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+	}
+
+	return &cursor, nil
+}
+
+// Cursor value for a product under the given sort
+func productCursorFor(p *Product, sort string) productCursor {
+	cursor := productCursor{Sort: sort, ID: p.ID}
+	switch sort {
+	case "price_asc", "price_desc":
+		cursor.Value = strconv.FormatFloat(p.BasePrice, 'f', -1, 64)
+	case "name":
+		cursor.Value = p.Name
+	default:
+		cursor.Value = p.CreatedAt.Format(time.RFC3339Nano)
+	}
+	return cursor
+}
+
+// Get a page of active products matching the listing filters.
+// Returns the next_cursor to continue from, or "" on the last page.
+func getProductsFromDB(params *ProductListParams) ([]Product, string, error) {
+	sort, ok := productSortOptions[params.Sort]
+	if !ok {
+		params.Sort = "newest"
+		sort = productSortOptions["newest"]
+	}
+
+	conditions := []string{"p.is_active = true"}
+	args := []interface{}{}
+	argIndex := 1
+
+	if params.CategoryID != nil {
+		conditions = append(conditions, fmt.Sprintf("p.category_id IN (%s)", fmt.Sprintf(categorySubtreeSQL, fmt.Sprintf("$%d", argIndex))))
+		args = append(args, *params.CategoryID)
+		argIndex++
+	}
+	if params.MinPrice != nil {
+		conditions = append(conditions, fmt.Sprintf("p.base_price >= $%d", argIndex))
+		args = append(args, *params.MinPrice)
+		argIndex++
+	}
+	if params.MaxPrice != nil {
+		conditions = append(conditions, fmt.Sprintf("p.base_price <= $%d", argIndex))
+		args = append(args, *params.MaxPrice)
+		argIndex++
+	}
+	if params.FeaturedOnly {
+		conditions = append(conditions, "p.is_featured = true")
+	}
+	if params.InStockOnly {
+		conditions = append(conditions, `EXISTS (
+			SELECT 1 FROM catalog.product_variants pv
+			WHERE pv.product_id = p.id AND pv.is_active = true AND pv.stock_quantity > 0
+		)`)
+	}
+
+	// Keyset pagination: continue strictly after the (sort value, id) of the previous page
+	direction, comparison := "ASC", ">"
+	if sort.Desc {
+		direction, comparison = "DESC", "<"
+	}
+	if params.Cursor != nil {
+		valueCast := ""
+		switch params.Sort {
+		case "price_asc", "price_desc":
+			valueCast = "::numeric"
+		case "newest":
+			valueCast = "::timestamp"
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s, p.id) %s ($%d%s, $%d)", sort.Column, comparison, argIndex, valueCast, argIndex+1))
+		args = append(args, params.Cursor.Value, params.Cursor.ID)
+		argIndex += 2
+	}
+
+	// Fetch one extra row to find out whether there is another page
+	args = append(args, params.Limit+1)
+
+	query := fmt.Sprintf(`
+		SELECT p.id, p.name, p.slug, p.description, p.category_id, p.base_price, p.is_active, p.is_featured, p.created_at,
 		       COALESCE((SELECT image_url FROM catalog.product_images WHERE product_id = p.id ORDER BY is_primary DESC, display_order LIMIT 1), '') as image_url
 		FROM catalog.products p
-		WHERE is_active = true 
-		ORDER BY created_at DESC
+		WHERE %s
+		ORDER BY %s %s, p.id %s
+		LIMIT $%d
+	`, strings.Join(conditions, " AND "), sort.Column, direction, direction, argIndex)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	products := []Product{}
+	for rows.Next() {
+		var p Product
+		err := rows.Scan(&p.ID, &p.Name, &p.Slug, &p.Description, &p.CategoryID, &p.BasePrice, &p.IsActive, &p.IsFeatured, &p.CreatedAt, &p.ImageURL)
+		if err != nil {
+			return nil, "", err
+		}
+		products = append(products, p)
+	}
+
+	nextCursor := ""
+	if len(products) > params.Limit {
+		products = products[:params.Limit]
+		nextCursor = encodeProductCursor(productCursorFor(&products[len(products)-1], params.Sort))
+	}
+
+	return products, nextCursor, nil
+}
+
+// Turn free text into a prefix-matching tsquery, e.g. "gopher hood" -> "gopher & hood:*".
+// Only letters and digits survive so user input can't inject tsquery operators.
+func buildSearchTSQuery(q string) string {
+	terms := strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(terms) == 0 {
+		return ""
+	}
+
+	// The last term is still being typed, so match it as a prefix for autocomplete
+	terms[len(terms)-1] += ":*"
+	return strings.Join(terms, " & ")
+}
+
+// Search active products using the full-text index, best matches first
+func searchProducts(tsQuery string, categoryID *int, limit int) ([]ProductSearchResult, error) {
+	// The WHERE expression must match idx_catalog_products_fulltext exactly for the index to be used
+	query := `
+		SELECT p.id, p.name, p.slug, p.description, p.category_id, p.base_price, p.is_active, p.is_featured,
+		       COALESCE((SELECT image_url FROM catalog.product_images WHERE product_id = p.id ORDER BY is_primary DESC, display_order LIMIT 1), '') as image_url,
+		       ts_rank(
+		           setweight(to_tsvector('english', coalesce(p.name,'')), 'A') ||
+		           setweight(to_tsvector('english', coalesce(p.description,'')), 'B'),
+		           q.query
+		       ) AS rank,
+		       ts_headline('english', coalesce(p.name,''), q.query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true') AS name_highlight,
+		       ts_headline('english', coalesce(p.description,''), q.query, 'StartSel=<mark>, StopSel=</mark>, MaxWords=30, MinWords=10, MaxFragments=2') AS snippet
+		FROM catalog.products p, to_tsquery('english', $1) AS q(query)
+		WHERE p.is_active = true
+		  AND to_tsvector('english', coalesce(p.name,'') || ' ' || coalesce(p.description,'')) @@ q.query
+		  AND ($2::int IS NULL OR p.category_id IN (` + fmt.Sprintf(categorySubtreeSQL, "$2") + `))
+		ORDER BY rank DESC, p.id
+		LIMIT $3
 	`
 
-	rows, err := db.Query(query)
+	rows, err := db.Query(query, tsQuery, categoryID, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var products []Product
+	results := []ProductSearchResult{}
 	for rows.Next() {
-		var p Product
-		err := rows.Scan(&p.ID, &p.Name, &p.Slug, &p.Description, &p.CategoryID, &p.BasePrice, &p.IsActive, &p.IsFeatured, &p.ImageURL)
+		var r ProductSearchResult
+		err := rows.Scan(&r.ID, &r.Name, &r.Slug, &r.Description, &r.CategoryID, &r.BasePrice, &r.IsActive, &r.IsFeatured, &r.ImageURL,
+			&r.Rank, &r.NameHighlight, &r.Snippet)
 		if err != nil {
 			return nil, err
 		}
-		products = append(products, p)
+		results = append(results, r)
 	}
 
-	return products, nil
+	return results, nil
 }
 
 // Get single product by ID
@@ -129,6 +406,40 @@ func getProductByID(id int) (*Product, error) {
 	return &p, nil
 }
 
+// Get single active product by slug
+func getProductBySlug(slug string) (*Product, error) {
+	query := `
+		SELECT id, name, slug, description, category_id, base_price, is_active, is_featured 
+		FROM catalog.products 
+		WHERE slug = $1 AND is_active
+	`
+
+	var p Product
+	err := db.QueryRow(query, slug).Scan(&p.ID, &p.Name, &p.Slug, &p.Description, &p.CategoryID, &p.BasePrice, &p.IsActive, &p.IsFeatured)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// Get single active category by slug
+func getCategoryBySlug(slug string) (*Category, error) {
+	query := `
+		SELECT id, name, slug, description, parent_id, image_url, is_active, sort_order, created_at, updated_at
+		FROM catalog.categories
+		WHERE slug = $1 AND is_active = true
+	`
+
+	var c Category
+	err := db.QueryRow(query, slug).Scan(&c.ID, &c.Name, &c.Slug, &c.Description, &c.ParentID, &c.ImageURL, &c.IsActive, &c.SortOrder, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
 // Get all categories from database
 func getCategoriesFromDB() ([]Category, error) {
 	query := `
@@ -155,7 +466,124 @@ func getCategoriesFromDB() ([]Category, error) {
 	}
 
 	return categories, nil
-} // CreateCategoryRequest struct for admin category creation
+}
+
+// Get active categories as a nested tree ordered by sort_order.
+// Categories under an inactive parent are left out along with it.
+func getCategoryTree() ([]*CategoryNode, error) {
+	query := `
+		SELECT c.id, c.name, c.slug, c.description, c.parent_id, c.image_url, c.is_active, c.sort_order, c.created_at, c.updated_at,
+		       (SELECT COUNT(*) FROM catalog.products p WHERE p.category_id = c.id AND p.is_active = true) as product_count
+		FROM catalog.categories c
+		WHERE c.is_active = true
+		ORDER BY c.sort_order, c.name
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := []CategoryNode{}
+	for rows.Next() {
+		var n CategoryNode
+		err := rows.Scan(&n.ID, &n.Name, &n.Slug, &n.Description, &n.ParentID, &n.ImageURL, &n.IsActive, &n.SortOrder, &n.CreatedAt, &n.UpdatedAt, &n.ProductCount)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+
+	return buildCategoryTree(nodes), nil
+}
+
+// Nest a flat, already ordered category list under its parents and total up product counts
+func buildCategoryTree(nodes []CategoryNode) []*CategoryNode {
+	byID := make(map[int]*CategoryNode, len(nodes))
+	for i := range nodes {
+		nodes[i].Children = []*CategoryNode{}
+		byID[nodes[i].ID] = &nodes[i]
+	}
+
+	roots := []*CategoryNode{}
+	for i := range nodes {
+		node := &nodes[i]
+		if node.ParentID == nil {
+			roots = append(roots, node)
+		} else if parent, ok := byID[*node.ParentID]; ok {
+			parent.Children = append(parent.Children, node)
+		}
+	}
+
+	var total func(node *CategoryNode) int
+	total = func(node *CategoryNode) int {
+		node.TotalProductCount = node.ProductCount
+		for _, child := range node.Children {
+			node.TotalProductCount += total(child)
+		}
+		return node.TotalProductCount
+	}
+	for _, root := range roots {
+		total(root)
+	}
+
+	return roots
+}
+
+// Get the path from the root category down to the given category
+func getCategoryBreadcrumbs(id int) ([]Category, error) {
+	query := `
+		WITH RECURSIVE ancestors AS (
+			SELECT id, parent_id, 0 AS depth FROM catalog.categories WHERE id = $1 AND is_active = true
+			UNION ALL
+			SELECT c.id, c.parent_id, a.depth + 1
+			FROM catalog.categories c
+			JOIN ancestors a ON c.id = a.parent_id
+		)
+		SELECT c.id, c.name, c.slug, c.description, c.parent_id, c.image_url, c.is_active, c.sort_order, c.created_at, c.updated_at
+		FROM ancestors a
+		JOIN catalog.categories c ON c.id = a.id
+		ORDER BY a.depth DESC
+	`
+
+	rows, err := db.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	breadcrumbs := []Category{}
+	for rows.Next() {
+		var c Category
+		err := rows.Scan(&c.ID, &c.Name, &c.Slug, &c.Description, &c.ParentID, &c.ImageURL, &c.IsActive, &c.SortOrder, &c.CreatedAt, &c.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		breadcrumbs = append(breadcrumbs, c)
+	}
+
+	if len(breadcrumbs) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return breadcrumbs, nil
+}
+
+// Check whether making parentID the parent of id would create a cycle. Pass the
+// transaction that moves the category so the tree can't change between check and move.
+func categoryParentCreatesCycle(q queryRower, id, parentID int) (bool, error) {
+	if id == parentID {
+		return true, nil
+	}
+
+	var cycle bool
+	query := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM (%s) AS descendants WHERE id = $2)`, fmt.Sprintf(categorySubtreeSQL, "$1"))
+	err := q.QueryRow(query, id, parentID).Scan(&cycle)
+	return cycle, err
+}
+
+// CreateCategoryRequest struct for admin category creation
 type CreateCategoryRequest struct {
 	Name        string `json:"name"`
 	Slug        string `json:"slug"`
@@ -221,6 +649,10 @@ func updateCategory(id int, req *UpdateCategoryRequest) (*Category, error) {
 		argIndex++
 	}
 	if req.ParentID != nil {
+		// Descendants are checked once the row is locked below
+		if *req.ParentID == id {
+			return nil, fmt.Errorf("category cannot be moved under itself or one of its descendants")
+		}
 		setParts = append(setParts, fmt.Sprintf("parent_id = $%d", argIndex))
 		args = append(args, *req.ParentID)
 		argIndex++
@@ -260,8 +692,30 @@ func updateCategory(id int, req *UpdateCategoryRequest) (*Category, error) {
 		RETURNING id, name, slug, description, parent_id, image_url, is_active, sort_order, created_at, updated_at
 	`, strings.Join(setParts, ", "), argIndex)
 
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the row and remember the current slug so a rename can be recorded
+	var oldSlug string
+	if err := tx.QueryRow(`SELECT slug FROM catalog.categories WHERE id = $1 FOR UPDATE`, id).Scan(&oldSlug); err != nil {
+		return nil, err
+	}
+
+	if req.ParentID != nil {
+		cycle, err := categoryParentCreatesCycle(tx, id, *req.ParentID)
+		if err != nil {
+			return nil, err
+		}
+		if cycle {
+			return nil, fmt.Errorf("category cannot be moved under itself or one of its descendants")
+		}
+	}
+
 	var category Category
-	err := db.QueryRow(query, args...).Scan(
+	err = tx.QueryRow(query, args...).Scan(
 		&category.ID, &category.Name, &category.Slug, &category.Description,
 		&category.ParentID, &category.ImageURL, &category.IsActive, &category.SortOrder,
 		&category.CreatedAt, &category.UpdatedAt)
@@ -270,16 +724,162 @@ func updateCategory(id int, req *UpdateCategoryRequest) (*Category, error) {
 		return nil, err
 	}
 
+	if err := recordSlugChange(tx, "category", id, oldSlug, category.Slug); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
 	return &category, nil
 }
 
-// Delete category (admin only) - soft delete
-func deleteCategory(id int) error {
-	query := `DELETE FROM catalog.categories WHERE id = $1`
-	_, err := db.Exec(query, id)
+// CategoryInUseError is returned when deleting a category that active products or subcategories still use
+type CategoryInUseError struct {
+	Products      int `json:"products"`
+	Subcategories int `json:"subcategories"`
+}
+
+func (e *CategoryInUseError) Error() string {
+	return fmt.Sprintf("category is used by %d active product(s) and %d active subcategory(ies)", e.Products, e.Subcategories)
+}
+
+// CategoryReassignment reports what was moved off a deleted category
+type CategoryReassignment struct {
+	ReassignedTo       *int  `json:"reassigned_to"`
+	ProductsMoved      int64 `json:"products_moved"`
+	SubcategoriesMoved int64 `json:"subcategories_moved"`
+}
+
+// Delete category (admin only) - soft delete.
+// With reassignTo, its products and subcategories are moved there first;
+// without it, the delete is refused while active products or subcategories remain.
+func deleteCategory(id int, reassignTo *int) (*CategoryReassignment, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT true FROM catalog.categories WHERE id = $1 AND is_active = true FOR UPDATE`, id).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CategoryReassignment{ReassignedTo: reassignTo}
+
+	if reassignTo != nil {
+		if *reassignTo == id {
+			return nil, fmt.Errorf("cannot reassign to the category being deleted")
+		}
+
+		var targetActive bool
+		err = tx.QueryRow(`SELECT is_active FROM catalog.categories WHERE id = $1 FOR UPDATE`, *reassignTo).Scan(&targetActive)
+		if err == sql.ErrNoRows || (err == nil && !targetActive) {
+			return nil, fmt.Errorf("reassign_to category not found")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Moving children under one of their own descendants would create a cycle
+		cycle, err := categoryParentCreatesCycle(tx, id, *reassignTo)
+		if err != nil {
+			return nil, err
+		}
+		if cycle {
+			return nil, fmt.Errorf("cannot reassign to a subcategory of the category being deleted")
+		}
+
+		res, err := tx.Exec(`UPDATE catalog.products SET category_id = $1, updated_at = NOW() WHERE category_id = $2`, *reassignTo, id)
+		if err != nil {
+			return nil, err
+		}
+		result.ProductsMoved, _ = res.RowsAffected()
+
+		res, err = tx.Exec(`UPDATE catalog.categories SET parent_id = $1, updated_at = NOW() WHERE parent_id = $2`, *reassignTo, id)
+		if err != nil {
+			return nil, err
+		}
+		result.SubcategoriesMoved, _ = res.RowsAffected()
+	} else {
+		var inUse CategoryInUseError
+		err = tx.QueryRow(`
+			SELECT
+				(SELECT COUNT(*) FROM catalog.products WHERE category_id = $1 AND is_active = true),
+				(SELECT COUNT(*) FROM catalog.categories WHERE parent_id = $1 AND is_active = true)
+		`, id).Scan(&inUse.Products, &inUse.Subcategories)
+		if err != nil {
+			return nil, err
+		}
+		if inUse.Products > 0 || inUse.Subcategories > 0 {
+			return nil, &inUse
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE catalog.categories SET is_active = false, updated_at = NOW() WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// =====================================================
+// SLUG HISTORY FUNCTIONS
+// =====================================================
+
+// Tables whose slugs are tracked in catalog.slug_history
+var slugEntityTables = map[string]string{
+	"product":  "catalog.products",
+	"category": "catalog.categories",
+}
+
+// Record a product or category rename so the old slug keeps resolving
+func recordSlugChange(tx *sql.Tx, entityType string, entityID int, oldSlug, newSlug string) error {
+	if oldSlug == newSlug {
+		return nil
+	}
+
+	// The live slug always wins, so drop any history entry it now shadows
+	_, err := tx.Exec(`DELETE FROM catalog.slug_history WHERE entity_type = $1 AND old_slug = $2`, entityType, newSlug)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO catalog.slug_history (entity_type, entity_id, old_slug)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (entity_type, old_slug) DO UPDATE SET entity_id = EXCLUDED.entity_id, created_at = NOW()
+	`, entityType, entityID, oldSlug)
 	return err
 }
 
+// Find the current slug of an active product or category that used to have the given slug
+func resolveOldSlug(entityType, slug string) (string, error) {
+	table, ok := slugEntityTables[entityType]
+	if !ok {
+		return "", fmt.Errorf("unknown slug entity type: %s", entityType)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT e.slug
+		FROM catalog.slug_history h
+		JOIN %s e ON e.id = h.entity_id
+		WHERE h.entity_type = $1 AND h.old_slug = $2 AND e.is_active = true
+	`, table)
+
+	var current string
+	err := db.QueryRow(query, entityType, slug).Scan(&current)
+	return current, err
+}
+
 // =====================================================
 // PRODUCT IMAGE FUNCTIONS
 // =====================================================
@@ -289,13 +889,13 @@ func createProductImage(productID int, variantID *int, req *ProductImageRequest)
 	query := `
 		INSERT INTO catalog.product_images (product_id, variant_id, image_url, image_path, image_type, alt_text, display_order, is_primary)
 		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-		RETURNING id, product_id, variant_id, image_url, image_path, image_type, alt_text, display_order, file_size, width, height, is_primary, created_at
+		RETURNING id, product_id, variant_id, image_url, image_path, image_type, alt_text, display_order, file_size, width, height, thumbnail_url, medium_url, is_primary, created_at
 	`
 
 	var image ProductImage
 	err := db.QueryRow(query, productID, variantID, req.ImageURL, req.ImagePath, req.ImageType, req.AltText, req.DisplayOrder, req.IsPrimary).Scan(
 		&image.ID, &image.ProductID, &image.VariantID, &image.ImageURL, &image.ImagePath, &image.ImageType,
-		&image.AltText, &image.DisplayOrder, &image.FileSize, &image.Width, &image.Height, &image.IsPrimary, &image.CreatedAt)
+		&image.AltText, &image.DisplayOrder, &image.FileSize, &image.Width, &image.Height, &image.ThumbnailURL, &image.MediumURL, &image.IsPrimary, &image.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -303,12 +903,40 @@ func createProductImage(productID int, variantID *int, req *ProductImageRequest)
 	return &image, nil
 }
 
-// Get product images by product ID
-func getProductImages(productID int) ([]ProductImage, error) {
+// Create product image from an uploaded file, recording its size, dimensions and rendition URLs
+func createUploadedProductImage(productID int, req *ProductImageRequest, upload *ProcessedImage, thumbnailURL, mediumURL string) (*ProductImage, error) {
 	query := `
-		SELECT id, product_id, variant_id, image_url, image_path, image_type, alt_text, display_order, file_size, width, height, is_primary, created_at
-		FROM catalog.product_images 
-		WHERE product_id = $1 
+		INSERT INTO catalog.product_images (product_id, image_url, image_path, image_type, alt_text, display_order, is_primary,
+		                                    file_size, width, height, thumbnail_url, medium_url)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id, product_id, variant_id, image_url, image_path, image_type, alt_text, display_order, file_size, width, height, thumbnail_url, medium_url, is_primary, created_at
+	`
+
+	var image ProductImage
+	err := db.QueryRow(query, productID, req.ImageURL, req.ImagePath, req.ImageType, req.AltText, req.DisplayOrder, req.IsPrimary,
+		upload.Size, upload.Width, upload.Height, thumbnailURL, mediumURL).Scan(
+		&image.ID, &image.ProductID, &image.VariantID, &image.ImageURL, &image.ImagePath, &image.ImageType,
+		&image.AltText, &image.DisplayOrder, &image.FileSize, &image.Width, &image.Height, &image.ThumbnailURL, &image.MediumURL, &image.IsPrimary, &image.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &image, nil
+}
+
+// Check whether a product exists (active or not)
+func productExists(id int) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM catalog.products WHERE id = $1)`, id).Scan(&exists)
+	return exists, err
+}
+
+// Get product images by product ID
+func getProductImages(productID int) ([]ProductImage, error) {
+	query := `
+		SELECT id, product_id, variant_id, image_url, image_path, image_type, alt_text, display_order, file_size, width, height, thumbnail_url, medium_url, is_primary, created_at
+		FROM catalog.product_images 
+		WHERE product_id = $1 
 		ORDER BY display_order ASC, is_primary DESC, created_at ASC
 	`
 
@@ -322,7 +950,7 @@ func getProductImages(productID int) ([]ProductImage, error) {
 	for rows.Next() {
 		var img ProductImage
 		err := rows.Scan(&img.ID, &img.ProductID, &img.VariantID, &img.ImageURL, &img.ImagePath, &img.ImageType,
-			&img.AltText, &img.DisplayOrder, &img.FileSize, &img.Width, &img.Height, &img.IsPrimary, &img.CreatedAt)
+			&img.AltText, &img.DisplayOrder, &img.FileSize, &img.Width, &img.Height, &img.ThumbnailURL, &img.MediumURL, &img.IsPrimary, &img.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -338,13 +966,13 @@ func updateProductImage(id int, req *ProductImageRequest) (*ProductImage, error)
 		UPDATE catalog.product_images 
 		SET image_url = $2, image_path = $3, image_type = $4, alt_text = $5, display_order = $6, is_primary = $7
 		WHERE id = $1
-		RETURNING id, product_id, variant_id, image_url, image_path, image_type, alt_text, display_order, file_size, width, height, is_primary, created_at
+		RETURNING id, product_id, variant_id, image_url, image_path, image_type, alt_text, display_order, file_size, width, height, thumbnail_url, medium_url, is_primary, created_at
 	`
 
 	var image ProductImage
 	err := db.QueryRow(query, id, req.ImageURL, req.ImagePath, req.ImageType, req.AltText, req.DisplayOrder, req.IsPrimary).Scan(
 		&image.ID, &image.ProductID, &image.VariantID, &image.ImageURL, &image.ImagePath, &image.ImageType,
-		&image.AltText, &image.DisplayOrder, &image.FileSize, &image.Width, &image.Height, &image.IsPrimary, &image.CreatedAt)
+		&image.AltText, &image.DisplayOrder, &image.FileSize, &image.Width, &image.Height, &image.ThumbnailURL, &image.MediumURL, &image.IsPrimary, &image.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -352,11 +980,15 @@ func updateProductImage(id int, req *ProductImageRequest) (*ProductImage, error)
 	return &image, nil
 }
 
-// Delete product image
-func deleteProductImage(id int) error {
-	query := `DELETE FROM catalog.product_images WHERE id = $1`
-	_, err := db.Exec(query, id)
-	return err
+// Delete product image, returning its storage path so the files can be removed
+func deleteProductImage(id int) (string, error) {
+	query := `DELETE FROM catalog.product_images WHERE id = $1 RETURNING image_path`
+	var imagePath string
+	err := db.QueryRow(query, id).Scan(&imagePath)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return imagePath, err
 }
 
 // UpdateProductRequest struct for product updates
@@ -464,8 +1096,20 @@ func updateProduct(id int, req *UpdateProductRequest) (*Product, error) {
 		RETURNING id, name, slug, description, category_id, base_price, is_active, is_featured
 	`, strings.Join(setParts, ", "), whereClause)
 
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the row and remember the current slug so a rename can be recorded
+	var oldSlug string
+	if err := tx.QueryRow(`SELECT slug FROM catalog.products WHERE id = $1 FOR UPDATE`, id).Scan(&oldSlug); err != nil {
+		return nil, err
+	}
+
 	var product Product
-	err := db.QueryRow(query, args...).Scan(
+	err = tx.QueryRow(query, args...).Scan(
 		&product.ID, &product.Name, &product.Slug, &product.Description,
 		&product.CategoryID, &product.BasePrice, &product.IsActive, &product.IsFeatured,
 	)
@@ -474,6 +1118,14 @@ func updateProduct(id int, req *UpdateProductRequest) (*Product, error) {
 		return nil, err
 	}
 
+	if err := recordSlugChange(tx, "product", id, oldSlug, product.Slug); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
 	// Handle image_url update if provided
 	if req.ImageURL != nil && *req.ImageURL != "" {
 		var existingImageID int
@@ -539,6 +1191,194 @@ func deleteProduct(id int) error {
 	return nil
 }
 
+// =====================================================
+// PRODUCT VARIANT FUNCTIONS
+// =====================================================
+
+// Get variants for a product, optionally only the active ones
+func getProductVariants(productID int, activeOnly bool) ([]ProductVariant, error) {
+	query := `
+		SELECT pv.id, pv.product_id, pv.sku, pv.size, pv.color, pv.material,
+		       pv.price_adjustment, p.base_price + pv.price_adjustment AS price,
+		       pv.stock_quantity, pv.low_stock_threshold, pv.is_active, pv.created_at, pv.updated_at
+		FROM catalog.product_variants pv
+		JOIN catalog.products p ON pv.product_id = p.id
+		WHERE pv.product_id = $1 AND (pv.is_active = true OR NOT $2)
+		ORDER BY pv.id
+	`
+
+	rows, err := db.Query(query, productID, activeOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := []ProductVariant{}
+	for rows.Next() {
+		var v ProductVariant
+		err := rows.Scan(&v.ID, &v.ProductID, &v.SKU, &v.Size, &v.Color, &v.Material,
+			&v.PriceAdjustment, &v.Price, &v.StockQuantity, &v.LowStockThreshold,
+			&v.IsActive, &v.CreatedAt, &v.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, v)
+	}
+
+	return variants, nil
+}
+
+// Get a single variant belonging to a product
+func getProductVariant(productID, variantID int) (*ProductVariant, error) {
+	query := `
+		SELECT pv.id, pv.product_id, pv.sku, pv.size, pv.color, pv.material,
+		       pv.price_adjustment, p.base_price + pv.price_adjustment AS price,
+		       pv.stock_quantity, pv.low_stock_threshold, pv.is_active, pv.created_at, pv.updated_at
+		FROM catalog.product_variants pv
+		JOIN catalog.products p ON pv.product_id = p.id
+		WHERE pv.product_id = $1 AND pv.id = $2
+	`
+
+	var v ProductVariant
+	err := db.QueryRow(query, productID, variantID).Scan(&v.ID, &v.ProductID, &v.SKU, &v.Size, &v.Color, &v.Material,
+		&v.PriceAdjustment, &v.Price, &v.StockQuantity, &v.LowStockThreshold,
+		&v.IsActive, &v.CreatedAt, &v.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+// Create product variant (admin only)
+func createProductVariant(productID int, req *CreateVariantRequest) (*ProductVariant, error) {
+	lowStockThreshold := 5
+	if req.LowStockThreshold != nil {
+		lowStockThreshold = *req.LowStockThreshold
+	}
+
+	var variantID int
+	query := `
+		INSERT INTO catalog.product_variants (product_id, sku, size, color, material, price_adjustment, stock_quantity, low_stock_threshold)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`
+	err := db.QueryRow(query, productID, req.SKU, req.Size, req.Color, req.Material,
+		req.PriceAdjustment, req.StockQuantity, lowStockThreshold).Scan(&variantID)
+	if err != nil {
+		return nil, err
+	}
+
+	return getProductVariant(productID, variantID)
+}
+
+// Update product variant (admin only)
+func updateProductVariant(productID, variantID int, req *UpdateVariantRequest) (*ProductVariant, error) {
+	// Build dynamic query based on provided fields
+	setParts := []string{}
+	args := []interface{}{}
+	argIndex := 1
+
+	if req.SKU != nil {
+		setParts = append(setParts, fmt.Sprintf("sku = $%d", argIndex))
+		args = append(args, *req.SKU)
+		argIndex++
+	}
+	if req.Size != nil {
+		setParts = append(setParts, fmt.Sprintf("size = $%d", argIndex))
+		args = append(args, *req.Size)
+		argIndex++
+	}
+	if req.Color != nil {
+		setParts = append(setParts, fmt.Sprintf("color = $%d", argIndex))
+		args = append(args, *req.Color)
+		argIndex++
+	}
+	if req.Material != nil {
+		setParts = append(setParts, fmt.Sprintf("material = $%d", argIndex))
+		args = append(args, *req.Material)
+		argIndex++
+	}
+	if req.PriceAdjustment != nil {
+		setParts = append(setParts, fmt.Sprintf("price_adjustment = $%d", argIndex))
+		args = append(args, *req.PriceAdjustment)
+		argIndex++
+	}
+	if req.StockQuantity != nil {
+		setParts = append(setParts, fmt.Sprintf("stock_quantity = $%d", argIndex))
+		args = append(args, *req.StockQuantity)
+		argIndex++
+	}
+	if req.LowStockThreshold != nil {
+		setParts = append(setParts, fmt.Sprintf("low_stock_threshold = $%d", argIndex))
+		args = append(args, *req.LowStockThreshold)
+		argIndex++
+	}
+	if req.IsActive != nil {
+		setParts = append(setParts, fmt.Sprintf("is_active = $%d", argIndex))
+		args = append(args, *req.IsActive)
+		argIndex++
+	}
+
+	if len(setParts) == 0 {
+		return nil, fmt.Errorf("no fields to update")
+	}
+
+	setParts = append(setParts, "updated_at = NOW()")
+	args = append(args, productID, variantID)
+
+	query := fmt.Sprintf(`
+		UPDATE catalog.product_variants
+		SET %s
+		WHERE product_id = $%d AND id = $%d
+	`, strings.Join(setParts, ", "), argIndex, argIndex+1)
+
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return getProductVariant(productID, variantID)
+}
+
+// Delete product variant (admin only) - refuses variants that appear on orders
+func deleteProductVariant(productID, variantID int) error {
+	var orderCount int
+	checkQuery := `SELECT COUNT(DISTINCT order_id) FROM orders.order_items WHERE variant_id = $1`
+	err := db.QueryRow(checkQuery, variantID).Scan(&orderCount)
+	if err != nil {
+		return fmt.Errorf("failed to check variant orders: %v", err)
+	}
+
+	if orderCount > 0 {
+		return fmt.Errorf("cannot delete variant: it has been used in %d order(s). Consider marking it as inactive instead", orderCount)
+	}
+
+	result, err := db.Exec(`DELETE FROM catalog.product_variants WHERE product_id = $1 AND id = $2`, productID, variantID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("variant not found")
+	}
+
+	return nil
+}
+
 // =====================================================
 // CART MODELS AND FUNCTIONS
 // =====================================================
@@ -549,11 +1389,15 @@ type CartItem struct {
 	UserID    *int    `json:"user_id,omitempty"`
 	SessionID *string `json:"session_id,omitempty"`
 	ProductID int     `json:"product_id"`
+	VariantID int     `json:"variant_id"`
 	Quantity  int     `json:"quantity"`
-	// Joined fields from product
+	// Joined fields from product and variant
 	ProductName string  `json:"product_name"`
 	ProductSlug string  `json:"product_slug"`
-	Price       float64 `json:"price"`
+	SKU         string  `json:"sku"`
+	Size        *string `json:"size,omitempty"`
+	Color       *string `json:"color,omitempty"`
+	Price       float64 `json:"price"` // base_price + price_adjustment
 	ImageURL    *string `json:"image_url,omitempty"`
 }
 
@@ -564,9 +1408,12 @@ type CartSummary struct {
 	Subtotal   float64    `json:"subtotal"`
 }
 
-// AddToCartRequest represents add to cart request
+// AddToCartRequest represents add to cart request.
+// VariantID selects the size/colour; ProductID alone is accepted for
+// products that have exactly one active variant.
 type AddToCartRequest struct {
-	ProductID int `json:"product_id"`
+	ProductID int `json:"product_id,omitempty"`
+	VariantID int `json:"variant_id"`
 	Quantity  int `json:"quantity"`
 }
 
@@ -580,20 +1427,30 @@ type UserPoints struct {
 
 // Order represents an order
 type Order struct {
-	ID              int         `json:"id"`
-	UserID          *int        `json:"user_id,omitempty"` // nil for guest orders
-	SessionID       *string     `json:"session_id,omitempty"`
-	OrderNumber     string      `json:"order_number"`
-	Status          string      `json:"status"` // pending, confirmed, processing, shipped, delivered, cancelled
-	TotalAmount     float64     `json:"total_amount"`
-	PaymentStatus   string      `json:"payment_status"` // pending, paid, failed, refunded
-	PaymentMethod   *string     `json:"payment_method,omitempty"`
-	ShippingAddress *string     `json:"shipping_address,omitempty"`
-	BillingAddress  *string     `json:"billing_address,omitempty"`
-	Notes           *string     `json:"notes,omitempty"`
-	CreatedAt       string      `json:"created_at"`
-	UpdatedAt       string      `json:"updated_at"`
-	Items           []OrderItem `json:"items,omitempty"`
+	ID              int            `json:"id"`
+	UserID          *int           `json:"user_id,omitempty"` // nil for guest orders
+	SessionID       *string        `json:"session_id,omitempty"`
+	OrderNumber     string         `json:"order_number"`
+	Status          string         `json:"status"` // pending, confirmed, processing, shipped, delivered, cancelled, refunded
+	Subtotal        float64        `json:"subtotal"`
+	DiscountAmount  float64        `json:"discount_amount"`
+	PointsRedeemed  int            `json:"points_redeemed"`
+	TotalAmount     float64        `json:"total_amount"`
+	PaymentStatus   string         `json:"payment_status"` // pending, paid, failed, refunded
+	PaymentMethod   *string        `json:"payment_method,omitempty"`
+	ShippingAddress *string        `json:"shipping_address,omitempty"`
+	BillingAddress  *string        `json:"billing_address,omitempty"`
+	Shipping        *PostalAddress `json:"shipping,omitempty"` // structured delivery address snapshotted at checkout
+	Notes           *string        `json:"notes,omitempty"`
+	CreatedAt       string         `json:"created_at"`
+	UpdatedAt       string         `json:"updated_at"`
+	ConfirmedAt     *time.Time     `json:"confirmed_at,omitempty"`
+	ProcessingAt    *time.Time     `json:"processing_at,omitempty"`
+	ShippedAt       *time.Time     `json:"shipped_at,omitempty"`
+	DeliveredAt     *time.Time     `json:"delivered_at,omitempty"`
+	CancelledAt     *time.Time     `json:"cancelled_at,omitempty"`
+	RefundedAt      *time.Time     `json:"refunded_at,omitempty"`
+	Items           []OrderItem    `json:"items,omitempty"`
 }
 
 // OrderItem represents an item in an order
@@ -612,46 +1469,141 @@ type OrderItem struct {
 
 // CreateOrderRequest represents order creation request
 type CreateOrderRequest struct {
-	ShippingAddress *string `json:"shipping_address,omitempty"`
-	BillingAddress  *string `json:"billing_address,omitempty"`
-	PaymentMethod   *string `json:"payment_method,omitempty"`
-	Notes           *string `json:"notes,omitempty"`
+	ShippingAddress  *string        `json:"shipping_address,omitempty"`
+	BillingAddress   *string        `json:"billing_address,omitempty"`
+	Shipping         *PostalAddress `json:"shipping,omitempty"`           // structured delivery address
+	AddressID        *int           `json:"address_id,omitempty"`         // saved address to ship to, instead of shipping
+	BillingAddressID *int           `json:"billing_address_id,omitempty"` // saved address to bill to, instead of billing_address
+	PaymentMethod    *string        `json:"payment_method,omitempty"`
+	Notes            *string        `json:"notes,omitempty"`
+	RedeemPoints     int            `json:"redeem_points,omitempty"` // loyalty points to spend as a discount (signed-in users only)
+}
+
+// StockShortage describes a cart line that can't be fulfilled from current stock
+type StockShortage struct {
+	VariantID   int    `json:"variant_id"`
+	SKU         string `json:"sku"`
+	ProductName string `json:"product_name"`
+	Requested   int    `json:"requested"`
+	Available   int    `json:"available"`
+}
+
+// OutOfStockError is returned by checkout when one or more lines can't be fulfilled
+type OutOfStockError struct {
+	Items []StockShortage
+}
+
+func (e *OutOfStockError) Error() string {
+	return fmt.Sprintf("%d item(s) are out of stock", len(e.Items))
+}
+
+// StockReservation is a time-limited hold on variant stock during checkout
+type StockReservation struct {
+	ID        int       `json:"id"`
+	VariantID int       `json:"variant_id"`
+	UserID    *int      `json:"user_id,omitempty"`
+	SessionID *string   `json:"session_id,omitempty"`
+	Quantity  int       `json:"quantity"`
+	Status    string    `json:"status"` // active, released, converted
+	OrderID   *int      `json:"order_id,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+	// Joined fields from variant and product
+	SKU         string `json:"sku"`
+	ProductName string `json:"product_name"`
+}
+
+// CheckoutReservation groups the holds taken for one checkout
+type CheckoutReservation struct {
+	Items     []StockReservation `json:"items"`
+	ExpiresAt time.Time          `json:"expires_at"`
 }
 
 // UpdateOrderStatusRequest represents order status update
 type UpdateOrderStatusRequest struct {
 	Status        string  `json:"status"`
+	Note          *string `json:"note,omitempty"` // kept in the status history
 	PaymentStatus *string `json:"payment_status,omitempty"`
 	PaymentMethod *string `json:"payment_method,omitempty"`
 }
 
+// Resolve the variant a cart request refers to. A variant ID always wins;
+// a bare product ID is only accepted when the product has a single active variant.
+func resolveCartVariant(productID, variantID int) (*ProductVariant, error) {
+	if variantID > 0 {
+		query := `
+			SELECT pv.id, pv.product_id, pv.sku, pv.size, pv.color, pv.material,
+			       pv.price_adjustment, p.base_price + pv.price_adjustment AS price,
+			       pv.stock_quantity, pv.low_stock_threshold, pv.is_active, pv.created_at, pv.updated_at
+			FROM catalog.product_variants pv
+			JOIN catalog.products p ON pv.product_id = p.id
+			WHERE pv.id = $1 AND pv.is_active = true AND p.is_active = true
+		`
+
+		var v ProductVariant
+		err := db.QueryRow(query, variantID).Scan(&v.ID, &v.ProductID, &v.SKU, &v.Size, &v.Color, &v.Material,
+			&v.PriceAdjustment, &v.Price, &v.StockQuantity, &v.LowStockThreshold,
+			&v.IsActive, &v.CreatedAt, &v.UpdatedAt)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("variant not found")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if productID > 0 && v.ProductID != productID {
+			return nil, fmt.Errorf("variant does not belong to product")
+		}
+
+		return &v, nil
+	}
+
+	if productID <= 0 {
+		return nil, fmt.Errorf("variant_id is required")
+	}
+
+	variants, err := getProductVariants(productID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(variants) {
+	case 0:
+		return nil, fmt.Errorf("product has no available variants")
+	case 1:
+		return &variants[0], nil
+	default:
+		return nil, fmt.Errorf("variant_id is required for products with multiple options")
+	}
+}
+
 // Add item to user cart (authenticated users)
-func addToUserCart(userID, productID, quantity int) error {
+func addToUserCart(userID, productID, variantID, quantity int) error {
 	query := `
-		INSERT INTO orders.cart_items (user_id, product_id, quantity)
-		VALUES ($1, $2, $3)
-		ON CONFLICT (user_id, product_id)
+		INSERT INTO orders.cart_items (user_id, product_id, variant_id, quantity)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, variant_id)
 		DO UPDATE SET 
-			quantity = orders.cart_items.quantity + $3,
+			quantity = orders.cart_items.quantity + $4,
 			updated_at = NOW()
 	`
 
-	_, err := db.Exec(query, userID, productID, quantity)
+	_, err := db.Exec(query, userID, productID, variantID, quantity)
 	return err
 }
 
 // Add item to guest cart (session-based)
-func addToGuestCart(sessionID string, productID, quantity int) error {
+func addToGuestCart(sessionID string, productID, variantID, quantity int) error {
 	query := `
-		INSERT INTO orders.guest_cart_items (session_id, product_id, quantity)
-		VALUES ($1, $2, $3)
-		ON CONFLICT (session_id, product_id)
+		INSERT INTO orders.guest_cart_items (session_id, product_id, variant_id, quantity)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (session_id, variant_id)
 		DO UPDATE SET 
-			quantity = orders.guest_cart_items.quantity + $3,
+			quantity = orders.guest_cart_items.quantity + $4,
 			updated_at = NOW()
 	`
 
-	_, err := db.Exec(query, sessionID, productID, quantity)
+	_, err := db.Exec(query, sessionID, productID, variantID, quantity)
 	return err
 }
 
@@ -659,12 +1611,14 @@ func addToGuestCart(sessionID string, productID, quantity int) error {
 func getUserCartItems(userID int) ([]CartItem, error) {
 	query := `
 		SELECT 
-			ci.id, ci.user_id, ci.product_id, ci.quantity,
+			ci.id, ci.user_id, ci.product_id, ci.variant_id, ci.quantity,
 			p.name as product_name, p.slug as product_slug,
-			p.base_price as price
+			pv.sku, pv.size, pv.color,
+			p.base_price + pv.price_adjustment as price
 		FROM orders.cart_items ci
-		JOIN catalog.products p ON ci.product_id = p.id
-		WHERE ci.user_id = $1 AND p.is_active = true
+		JOIN catalog.product_variants pv ON ci.variant_id = pv.id
+		JOIN catalog.products p ON pv.product_id = p.id
+		WHERE ci.user_id = $1 AND p.is_active = true AND pv.is_active = true
 		ORDER BY ci.created_at DESC
 	`
 
@@ -678,8 +1632,9 @@ func getUserCartItems(userID int) ([]CartItem, error) {
 	for rows.Next() {
 		var item CartItem
 		err := rows.Scan(
-			&item.ID, &item.UserID, &item.ProductID, &item.Quantity,
-			&item.ProductName, &item.ProductSlug, &item.Price,
+			&item.ID, &item.UserID, &item.ProductID, &item.VariantID, &item.Quantity,
+			&item.ProductName, &item.ProductSlug,
+			&item.SKU, &item.Size, &item.Color, &item.Price,
 		)
 		if err != nil {
 			return nil, err
@@ -694,12 +1649,14 @@ func getUserCartItems(userID int) ([]CartItem, error) {
 func getGuestCartItems(sessionID string) ([]CartItem, error) {
 	query := `
 		SELECT 
-			gci.id, gci.product_id, gci.quantity,
+			gci.id, gci.product_id, gci.variant_id, gci.quantity,
 			p.name as product_name, p.slug as product_slug,
-			p.base_price as price
+			pv.sku, pv.size, pv.color,
+			p.base_price + pv.price_adjustment as price
 		FROM orders.guest_cart_items gci
-		JOIN catalog.products p ON gci.product_id = p.id
-		WHERE gci.session_id = $1 AND p.is_active = true
+		JOIN catalog.product_variants pv ON gci.variant_id = pv.id
+		JOIN catalog.products p ON pv.product_id = p.id
+		WHERE gci.session_id = $1 AND p.is_active = true AND pv.is_active = true
 		ORDER BY gci.created_at DESC
 	`
 
@@ -716,8 +1673,9 @@ func getGuestCartItems(sessionID string) ([]CartItem, error) {
 		item.SessionID = &sessionIDStr
 
 		err := rows.Scan(
-			&item.ID, &item.ProductID, &item.Quantity,
-			&item.ProductName, &item.ProductSlug, &item.Price,
+			&item.ID, &item.ProductID, &item.VariantID, &item.Quantity,
+			&item.ProductName, &item.ProductSlug,
+			&item.SKU, &item.Size, &item.Color, &item.Price,
 		)
 		if err != nil {
 			return nil, err
@@ -729,27 +1687,27 @@ func getGuestCartItems(sessionID string) ([]CartItem, error) {
 }
 
 // Update cart item quantity
-func updateCartItemQuantity(userID *int, sessionID *string, productID, quantity int) error {
+func updateCartItemQuantity(userID *int, sessionID *string, variantID, quantity int) error {
 	if userID != nil {
 		// User cart
 		if quantity <= 0 {
-			query := `DELETE FROM orders.cart_items WHERE user_id = $1 AND product_id = $2`
-			_, err := db.Exec(query, *userID, productID)
+			query := `DELETE FROM orders.cart_items WHERE user_id = $1 AND variant_id = $2`
+			_, err := db.Exec(query, *userID, variantID)
 			return err
 		} else {
-			query := `UPDATE orders.cart_items SET quantity = $3, updated_at = NOW() WHERE user_id = $1 AND product_id = $2`
-			_, err := db.Exec(query, *userID, productID, quantity)
+			query := `UPDATE orders.cart_items SET quantity = $3, updated_at = NOW() WHERE user_id = $1 AND variant_id = $2`
+			_, err := db.Exec(query, *userID, variantID, quantity)
 			return err
 		}
 	} else if sessionID != nil {
 		// Guest cart
 		if quantity <= 0 {
-			query := `DELETE FROM orders.guest_cart_items WHERE session_id = $1 AND product_id = $2`
-			_, err := db.Exec(query, *sessionID, productID)
+			query := `DELETE FROM orders.guest_cart_items WHERE session_id = $1 AND variant_id = $2`
+			_, err := db.Exec(query, *sessionID, variantID)
 			return err
 		} else {
-			query := `UPDATE orders.guest_cart_items SET quantity = $3, updated_at = NOW() WHERE session_id = $1 AND product_id = $2`
-			_, err := db.Exec(query, *sessionID, productID, quantity)
+			query := `UPDATE orders.guest_cart_items SET quantity = $3, updated_at = NOW() WHERE session_id = $1 AND variant_id = $2`
+			_, err := db.Exec(query, *sessionID, variantID, quantity)
 			return err
 		}
 	}
@@ -758,14 +1716,14 @@ func updateCartItemQuantity(userID *int, sessionID *string, productID, quantity
 }
 
 // Remove item from cart
-func removeFromCart(userID *int, sessionID *string, productID int) error {
+func removeFromCart(userID *int, sessionID *string, variantID int) error {
 	if userID != nil {
-		query := `DELETE FROM orders.cart_items WHERE user_id = $1 AND product_id = $2`
-		_, err := db.Exec(query, *userID, productID)
+		query := `DELETE FROM orders.cart_items WHERE user_id = $1 AND variant_id = $2`
+		_, err := db.Exec(query, *userID, variantID)
 		return err
 	} else if sessionID != nil {
-		query := `DELETE FROM orders.guest_cart_items WHERE session_id = $1 AND product_id = $2`
-		_, err := db.Exec(query, *sessionID, productID)
+		query := `DELETE FROM orders.guest_cart_items WHERE session_id = $1 AND variant_id = $2`
+		_, err := db.Exec(query, *sessionID, variantID)
 		return err
 	}
 
@@ -782,7 +1740,7 @@ func migrateGuestCartToUser(sessionID string, userID int) error {
 
 	// Add each item to user cart
 	for _, item := range guestItems {
-		err := addToUserCart(userID, item.ProductID, item.Quantity)
+		err := addToUserCart(userID, item.ProductID, item.VariantID, item.Quantity)
 		if err != nil {
 			return err
 		}
@@ -827,51 +1785,6 @@ func getCartSummary(userID *int, sessionID *string) (*CartSummary, error) {
 	}, nil
 }
 
-// Initialize user points when user registers
-func initializeUserPoints(userID int) error {
-	query := `
-		INSERT INTO auth.user_points (user_id, points_balance, total_earned, total_spent)
-		VALUES ($1, 0, 0, 0)
-		ON CONFLICT (user_id) DO NOTHING
-	`
-	_, err := db.Exec(query, userID)
-	return err
-}
-
-// Add points to user account
-func addPointsToUser(userID int, points int, description string, orderID *int) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-
-	// Update points balance
-	query1 := `
-		UPDATE auth.user_points 
-		SET points_balance = points_balance + $2,
-		    total_earned = total_earned + $2,
-		    updated_at = NOW()
-		WHERE user_id = $1
-	`
-	_, err = tx.Exec(query1, userID, points)
-	if err != nil {
-		return err
-	}
-
-	// Record transaction
-	query2 := `
-		INSERT INTO auth.points_transactions (user_id, order_id, transaction_type, points, description)
-		VALUES ($1, $2, 'earned', $3, $4)
-	`
-	_, err = tx.Exec(query2, userID, orderID, points, description)
-	if err != nil {
-		return err
-	}
-
-	return tx.Commit()
-}
-
 // Get user points balance
 func getUserPoints(userID int) (*UserPoints, error) {
 	query := `
@@ -897,6 +1810,58 @@ func getUserPoints(userID int) (*UserPoints, error) {
 // ORDER MANAGEMENT FUNCTIONS
 // =====================================================
 
+// Columns read by scanOrder, in order
+const orderColumns = `
+	id, user_id, session_id, order_number, status, subtotal, COALESCE(discount_amount, 0), points_redeemed, total_amount, payment_status,
+	payment_method, shipping_address, billing_address, notes, created_at, updated_at,
+	shipping_first_name, shipping_last_name, shipping_company, shipping_address_line_1,
+	shipping_address_line_2, shipping_city, shipping_county, shipping_postal_code,
+	shipping_country, shipping_phone,
+	confirmed_at, processing_at, shipped_at, delivered_at, cancelled_at, refunded_at
+`
+
+// Scan a row selected with orderColumns. Shipping is only set for orders that have a structured address.
+func scanOrder(row rowScanner) (*Order, error) {
+	var order Order
+	var firstName, lastName, company, line1, line2, city, county, postalCode, country, phone *string
+	err := row.Scan(
+		&order.ID, &order.UserID, &order.SessionID, &order.OrderNumber,
+		&order.Status, &order.Subtotal, &order.DiscountAmount, &order.PointsRedeemed, &order.TotalAmount, &order.PaymentStatus,
+		&order.PaymentMethod, &order.ShippingAddress, &order.BillingAddress,
+		&order.Notes, &order.CreatedAt, &order.UpdatedAt,
+		&firstName, &lastName, &company, &line1,
+		&line2, &city, &county, &postalCode,
+		&country, &phone,
+		&order.ConfirmedAt, &order.ProcessingAt, &order.ShippedAt, &order.DeliveredAt, &order.CancelledAt, &order.RefundedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if line1 != nil {
+		value := func(s *string) string {
+			if s == nil {
+				return ""
+			}
+			return *s
+		}
+		order.Shipping = &PostalAddress{
+			FirstName:    value(firstName),
+			LastName:     value(lastName),
+			Company:      value(company),
+			AddressLine1: *line1,
+			AddressLine2: value(line2),
+			City:         value(city),
+			County:       value(county),
+			PostalCode:   value(postalCode),
+			Country:      value(country),
+			Phone:        value(phone),
+		}
+	}
+
+	return &order, nil
+}
+
 // Create order from cart
 func createOrderFromCart(userID *int, sessionID *string, req *CreateOrderRequest) (*Order, error) {
 	// Generate unique order number
@@ -907,13 +1872,7 @@ func createOrderFromCart(userID *int, sessionID *string, req *CreateOrderRequest
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		} else {
-			tx.Commit()
-		}
-	}()
+	defer tx.Rollback()
 
 	// Get cart items
 	var cartItems []CartItem
@@ -931,52 +1890,147 @@ func createOrderFromCart(userID *int, sessionID *string, req *CreateOrderRequest
 		return nil, fmt.Errorf("cart is empty")
 	}
 
+	// A saved or structured shipping address is copied onto the order, so later edits to the
+	// address book don't change it. The free-text columns are filled too for older clients.
+	shipping := req.Shipping
+	if req.AddressID != nil {
+		if shipping, err = savedOrderAddress(userID, *req.AddressID); err != nil {
+			return nil, err
+		}
+	}
+	shippingAddress, billingAddress := req.ShippingAddress, req.BillingAddress
+	if shipping != nil {
+		text := shipping.Format()
+		shippingAddress = &text
+	}
+	if req.BillingAddressID != nil {
+		billing, err := savedOrderAddress(userID, *req.BillingAddressID)
+		if err != nil {
+			return nil, err
+		}
+		text := billing.Format()
+		billingAddress = &text
+	}
+
+	// Stock this customer is already holding from a checkout reservation
+	held, err := lockActiveReservations(tx, userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock the variant rows so concurrent checkouts can't oversell
+	stock, err := lockVariantStock(tx, cartItems)
+	if err != nil {
+		return nil, err
+	}
+	for variantID, quantity := range held {
+		stock[variantID] += quantity
+	}
+
+	if shortages := findStockShortages(cartItems, stock); len(shortages) > 0 {
+		return nil, &OutOfStockError{Items: shortages}
+	}
+
 	// Calculate total amount
-	var totalAmount float64
+	var subtotal float64
 	for _, item := range cartItems {
-		totalAmount += float64(item.Quantity) * item.Price
+		subtotal += float64(item.Quantity) * item.Price
+	}
+
+	// Redeemed points come off the total, up to the configured share of the subtotal
+	var pointsRedeemed int
+	var discountAmount float64
+	if req.RedeemPoints > 0 {
+		if userID == nil {
+			return nil, fmt.Errorf("points redemption requires authentication")
+		}
+		pointsRedeemed, discountAmount = currentPointsRules().redemption(req.RedeemPoints, subtotal)
 	}
+	totalAmount := math.Round((subtotal-discountAmount)*100) / 100
 
 	// Create order
 	var orderID int
 	orderQuery := `
 		INSERT INTO orders.orders (
 			user_id, session_id, order_number, status, 
-			subtotal, total_amount, payment_status, payment_method,
-			shipping_address, billing_address, notes
+			subtotal, discount_amount, points_redeemed, total_amount, payment_status, payment_method,
+			shipping_address, billing_address, notes,
+			shipping_first_name, shipping_last_name, shipping_company,
+			shipping_address_line_1, shipping_address_line_2, shipping_city,
+			shipping_county, shipping_postal_code, shipping_country, shipping_phone
 		)
-		VALUES ($1, $2, $3, 'pending', $4, $5, 'pending', $6, $7, $8, $9)
+		VALUES ($1, $2, $3, 'pending', $4, $5, $6, $7, 'pending', $8, $9, $10, $11,
+		        $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
 		RETURNING id
 	`
 
-	err = tx.QueryRow(
-		orderQuery,
+	args := []interface{}{
 		userID, sessionID, orderNumber,
-		totalAmount, totalAmount, req.PaymentMethod, // subtotal = total for now
-		req.ShippingAddress, req.BillingAddress, req.Notes,
-	).Scan(&orderID)
+		subtotal, discountAmount, pointsRedeemed, totalAmount, req.PaymentMethod,
+		shippingAddress, billingAddress, req.Notes,
+	}
+	args = append(args, shipping.columnValues()...)
+
+	err = tx.QueryRow(orderQuery, args...).Scan(&orderID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create order items
-	for _, item := range cartItems {
-		totalPrice := float64(item.Quantity) * item.Price
+	if err = recordOrderStatus(tx, orderID, nil, "pending", userID, nil); err != nil {
+		return nil, err
+	}
 
-		productName := item.ProductName
-		if productName == "" {
-			productName = "Product"
+	// Checked whenever points were asked for, even if the cap leaves none to use
+	if req.RedeemPoints > 0 {
+		if err = redeemOrderPoints(tx, *userID, orderID, req.RedeemPoints, pointsRedeemed, orderNumber); err != nil {
+			return nil, err
+		}
+	}
+
+	// Wallet orders are charged in this transaction, so a failed debit leaves no order behind
+	if isWalletPayment(req.PaymentMethod) {
+		if userID == nil {
+			return nil, fmt.Errorf("wallet payment requires authentication")
+		}
+		if err = payOrderFromWallet(tx, *userID, orderID, orderNumber, totalAmount); err != nil {
+			return nil, err
+		}
+	}
+
+	// Hand held stock back to the shelf; the order lines below take it again
+	if len(held) > 0 {
+		if err = convertReservations(tx, userID, sessionID, orderID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create order items
+	for _, item := range cartItems {
+		totalPrice := float64(item.Quantity) * item.Price
+
+		productName := item.ProductName
+		if productName == "" {
+			productName = "Product"
 		}
-		variantSKU := fmt.Sprintf("PROD-%d", item.ProductID)
 
 		orderItemQuery := `
 			INSERT INTO orders.order_items (
-				order_id, product_name, variant_sku, 
+				order_id, variant_id, product_name, variant_sku, size, color,
 				unit_price, quantity, total_price
 			)
-			VALUES ($1, $2, $3, $4, $5, $6)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 		`
-		_, err = tx.Exec(orderItemQuery, orderID, productName, variantSKU, item.Price, item.Quantity, totalPrice)
+		_, err = tx.Exec(orderItemQuery, orderID, item.VariantID, productName, item.SKU, item.Size, item.Color,
+			item.Price, item.Quantity, totalPrice)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.Exec(`
+			UPDATE catalog.product_variants
+			SET stock_quantity = stock_quantity - $2, updated_at = NOW()
+			WHERE id = $1
+		`, item.VariantID, item.Quantity)
 		if err != nil {
 			return nil, err
 		}
@@ -993,44 +2047,163 @@ func createOrderFromCart(userID *int, sessionID *string, req *CreateOrderRequest
 		return nil, err
 	}
 
+	// Orders paid at checkout may earn points straight away
+	if err = syncOrderPoints(tx, orderID); err != nil {
+		return nil, err
+	}
+
 	// Get the created order using the transaction
 	query := `
-		SELECT id, user_id, session_id, order_number, status, total_amount, payment_status, 
-		       payment_method, shipping_address, billing_address, notes, created_at, updated_at
+		SELECT ` + orderColumns + `
 		FROM orders.orders 
 		WHERE id = $1
 	`
 
-	var order Order
-	err = tx.QueryRow(query, orderID).Scan(
-		&order.ID, &order.UserID, &order.SessionID, &order.OrderNumber,
-		&order.Status, &order.TotalAmount, &order.PaymentStatus,
-		&order.PaymentMethod, &order.ShippingAddress, &order.BillingAddress,
-		&order.Notes, &order.CreatedAt, &order.UpdatedAt,
-	)
+	order, err := scanOrder(tx.QueryRow(query, orderID))
 	if err != nil {
 		return nil, err
 	}
 
-	return &order, nil
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// Whether an order is to be paid from the customer's token wallet
+func isWalletPayment(method *string) bool {
+	return method != nil && strings.EqualFold(strings.TrimSpace(*method), "wallet")
+}
+
+// Debit an order's total from the customer's wallet inside the checkout transaction
+// and mark the order paid. The wallet transaction is linked to the order.
+func payOrderFromWallet(tx *sql.Tx, userID, orderID int, orderNumber string, amount float64) error {
+	transactionID, err := addWalletTransactionTx(tx, userID, amount, "debit", "Payment for order "+orderNumber, &orderID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE orders.orders
+		SET payment_status = 'paid', payment_method = 'wallet', payment_reference = $2, updated_at = NOW()
+		WHERE id = $1
+	`, orderID, fmt.Sprintf("wallet:%d", transactionID))
+	return err
+}
+
+// Credit a wallet-paid order back when it is cancelled or refunded. The amount is the
+// order's linked wallet debit, not its current total, and an order that already has a
+// credit is not refunded twice. Orders not paid from the wallet are left alone.
+// The caller holds the order row lock.
+func refundWalletPayment(tx *sql.Tx, orderID int) error {
+	var userID int
+	var amount float64
+	var orderNumber string
+	err := tx.QueryRow(`
+		SELECT w.user_id, w.amount, o.order_number
+		FROM auth.wallet_transactions w
+		JOIN orders.orders o ON o.id = w.order_id
+		WHERE w.order_id = $1 AND w.type = 'debit' AND w.user_id IS NOT NULL
+		  AND NOT EXISTS (
+			SELECT 1 FROM auth.wallet_transactions
+			WHERE order_id = w.order_id AND type = 'credit'
+		  )
+		ORDER BY w.id
+		LIMIT 1
+	`, orderID).Scan(&userID, &amount, &orderNumber)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := addWalletTransactionTx(tx, userID, amount, "credit", "Refund for order "+orderNumber, &orderID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE orders.orders SET payment_status = 'refunded', updated_at = NOW() WHERE id = $1`, orderID)
+	return err
+}
+
+// Lock the variant rows referenced by the cart and return what can be sold.
+// Rows are locked in ID order to avoid deadlocks between concurrent checkouts.
+func lockVariantStock(tx *sql.Tx, items []CartItem) (map[int]int, error) {
+	variantIDs := make([]int64, 0, len(items))
+	for _, item := range items {
+		variantIDs = append(variantIDs, int64(item.VariantID))
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, stock_quantity, is_active
+		FROM catalog.product_variants
+		WHERE id = ANY($1)
+		ORDER BY id
+		FOR UPDATE
+	`, pq.Array(variantIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stock := make(map[int]int, len(items))
+	for rows.Next() {
+		var id, quantity int
+		var isActive bool
+		if err := rows.Scan(&id, &quantity, &isActive); err != nil {
+			return nil, err
+		}
+		if !isActive {
+			quantity = 0
+		}
+		stock[id] = quantity
+	}
+
+	return stock, rows.Err()
+}
+
+// Compare cart quantities against available stock
+func findStockShortages(items []CartItem, stock map[int]int) []StockShortage {
+	var shortages []StockShortage
+	for _, item := range items {
+		available := stock[item.VariantID]
+		if available < 0 {
+			available = 0
+		}
+		if item.Quantity > available {
+			shortages = append(shortages, StockShortage{
+				VariantID:   item.VariantID,
+				SKU:         item.SKU,
+				ProductName: item.ProductName,
+				Requested:   item.Quantity,
+				Available:   available,
+			})
+		}
+	}
+	return shortages
+}
+
+// Put the stock from an order's lines back on the shelf
+func restoreOrderStock(tx *sql.Tx, orderID int) error {
+	_, err := tx.Exec(`
+		UPDATE catalog.product_variants pv
+		SET stock_quantity = pv.stock_quantity + oi.quantity, updated_at = NOW()
+		FROM orders.order_items oi
+		WHERE oi.order_id = $1 AND oi.variant_id = pv.id
+	`, orderID)
+	return err
 }
 
 // Get order by ID
 func getOrderByID(orderID int) (*Order, error) {
 	query := `
-		SELECT id, user_id, session_id, order_number, status, total_amount, payment_status, 
-		       payment_method, shipping_address, billing_address, notes, created_at, updated_at
+		SELECT ` + orderColumns + `
 		FROM orders.orders 
 		WHERE id = $1
 	`
 
-	var order Order
-	err := db.QueryRow(query, orderID).Scan(
-		&order.ID, &order.UserID, &order.SessionID, &order.OrderNumber,
-		&order.Status, &order.TotalAmount, &order.PaymentStatus,
-		&order.PaymentMethod, &order.ShippingAddress, &order.BillingAddress,
-		&order.Notes, &order.CreatedAt, &order.UpdatedAt,
-	)
+	order, err := scanOrder(db.QueryRow(query, orderID))
 
 	if err != nil {
 		return nil, err
@@ -1038,7 +2211,7 @@ func getOrderByID(orderID int) (*Order, error) {
 
 	// Get order items
 	itemsQuery := `
-		SELECT id, order_id, product_name, variant_sku, size, color,
+		SELECT id, order_id, variant_id, product_name, variant_sku, size, color,
 		       unit_price, quantity, total_price
 		FROM orders.order_items
 		WHERE order_id = $1
@@ -1054,7 +2227,7 @@ func getOrderByID(orderID int) (*Order, error) {
 	for rows.Next() {
 		var item OrderItem
 		err := rows.Scan(
-			&item.ID, &item.OrderID, &item.ProductName, &item.VariantSKU,
+			&item.ID, &item.OrderID, &item.VariantID, &item.ProductName, &item.VariantSKU,
 			&item.Size, &item.Color, &item.UnitPrice, &item.Quantity, &item.TotalPrice,
 		)
 		if err != nil {
@@ -1064,14 +2237,13 @@ func getOrderByID(orderID int) (*Order, error) {
 	}
 
 	order.Items = items
-	return &order, nil
+	return order, nil
 }
 
 // Get user orders
 func getUserOrders(userID int) ([]Order, error) {
 	query := `
-		SELECT id, user_id, session_id, order_number, status, total_amount, payment_status,
-		       payment_method, shipping_address, billing_address, notes, created_at, updated_at
+		SELECT ` + orderColumns + `
 		FROM orders.orders 
 		WHERE user_id = $1
 		ORDER BY created_at DESC
@@ -1085,34 +2257,29 @@ func getUserOrders(userID int) ([]Order, error) {
 
 	var orders []Order
 	for rows.Next() {
-		var order Order
-		err := rows.Scan(
-			&order.ID, &order.UserID, &order.SessionID, &order.OrderNumber,
-			&order.Status, &order.TotalAmount, &order.PaymentStatus,
-			&order.PaymentMethod, &order.ShippingAddress, &order.BillingAddress,
-			&order.Notes, &order.CreatedAt, &order.UpdatedAt,
-		)
+		order, err := scanOrder(rows)
 		if err != nil {
 			return nil, err
 		}
-		orders = append(orders, order)
+		orders = append(orders, *order)
 	}
 
 	return orders, nil
 }
 
-// Update order status (admin function)
-func updateOrderStatus(orderID int, req *UpdateOrderStatusRequest) error {
+// Update order status (admin function). Status changes must follow orderTransitions;
+// each one stamps its timestamp column and is written to the status history.
+// Cancelling an order puts its stock back; cancelling or refunding a wallet-paid order
+// credits the wallet.
+func updateOrderStatus(orderID, changedBy int, req *UpdateOrderStatusRequest) error {
+	if req.Status != "" && !isOrderStatus(req.Status) {
+		return fmt.Errorf("invalid order status")
+	}
+
 	setParts := []string{}
 	args := []interface{}{}
 	argIndex := 1
 
-	if req.Status != "" {
-		setParts = append(setParts, fmt.Sprintf("status = $%d", argIndex))
-		args = append(args, req.Status)
-		argIndex++
-	}
-
 	if req.PaymentStatus != nil {
 		setParts = append(setParts, fmt.Sprintf("payment_status = $%d", argIndex))
 		args = append(args, *req.PaymentStatus)
@@ -1125,24 +2292,77 @@ func updateOrderStatus(orderID int, req *UpdateOrderStatusRequest) error {
 		argIndex++
 	}
 
-	if len(setParts) == 0 {
+	if req.Status == "" && len(setParts) == 0 {
 		return fmt.Errorf("no fields to update")
 	}
 
-	setParts = append(setParts, fmt.Sprintf("updated_at = NOW()"))
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the order so two concurrent changes can't both pass the transition check
+	var currentStatus string
+	err = tx.QueryRow(`SELECT status FROM orders.orders WHERE id = $1 FOR UPDATE`, orderID).Scan(&currentStatus)
+	if err != nil {
+		return err
+	}
 
+	// Asking for the status the order already has changes nothing
+	statusChanged := req.Status != "" && req.Status != currentStatus
+	if statusChanged {
+		if !canTransitionOrder(currentStatus, req.Status) {
+			return &OrderTransitionError{From: currentStatus, To: req.Status, Allowed: orderTransitions[currentStatus]}
+		}
+		setParts = append(setParts, fmt.Sprintf("status = $%d", argIndex), orderStatusTimestamps[req.Status]+" = NOW()")
+		args = append(args, req.Status)
+		argIndex++
+	}
+
+	if len(setParts) == 0 {
+		return tx.Commit()
+	}
+
+	setParts = append(setParts, "updated_at = NOW()")
 	query := fmt.Sprintf("UPDATE orders.orders SET %s WHERE id = $%d", strings.Join(setParts, ", "), argIndex)
 	args = append(args, orderID)
 
-	_, err := db.Exec(query, args...)
-	return err
+	if _, err = tx.Exec(query, args...); err != nil {
+		return err
+	}
+
+	if statusChanged {
+		if err = recordOrderStatus(tx, orderID, &currentStatus, req.Status, &changedBy, req.Note); err != nil {
+			return err
+		}
+	}
+
+	if statusChanged && req.Status == "cancelled" {
+		if err = restoreOrderStock(tx, orderID); err != nil {
+			return err
+		}
+	}
+
+	// Money paid from the wallet goes back to it
+	if statusChanged && (req.Status == "cancelled" || req.Status == "refunded") {
+		if err = refundWalletPayment(tx, orderID); err != nil {
+			return err
+		}
+	}
+
+	// Award or take back loyalty points for the order's new state
+	if err = syncOrderPoints(tx, orderID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // Get all orders (admin function)
 func getAllOrders() ([]Order, error) {
 	query := `
-		SELECT id, user_id, session_id, order_number, status, total_amount, payment_status,
-		       payment_method, shipping_address, billing_address, notes, created_at, updated_at
+		SELECT ` + orderColumns + `
 		FROM orders.orders 
 		ORDER BY created_at DESC
 	`
@@ -1155,22 +2375,300 @@ func getAllOrders() ([]Order, error) {
 
 	var orders []Order
 	for rows.Next() {
-		var order Order
-		err := rows.Scan(
-			&order.ID, &order.UserID, &order.SessionID, &order.OrderNumber,
-			&order.Status, &order.TotalAmount, &order.PaymentStatus,
-			&order.PaymentMethod, &order.ShippingAddress, &order.BillingAddress,
-			&order.Notes, &order.CreatedAt, &order.UpdatedAt,
-		)
+		order, err := scanOrder(rows)
 		if err != nil {
 			return nil, err
 		}
-		orders = append(orders, order)
+		orders = append(orders, *order)
 	}
 
 	return orders, nil
 }
 
+// =====================================================
+// STOCK RESERVATION FUNCTIONS
+// =====================================================
+
+// How long a checkout reservation holds stock, from RESERVATION_MINUTES (default 15)
+func reservationTTL() time.Duration {
+	return getEnvDuration("RESERVATION_MINUTES", 15, time.Minute)
+}
+
+// Build the WHERE fragment matching a cart owner's reservations
+func reservationOwnerClause(userID *int, sessionID *string) (string, interface{}, error) {
+	if userID != nil {
+		return "user_id = $1", *userID, nil
+	} else if sessionID != nil {
+		return "session_id = $1", *sessionID, nil
+	}
+	return "", nil, fmt.Errorf("either userID or sessionID must be provided")
+}
+
+// Reserve stock for everything in the cart, replacing any earlier hold
+func reserveCartStock(userID *int, sessionID *string) (*CheckoutReservation, error) {
+	var cartItems []CartItem
+	var err error
+	if userID != nil {
+		cartItems, err = getUserCartItems(*userID)
+	} else if sessionID != nil {
+		cartItems, err = getGuestCartItems(*sessionID)
+	} else {
+		return nil, fmt.Errorf("either userID or sessionID must be provided")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cartItems) == 0 {
+		return nil, fmt.Errorf("cart is empty")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Starting checkout again releases the previous hold first
+	if err = releaseOwnerReservations(tx, userID, sessionID); err != nil {
+		return nil, err
+	}
+
+	stock, err := lockVariantStock(tx, cartItems)
+	if err != nil {
+		return nil, err
+	}
+
+	if shortages := findStockShortages(cartItems, stock); len(shortages) > 0 {
+		return nil, &OutOfStockError{Items: shortages}
+	}
+
+	expiresAt := time.Now().Add(reservationTTL())
+	reservation := &CheckoutReservation{ExpiresAt: expiresAt}
+
+	for _, item := range cartItems {
+		_, err = tx.Exec(`
+			UPDATE catalog.product_variants
+			SET stock_quantity = stock_quantity - $2, updated_at = NOW()
+			WHERE id = $1
+		`, item.VariantID, item.Quantity)
+		if err != nil {
+			return nil, err
+		}
+
+		r := StockReservation{
+			VariantID:   item.VariantID,
+			UserID:      userID,
+			SessionID:   sessionID,
+			Quantity:    item.Quantity,
+			Status:      "active",
+			ExpiresAt:   expiresAt,
+			SKU:         item.SKU,
+			ProductName: item.ProductName,
+		}
+		err = tx.QueryRow(`
+			INSERT INTO orders.stock_reservations (variant_id, user_id, session_id, quantity, expires_at)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id, created_at
+		`, item.VariantID, userID, sessionID, item.Quantity, expiresAt).Scan(&r.ID, &r.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		reservation.Items = append(reservation.Items, r)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return reservation, nil
+}
+
+// Get a cart owner's active reservation, if any
+func getOwnerReservation(userID *int, sessionID *string) (*CheckoutReservation, error) {
+	ownerClause, ownerArg, err := reservationOwnerClause(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT r.id, r.variant_id, r.user_id, r.session_id, r.quantity, r.status, r.order_id,
+		       r.expires_at, r.created_at, pv.sku, p.name
+		FROM orders.stock_reservations r
+		JOIN catalog.product_variants pv ON r.variant_id = pv.id
+		JOIN catalog.products p ON pv.product_id = p.id
+		WHERE r.status = 'active' AND r.expires_at > NOW() AND r.%s
+		ORDER BY r.id
+	`, ownerClause)
+
+	items, err := queryReservations(query, ownerArg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(items) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return &CheckoutReservation{Items: items, ExpiresAt: items[0].ExpiresAt}, nil
+}
+
+// Release a cart owner's hold (customer abandoned checkout)
+func releaseCheckoutReservation(userID *int, sessionID *string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = releaseOwnerReservations(tx, userID, sessionID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Mark an owner's active reservations released and put the stock back
+func releaseOwnerReservations(tx *sql.Tx, userID *int, sessionID *string) error {
+	ownerClause, ownerArg, err := reservationOwnerClause(userID, sessionID)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(`
+		WITH released AS (
+			UPDATE orders.stock_reservations
+			SET status = 'released', released_at = NOW()
+			WHERE status = 'active' AND %s
+			RETURNING variant_id, quantity
+		)
+		UPDATE catalog.product_variants pv
+		SET stock_quantity = pv.stock_quantity + r.quantity, updated_at = NOW()
+		FROM (SELECT variant_id, SUM(quantity) AS quantity FROM released GROUP BY variant_id) r
+		WHERE pv.id = r.variant_id
+	`, ownerClause)
+
+	_, err = tx.Exec(query, ownerArg)
+	return err
+}
+
+// Lock an owner's active reservations and return held quantity per variant.
+// Expired holds the sweeper hasn't reached yet still count: their stock is still off the shelf.
+func lockActiveReservations(tx *sql.Tx, userID *int, sessionID *string) (map[int]int, error) {
+	ownerClause, ownerArg, err := reservationOwnerClause(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT variant_id, quantity
+		FROM orders.stock_reservations
+		WHERE status = 'active' AND %s
+		FOR UPDATE
+	`, ownerClause)
+
+	rows, err := tx.Query(query, ownerArg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	held := make(map[int]int)
+	for rows.Next() {
+		var variantID, quantity int
+		if err := rows.Scan(&variantID, &quantity); err != nil {
+			return nil, err
+		}
+		held[variantID] += quantity
+	}
+
+	return held, rows.Err()
+}
+
+// Attach an owner's active reservations to an order and return the held stock
+func convertReservations(tx *sql.Tx, userID *int, sessionID *string, orderID int) error {
+	ownerClause, ownerArg, err := reservationOwnerClause(userID, sessionID)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(`
+		WITH converted AS (
+			UPDATE orders.stock_reservations
+			SET status = 'converted', order_id = $2, released_at = NOW()
+			WHERE status = 'active' AND %s
+			RETURNING variant_id, quantity
+		)
+		UPDATE catalog.product_variants pv
+		SET stock_quantity = pv.stock_quantity + c.quantity, updated_at = NOW()
+		FROM (SELECT variant_id, SUM(quantity) AS quantity FROM converted GROUP BY variant_id) c
+		WHERE pv.id = c.variant_id
+	`, ownerClause)
+
+	_, err = tx.Exec(query, ownerArg, orderID)
+	return err
+}
+
+// Release every hold past its expiry and put the stock back
+func releaseExpiredReservations() (int64, error) {
+	query := `
+		WITH expired AS (
+			UPDATE orders.stock_reservations
+			SET status = 'released', released_at = NOW()
+			WHERE status = 'active' AND expires_at <= NOW()
+			RETURNING variant_id, quantity
+		), restocked AS (
+			UPDATE catalog.product_variants pv
+			SET stock_quantity = pv.stock_quantity + e.quantity, updated_at = NOW()
+			FROM (SELECT variant_id, SUM(quantity) AS quantity FROM expired GROUP BY variant_id) e
+			WHERE pv.id = e.variant_id
+		)
+		SELECT COUNT(*) FROM expired
+	`
+
+	// Count the released holds, not the variants they were spread across
+	var released int64
+	err := db.QueryRow(query).Scan(&released)
+	return released, err
+}
+
+// Get all active holds (admin function)
+func getActiveReservations() ([]StockReservation, error) {
+	query := `
+		SELECT r.id, r.variant_id, r.user_id, r.session_id, r.quantity, r.status, r.order_id,
+		       r.expires_at, r.created_at, pv.sku, p.name
+		FROM orders.stock_reservations r
+		JOIN catalog.product_variants pv ON r.variant_id = pv.id
+		JOIN catalog.products p ON pv.product_id = p.id
+		WHERE r.status = 'active'
+		ORDER BY r.expires_at
+	`
+
+	return queryReservations(query)
+}
+
+func queryReservations(query string, args ...interface{}) ([]StockReservation, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := []StockReservation{}
+	for rows.Next() {
+		var r StockReservation
+		err := rows.Scan(&r.ID, &r.VariantID, &r.UserID, &r.SessionID, &r.Quantity, &r.Status, &r.OrderID,
+			&r.ExpiresAt, &r.CreatedAt, &r.SKU, &r.ProductName)
+		if err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, r)
+	}
+
+	return reservations, nil
+}
+
 // Generate unique order number
 func generateOrderNumber() string {
 	return fmt.Sprintf("ORD-%d", time.Now().Unix())
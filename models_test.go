@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	"testing"
 	"time"
 )
@@ -51,19 +52,21 @@ func TestProductStruct(t *testing.T) {
 
 // TestProductImageStruct tests the ProductImage struct
 func TestProductImageStruct(t *testing.T) {
+	altText := "Product image"
+	fileSize, width, height := 1024, 800, 600
 	image := ProductImage{
 		ID:           1,
 		ProductID:    1,
 		ImageURL:     "https://example.com/image.jpg",
 		ImagePath:    "/images/product.jpg",
 		ImageType:    "jpg",
-		AltText:      "Product image",
+		AltText:      &altText,
 		DisplayOrder: 1,
-		FileSize:     1024,
-		Width:        800,
-		Height:       600,
+		FileSize:     &fileSize,
+		Width:        &width,
+		Height:       &height,
 		IsPrimary:    true,
-		CreatedAt:    time.Now().Format(time.RFC3339),
+		CreatedAt:    time.Now(),
 	}
 
 	if image.ID != 1 {
@@ -82,12 +85,12 @@ func TestProductImageStruct(t *testing.T) {
 		t.Error("IsPrimary should be true")
 	}
 
-	if image.Width != 800 {
-		t.Errorf("Width = %d, want 800", image.Width)
+	if image.Width == nil || *image.Width != 800 {
+		t.Errorf("Width = %v, want 800", image.Width)
 	}
 
-	if image.Height != 600 {
-		t.Errorf("Height = %d, want 600", image.Height)
+	if image.Height == nil || *image.Height != 600 {
+		t.Errorf("Height = %v, want 600", image.Height)
 	}
 }
 
@@ -292,3 +295,223 @@ func TestValidateQuantity(t *testing.T) {
 		})
 	}
 }
+
+// TestProductVariantStruct tests the ProductVariant struct
+func TestProductVariantStruct(t *testing.T) {
+	size := "M"
+	color := "Black"
+	variant := ProductVariant{
+		ID:              1,
+		ProductID:       10,
+		SKU:             "GOPHER-TEE-M-BLK",
+		Size:            &size,
+		Color:           &color,
+		PriceAdjustment: 200.00,
+		Price:           1700.00,
+		StockQuantity:   25,
+		IsActive:        true,
+	}
+
+	if variant.SKU != "GOPHER-TEE-M-BLK" {
+		t.Errorf("SKU = %s, want GOPHER-TEE-M-BLK", variant.SKU)
+	}
+
+	if variant.Size == nil || *variant.Size != "M" {
+		t.Errorf("Size = %v, want M", variant.Size)
+	}
+
+	if variant.Price != 1700.00 {
+		t.Errorf("Price = %.2f, want 1700.00", variant.Price)
+	}
+
+	if variant.StockQuantity != 25 {
+		t.Errorf("StockQuantity = %d, want 25", variant.StockQuantity)
+	}
+}
+
+// TestFindStockShortages tests checkout stock validation
+func TestFindStockShortages(t *testing.T) {
+	items := []CartItem{
+		{VariantID: 1, SKU: "TEE-S", ProductName: "Tee", Quantity: 2},
+		{VariantID: 2, SKU: "TEE-M", ProductName: "Tee", Quantity: 5},
+		{VariantID: 3, SKU: "TEE-L", ProductName: "Tee", Quantity: 1},
+	}
+	stock := map[int]int{
+		1: 2, // exactly enough
+		2: 3, // short by two
+		// variant 3 missing (deleted or inactive)
+	}
+
+	shortages := findStockShortages(items, stock)
+
+	if len(shortages) != 2 {
+		t.Fatalf("len(shortages) = %d, want 2", len(shortages))
+	}
+
+	if shortages[0].VariantID != 2 || shortages[0].Requested != 5 || shortages[0].Available != 3 {
+		t.Errorf("shortages[0] = %+v, want variant 2 requested 5 available 3", shortages[0])
+	}
+
+	if shortages[1].VariantID != 3 || shortages[1].Available != 0 {
+		t.Errorf("shortages[1] = %+v, want variant 3 available 0", shortages[1])
+	}
+
+	err := &OutOfStockError{Items: shortages}
+	if err.Error() != "2 item(s) are out of stock" {
+		t.Errorf("Error() = %q, want %q", err.Error(), "2 item(s) are out of stock")
+	}
+}
+
+// TestReservationTTL tests the configurable reservation hold duration
+func TestReservationTTL(t *testing.T) {
+	os.Unsetenv("RESERVATION_MINUTES")
+	if ttl := reservationTTL(); ttl != 15*time.Minute {
+		t.Errorf("default TTL = %v, want 15m", ttl)
+	}
+
+	os.Setenv("RESERVATION_MINUTES", "5")
+	defer os.Unsetenv("RESERVATION_MINUTES")
+	if ttl := reservationTTL(); ttl != 5*time.Minute {
+		t.Errorf("TTL = %v, want 5m", ttl)
+	}
+	for _, value := range []string{"0", "-5"} {
+		os.Setenv("RESERVATION_MINUTES", value)
+		if ttl := reservationTTL(); ttl != 15*time.Minute {
+			t.Errorf("TTL with RESERVATION_MINUTES=%s = %v, want 15m", value, ttl)
+		}
+	}
+}
+
+// TestBuildSearchTSQuery tests turning search text into a tsquery
+func TestBuildSearchTSQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "Single term", input: "gopher", want: "gopher:*"},
+		{name: "Multiple terms", input: "Gopher Hood", want: "gopher & hood:*"},
+		{name: "Extra whitespace", input: "  docker   whale ", want: "docker & whale:*"},
+		{name: "Operators stripped", input: "mug & !tea | (k8s)", want: "mug & tea & k8s:*"},
+		{name: "Only punctuation", input: "&|!:*", want: ""},
+		{name: "Empty", input: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildSearchTSQuery(tt.input); got != tt.want {
+				t.Errorf("buildSearchTSQuery(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestProductCursorRoundTrip tests cursor encoding for each sort order
+func TestProductCursorRoundTrip(t *testing.T) {
+	product := Product{
+		ID:        42,
+		Name:      "Nairobi Hoodie",
+		BasePrice: 2499.5,
+		CreatedAt: time.Date(2025, 3, 1, 10, 30, 0, 123456000, time.UTC),
+	}
+
+	tests := []struct {
+		sort  string
+		value string
+	}{
+		{sort: "newest", value: "2025-03-01T10:30:00.123456Z"},
+		{sort: "price_asc", value: "2499.5"},
+		{sort: "price_desc", value: "2499.5"},
+		{sort: "name", value: "Nairobi Hoodie"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			encoded := encodeProductCursor(productCursorFor(&product, tt.sort))
+
+			cursor, err := decodeProductCursor(encoded)
+			if err != nil {
+				t.Fatalf("decodeProductCursor() error = %v", err)
+			}
+			if cursor.Sort != tt.sort || cursor.Value != tt.value || cursor.ID != 42 {
+				t.Errorf("decodeProductCursor() = %+v, want {%s %s 42}", *cursor, tt.sort, tt.value)
+			}
+		})
+	}
+
+	for _, bad := range []string{
+		"", "%%%", "bm90IGpzb24",
+		encodeProductCursor(productCursor{Sort: "popular", ID: 1}),
+		encodeProductCursor(productCursor{Sort: "price_asc", Value: "cheap", ID: 1}),
+		encodeProductCursor(productCursor{Sort: "price_desc", Value: "NaN", ID: 1}),
+		encodeProductCursor(productCursor{Sort: "newest", Value: "1500", ID: 1}),
+	} {
+		if _, err := decodeProductCursor(bad); err == nil {
+			t.Errorf("decodeProductCursor(%q) expected error", bad)
+		}
+	}
+}
+
+// TestBuildCategoryTree tests nesting and descendant product counts
+func TestBuildCategoryTree(t *testing.T) {
+	parent := func(id int) *int { return &id }
+
+	// Ordered by sort_order, as returned from the database
+	nodes := []CategoryNode{
+		{Category: Category{ID: 1, Name: "Apparel"}, ProductCount: 1},
+		{Category: Category{ID: 2, Name: "Hoodies", ParentID: parent(1)}, ProductCount: 4},
+		{Category: Category{ID: 3, Name: "T-Shirts", ParentID: parent(1)}, ProductCount: 6},
+		{Category: Category{ID: 4, Name: "Zip Hoodies", ParentID: parent(2)}, ProductCount: 2},
+		{Category: Category{ID: 5, Name: "Accessories"}, ProductCount: 3},
+		{Category: Category{ID: 6, Name: "Orphan", ParentID: parent(99)}, ProductCount: 7},
+	}
+
+	roots := buildCategoryTree(nodes)
+
+	if len(roots) != 2 {
+		t.Fatalf("len(roots) = %d, want 2", len(roots))
+	}
+	if roots[0].ID != 1 || roots[1].ID != 5 {
+		t.Errorf("root order = [%d %d], want [1 5]", roots[0].ID, roots[1].ID)
+	}
+
+	apparel := roots[0]
+	if len(apparel.Children) != 2 || apparel.Children[0].ID != 2 || apparel.Children[1].ID != 3 {
+		t.Fatalf("Apparel children not nested in sort order")
+	}
+	if apparel.TotalProductCount != 13 {
+		t.Errorf("Apparel TotalProductCount = %d, want 13", apparel.TotalProductCount)
+	}
+	if hoodies := apparel.Children[0]; hoodies.ProductCount != 4 || hoodies.TotalProductCount != 6 {
+		t.Errorf("Hoodies counts = %d/%d, want 4/6", hoodies.ProductCount, hoodies.TotalProductCount)
+	}
+	if roots[1].TotalProductCount != 3 || roots[1].Children == nil {
+		t.Errorf("Accessories should have total 3 and an empty children list")
+	}
+}
+
+// TestIsWalletPayment tests which payment methods charge the wallet
+func TestIsWalletPayment(t *testing.T) {
+	method := func(s string) *string { return &s }
+	tests := []struct {
+		method *string
+		want   bool
+	}{
+		{method: nil, want: false},
+		{method: method("wallet"), want: true},
+		{method: method(" WALLET "), want: true},
+		{method: method("mpesa"), want: false},
+		{method: method("wallets"), want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isWalletPayment(tt.method); got != tt.want {
+			t.Errorf("isWalletPayment(%v) = %v, want %v", tt.method, got, tt.want)
+		}
+	}
+
+	err := error(&InsufficientBalanceError{Balance: 100, Required: 250})
+	if err.Error() != "insufficient wallet balance" {
+		t.Errorf("InsufficientBalanceError.Error() = %q", err.Error())
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Order statuses and the statuses each may move to. Orders move forward one step at a
+// time; they can be cancelled until they ship and refunded once shipped or delivered.
+var orderTransitions = map[string][]string{
+	"pending":    {"confirmed", "cancelled"},
+	"confirmed":  {"processing", "cancelled"},
+	"processing": {"shipped", "cancelled"},
+	"shipped":    {"delivered", "refunded"},
+	"delivered":  {"refunded"},
+	"cancelled":  {},
+	"refunded":   {},
+}
+
+// Timestamp column stamped when an order enters each status
+var orderStatusTimestamps = map[string]string{
+	"confirmed":  "confirmed_at",
+	"processing": "processing_at",
+	"shipped":    "shipped_at",
+	"delivered":  "delivered_at",
+	"cancelled":  "cancelled_at",
+	"refunded":   "refunded_at",
+}
+
+func isOrderStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+// Whether an order may move from one status to another
+func canTransitionOrder(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderTransitionError is returned when a status change isn't allowed from the order's current status
+type OrderTransitionError struct {
+	From    string
+	To      string
+	Allowed []string
+}
+
+func (e *OrderTransitionError) Error() string {
+	if len(e.Allowed) == 0 {
+		return fmt.Sprintf("order is %s and can't change status", e.From)
+	}
+	return fmt.Sprintf("can't move order from %s to %s (allowed: %s)", e.From, e.To, strings.Join(e.Allowed, ", "))
+}
+
+// OrderStatusChange is one entry in an order's status history
+type OrderStatusChange struct {
+	ID         int       `json:"id"`
+	OrderID    int       `json:"order_id"`
+	FromStatus *string   `json:"from_status"` // nil for the entry written when the order is placed
+	ToStatus   string    `json:"to_status"`
+	ChangedBy  *int      `json:"changed_by,omitempty"` // user who made the change; nil for guests and the system
+	Note       *string   `json:"note,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Append a status change to an order's history inside tx
+func recordOrderStatus(tx *sql.Tx, orderID int, from *string, to string, changedBy *int, note *string) error {
+	_, err := tx.Exec(`
+		INSERT INTO orders.order_status_history (order_id, from_status, to_status, changed_by, note)
+		VALUES ($1, $2, $3, $4, $5)
+	`, orderID, from, to, changedBy, note)
+	return err
+}
+
+// Get an order's status history, oldest first
+func getOrderStatusHistory(orderID int) ([]OrderStatusChange, error) {
+	rows, err := db.Query(`
+		SELECT id, order_id, from_status, to_status, changed_by, note, created_at
+		FROM orders.order_status_history
+		WHERE order_id = $1
+		ORDER BY created_at, id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []OrderStatusChange{}
+	for rows.Next() {
+		var change OrderStatusChange
+		err := rows.Scan(&change.ID, &change.OrderID, &change.FromStatus, &change.ToStatus, &change.ChangedBy, &change.Note, &change.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, change)
+	}
+
+	return history, rows.Err()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestCanTransitionOrder tests the order status graph
+func TestCanTransitionOrder(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+		want bool
+	}{
+		{from: "pending", to: "confirmed", want: true},
+		{from: "confirmed", to: "processing", want: true},
+		{from: "processing", to: "shipped", want: true},
+		{from: "shipped", to: "delivered", want: true},
+		{from: "pending", to: "cancelled", want: true},
+		{from: "processing", to: "cancelled", want: true},
+		{from: "shipped", to: "refunded", want: true},
+		{from: "delivered", to: "refunded", want: true},
+		{from: "delivered", to: "pending", want: false},
+		{from: "pending", to: "shipped", want: false},
+		{from: "shipped", to: "cancelled", want: false},
+		{from: "pending", to: "refunded", want: false},
+		{from: "cancelled", to: "pending", want: false},
+		{from: "refunded", to: "delivered", want: false},
+		{from: "unknown", to: "confirmed", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := canTransitionOrder(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransitionOrder(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+// TestOrderStatusTimestamps tests every status an order can move into stamps a column
+func TestOrderStatusTimestamps(t *testing.T) {
+	for from, nexts := range orderTransitions {
+		for _, to := range nexts {
+			if !isOrderStatus(to) {
+				t.Errorf("%s -> %s leads to an unknown status", from, to)
+			}
+			if orderStatusTimestamps[to] == "" {
+				t.Errorf("no timestamp column for %s", to)
+			}
+		}
+	}
+}
+
+// TestOrderTransitionError tests the messages for refused status changes
+func TestOrderTransitionError(t *testing.T) {
+	err := &OrderTransitionError{From: "delivered", To: "pending", Allowed: orderTransitions["delivered"]}
+	if !strings.Contains(err.Error(), "allowed: refunded") {
+		t.Errorf("Error() = %q, want the allowed statuses", err.Error())
+	}
+
+	final := &OrderTransitionError{From: "cancelled", To: "pending"}
+	if !strings.Contains(final.Error(), "can't change status") {
+		t.Errorf("Error() = %q, want a final-status message", final.Error())
+	}
+}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PointsRules decide how many loyalty points an order earns and when, and what they are worth at checkout
+type PointsRules struct {
+	KESPerPoint         float64            // spend that earns one point
+	EarnOn              string             // "delivered", or "paid" to award as soon as payment is taken
+	CategoryMultipliers map[string]float64 // by category slug; subcategories inherit their parent's
+	RedeemValue         float64            // KES discount one redeemed point gives
+	RedeemMaxPercent    int                // largest share of the subtotal points can pay for
+	ExpiryDays          int                // points not used within this many days expire; 0 keeps them forever
+	Tiers               []PointsTier       // lowest first; the first tier must start at 0
+	TierWindowDays      int                // rolling period of delivered orders that decides a customer's tier
+}
+
+// PointsTier is a customer tier reached by spend over the rolling window. Higher tiers earn faster.
+type PointsTier struct {
+	Name       string  `json:"name"`
+	MinSpend   float64 `json:"min_spend"`
+	Multiplier float64 `json:"multiplier"`
+}
+
+// InsufficientPointsError is returned by checkout when a customer redeems more points than they have
+type InsufficientPointsError struct {
+	Balance   int
+	Requested int
+}
+
+func (e *InsufficientPointsError) Error() string {
+	return "insufficient points balance"
+}
+
+// Read the earning rules from the environment
+func loadPointsRules() (*PointsRules, error) {
+	rules := &PointsRules{
+		KESPerPoint:      float64(getEnvInt("POINTS_KES_PER_POINT", 100)),
+		EarnOn:           strings.ToLower(strings.TrimSpace(os.Getenv("POINTS_EARN_ON"))),
+		RedeemMaxPercent: getEnvInt("POINTS_REDEEM_MAX_PERCENT", 50),
+		ExpiryDays:       getEnvInt("POINTS_EXPIRY_DAYS", 365),
+		TierWindowDays:   getEnvInt("POINTS_TIER_WINDOW_DAYS", 365),
+	}
+	if rules.KESPerPoint <= 0 {
+		return nil, fmt.Errorf("POINTS_KES_PER_POINT must be positive")
+	}
+	if rules.ExpiryDays < 0 {
+		return nil, fmt.Errorf("POINTS_EXPIRY_DAYS can't be negative")
+	}
+	if rules.TierWindowDays <= 0 {
+		return nil, fmt.Errorf("POINTS_TIER_WINDOW_DAYS must be positive")
+	}
+
+	var err error
+	if rules.RedeemValue, err = envPositiveFloat("POINTS_REDEEM_VALUE", 1); err != nil {
+		return nil, err
+	}
+
+	silver := PointsTier{Name: "Silver"}
+	gold := PointsTier{Name: "Gold"}
+	if silver.MinSpend, err = envPositiveFloat("POINTS_TIER_SILVER_SPEND", 20000); err != nil {
+		return nil, err
+	}
+	if gold.MinSpend, err = envPositiveFloat("POINTS_TIER_GOLD_SPEND", 50000); err != nil {
+		return nil, err
+	}
+	if silver.Multiplier, err = envPositiveFloat("POINTS_TIER_SILVER_MULTIPLIER", 1.25); err != nil {
+		return nil, err
+	}
+	if gold.Multiplier, err = envPositiveFloat("POINTS_TIER_GOLD_MULTIPLIER", 1.5); err != nil {
+		return nil, err
+	}
+	if gold.MinSpend <= silver.MinSpend {
+		return nil, fmt.Errorf("POINTS_TIER_GOLD_SPEND must be above POINTS_TIER_SILVER_SPEND")
+	}
+	rules.Tiers = []PointsTier{{Name: "Bronze", MinSpend: 0, Multiplier: 1}, silver, gold}
+
+	if rules.RedeemMaxPercent < 0 || rules.RedeemMaxPercent > 100 {
+		return nil, fmt.Errorf("POINTS_REDEEM_MAX_PERCENT must be between 0 and 100")
+	}
+	if rules.EarnOn == "" {
+		rules.EarnOn = "delivered"
+	}
+	if rules.EarnOn != "delivered" && rules.EarnOn != "paid" {
+		return nil, fmt.Errorf("POINTS_EARN_ON must be 'delivered' or 'paid'")
+	}
+
+	multipliers, err := parseCategoryMultipliers(os.Getenv("POINTS_CATEGORY_MULTIPLIERS"))
+	if err != nil {
+		return nil, err
+	}
+	rules.CategoryMultipliers = multipliers
+
+	return rules, nil
+}
+
+// Read a positive decimal setting from the environment, falling back to a default when unset
+func envPositiveFloat(key string, fallback float64) (float64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number", key)
+	}
+	return number, nil
+}
+
+var (
+	pointsRules     *PointsRules
+	pointsRulesOnce sync.Once
+)
+
+// Parse the earning rules once at startup so a typo doesn't surface on the first delivery
+func initPointsRules() {
+	rules, err := loadPointsRules()
+	if err != nil {
+		log.Fatalf("Invalid loyalty points settings: %v", err)
+	}
+	pointsRules = rules
+}
+
+// Rules in use, parsing them on first use when initPointsRules hasn't run (e.g. in tests)
+func currentPointsRules() *PointsRules {
+	pointsRulesOnce.Do(func() {
+		if pointsRules != nil {
+			return
+		}
+		rules, err := loadPointsRules()
+		if err != nil {
+			log.Fatalf("Invalid loyalty points settings: %v", err)
+		}
+		pointsRules = rules
+	})
+	return pointsRules
+}
+
+// Parse "hoodies:2,stickers:0.5" into multipliers by category slug
+func parseCategoryMultipliers(value string) (map[string]float64, error) {
+	multipliers := map[string]float64{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		slug, factor, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("POINTS_CATEGORY_MULTIPLIERS entry %q should be slug:multiplier", entry)
+		}
+		multiplier, err := strconv.ParseFloat(strings.TrimSpace(factor), 64)
+		if err != nil || multiplier < 0 {
+			return nil, fmt.Errorf("POINTS_CATEGORY_MULTIPLIERS entry %q has an invalid multiplier", entry)
+		}
+		multipliers[strings.TrimSpace(slug)] = multiplier
+	}
+	return multipliers, nil
+}
+
+// pointsCategory is the part of a category needed to find its multiplier
+type pointsCategory struct {
+	Slug     string
+	ParentID *int
+}
+
+// Multiplier for a category: its own, else the nearest ancestor's, else 1
+func (r *PointsRules) categoryMultiplier(categoryID *int, categories map[int]pointsCategory) float64 {
+	// Bounded walk in case of a cycle in the data
+	for depth := 0; categoryID != nil && depth < 10; depth++ {
+		category, ok := categories[*categoryID]
+		if !ok {
+			break
+		}
+		if multiplier, ok := r.CategoryMultipliers[category.Slug]; ok {
+			return multiplier
+		}
+		categoryID = category.ParentID
+	}
+	return 1
+}
+
+// PointsLine is one order line as far as earning points is concerned
+type PointsLine struct {
+	Amount     float64
+	CategoryID *int
+}
+
+// Points earned by a set of order lines. Each line's amount is scaled by its category
+// multiplier; the total is rounded down once so small lines still count.
+func (r *PointsRules) pointsFor(lines []PointsLine, categories map[int]pointsCategory) int {
+	var weighted float64
+	for _, line := range lines {
+		weighted += line.Amount * r.categoryMultiplier(line.CategoryID, categories)
+	}
+	return int(math.Floor(weighted/r.KESPerPoint + 1e-9))
+}
+
+// Points used and the discount they give when redeeming on a subtotal. A request larger
+// than RedeemMaxPercent of the subtotal allows is trimmed to the cap.
+func (r *PointsRules) redemption(requested int, subtotal float64) (int, float64) {
+	if requested <= 0 || subtotal <= 0 {
+		return 0, 0
+	}
+	maxDiscount := subtotal * float64(r.RedeemMaxPercent) / 100
+	points := requested
+	if maxPoints := int(math.Floor(maxDiscount/r.RedeemValue + 1e-9)); points > maxPoints {
+		points = maxPoints
+	}
+	discount := math.Round(float64(points)*r.RedeemValue*100) / 100
+	return points, discount
+}
+
+// The highest tier a rolling spend reaches. Tiers are ordered lowest first.
+func tierForSpend(spend float64, tiers []PointsTier) PointsTier {
+	tier := PointsTier{Name: "Bronze", Multiplier: 1}
+	for _, t := range tiers {
+		if spend >= t.MinSpend {
+			tier = t
+		}
+	}
+	return tier
+}
+
+// The tier after the one a rolling spend reaches, or nil at the top
+func nextTier(spend float64, tiers []PointsTier) *PointsTier {
+	for _, t := range tiers {
+		if spend < t.MinSpend {
+			return &t
+		}
+	}
+	return nil
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// A customer's spend on orders delivered within the tier window, leaving out one order
+// (pass 0 to count them all) so an order doesn't lift its own tier
+func rollingSpend(q queryRower, userID, excludeOrderID int, windowDays int) (float64, error) {
+	var spend float64
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(total_amount), 0)
+		FROM orders.orders
+		WHERE user_id = $1 AND status = 'delivered' AND id <> $2
+		  AND delivered_at >= NOW() - make_interval(days => $3)
+	`, userID, excludeOrderID, windowDays).Scan(&spend)
+	return spend, err
+}
+
+// What an order's current state means for its points: "earn", "reverse" or nothing
+func orderPointsAction(status, paymentStatus, earnOn string) string {
+	switch {
+	case status == "cancelled" || status == "refunded" || paymentStatus == "refunded":
+		return "reverse"
+	case status == "delivered":
+		return "earn"
+	case earnOn == "paid" && paymentStatus == "paid":
+		return "earn"
+	}
+	return ""
+}
+
+// Initialize user points when user registers
+func initializeUserPoints(tx *sql.Tx, userID int) error {
+	_, err := tx.Exec(`
+		INSERT INTO auth.user_points (user_id, points_balance, total_earned, total_spent)
+		VALUES ($1, 0, 0, 0)
+		ON CONFLICT (user_id) DO NOTHING
+	`, userID)
+	return err
+}
+
+// How a ledger entry moves the earned and spent totals. Points are signed: positive
+// entries add to the balance, negative ones take from it.
+func pointsTotalsDelta(transactionType string, points int) (earned, spent int) {
+	switch transactionType {
+	case "earned", "reversed":
+		return points, 0
+	case "spent", "restored":
+		return 0, -points
+	}
+	return 0, 0
+}
+
+// Write a points ledger entry inside tx and apply it to the user's balance. Entries tied
+// to an order are written at most once per type; false means the entry already existed.
+func addPointsTx(tx *sql.Tx, userID, points int, transactionType, description string, orderID *int) (bool, error) {
+	res, err := tx.Exec(`
+		INSERT INTO auth.points_transactions (user_id, order_id, transaction_type, points, description)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (order_id, transaction_type) WHERE order_id IS NOT NULL DO NOTHING
+	`, userID, orderID, transactionType, points, description)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	// Accounts created before points were initialized at registration get their row here
+	earned, spent := pointsTotalsDelta(transactionType, points)
+	_, err = tx.Exec(`
+		INSERT INTO auth.user_points (user_id, points_balance, total_earned, total_spent)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE
+		SET points_balance = user_points.points_balance + EXCLUDED.points_balance,
+		    total_earned = user_points.total_earned + EXCLUDED.total_earned,
+		    total_spent = user_points.total_spent + EXCLUDED.total_spent,
+		    updated_at = NOW()
+	`, userID, points, earned, spent)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Add points to user account
+func addPointsToUser(userID int, points int, description string, orderID *int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := addPointsTx(tx, userID, points, "earned", description, orderID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Spend points on an order inside tx. The customer's balance is locked and must cover
+// everything they asked to redeem, even when the cap means fewer (or no) points are used.
+func redeemOrderPoints(tx *sql.Tx, userID, orderID, requested, points int, orderNumber string) error {
+	var balance int
+	err := tx.QueryRow(`SELECT points_balance FROM auth.user_points WHERE user_id = $1 FOR UPDATE`, userID).Scan(&balance)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if balance < requested {
+		return &InsufficientPointsError{Balance: balance, Requested: requested}
+	}
+	if points == 0 {
+		return nil
+	}
+
+	_, err = addPointsTx(tx, userID, -points, "spent", "Redeemed on order "+orderNumber, &orderID)
+	return err
+}
+
+// Bring an order's points in line with its state inside tx: award them once it reaches
+// the earning stage, and if it is cancelled or refunded take them back and return any
+// points redeemed on it. Safe to call after any change to the order; each entry is
+// only ever written once.
+func syncOrderPoints(tx *sql.Tx, orderID int) error {
+	var userID sql.NullInt64
+	var status, paymentStatus, orderNumber string
+	err := tx.QueryRow(`
+		SELECT user_id, status, COALESCE(payment_status, ''), order_number
+		FROM orders.orders
+		WHERE id = $1
+	`, orderID).Scan(&userID, &status, &paymentStatus, &orderNumber)
+	if err != nil {
+		return err
+	}
+	// Guests have no points account
+	if !userID.Valid {
+		return nil
+	}
+
+	rules := currentPointsRules()
+
+	switch orderPointsAction(status, paymentStatus, rules.EarnOn) {
+	case "earn":
+		points, err := orderPoints(tx, int(userID.Int64), orderID, rules)
+		if err != nil || points <= 0 {
+			return err
+		}
+		_, err = addPointsTx(tx, int(userID.Int64), points, "earned", "Order "+orderNumber, &orderID)
+		return err
+
+	case "reverse":
+		earned, err := orderLedgerPoints(tx, orderID, "earned")
+		if err != nil {
+			return err
+		}
+		// The balance can dip below zero if the points were already spent
+		if earned != 0 {
+			_, err = addPointsTx(tx, int(userID.Int64), -earned, "reversed", "Refunded order "+orderNumber, &orderID)
+			if err != nil {
+				return err
+			}
+		}
+
+		spent, err := orderLedgerPoints(tx, orderID, "spent")
+		if err != nil {
+			return err
+		}
+		if spent != 0 {
+			_, err = addPointsTx(tx, int(userID.Int64), -spent, "restored", "Points returned from order "+orderNumber, &orderID)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Points in an order's ledger entry of one type, or 0 when there is none
+func orderLedgerPoints(tx *sql.Tx, orderID int, transactionType string) (int, error) {
+	var points int
+	err := tx.QueryRow(`
+		SELECT points FROM auth.points_transactions
+		WHERE order_id = $1 AND transaction_type = $2
+	`, orderID, transactionType).Scan(&points)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return points, err
+}
+
+// Points an order's lines are worth under the rules. Lines are scaled down by any
+// discount, so points paid with don't earn points, and up by the customer's tier.
+func orderPoints(tx *sql.Tx, userID, orderID int, rules *PointsRules) (int, error) {
+	var subtotal, discount float64
+	err := tx.QueryRow(`
+		SELECT subtotal, COALESCE(discount_amount, 0) FROM orders.orders WHERE id = $1
+	`, orderID).Scan(&subtotal, &discount)
+	if err != nil {
+		return 0, err
+	}
+	paidShare := 1.0
+	if subtotal > 0 {
+		paidShare = math.Max(subtotal-discount, 0) / subtotal
+	}
+
+	spend, err := rollingSpend(tx, userID, orderID, rules.TierWindowDays)
+	if err != nil {
+		return 0, err
+	}
+	scale := paidShare * tierForSpend(spend, rules.Tiers).Multiplier
+
+	rows, err := tx.Query(`
+		SELECT oi.total_price, p.category_id
+		FROM orders.order_items oi
+		LEFT JOIN catalog.product_variants v ON v.id = oi.variant_id
+		LEFT JOIN catalog.products p ON p.id = v.product_id
+		WHERE oi.order_id = $1
+	`, orderID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	lines := []PointsLine{}
+	for rows.Next() {
+		var line PointsLine
+		if err := rows.Scan(&line.Amount, &line.CategoryID); err != nil {
+			return 0, err
+		}
+		line.Amount *= scale
+		lines = append(lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	categories := map[int]pointsCategory{}
+	if len(rules.CategoryMultipliers) > 0 {
+		rows, err := tx.Query(`SELECT id, slug, parent_id FROM catalog.categories`)
+		if err != nil {
+			return 0, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			var category pointsCategory
+			if err := rows.Scan(&id, &category.Slug, &category.ParentID); err != nil {
+				return 0, err
+			}
+			categories[id] = category
+		}
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	return rules.pointsFor(lines, categories), nil
+}
+
+// PointsTransaction is one entry in a customer's points history
+type PointsTransaction struct {
+	ID              int       `json:"id"`
+	OrderID         *int      `json:"order_id,omitempty"`
+	TransactionType string    `json:"transaction_type"` // earned, reversed, spent, restored or expired
+	Points          int       `json:"points"`           // negative for entries that take points away
+	Description     string    `json:"description"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// Get one page of a user's points history, newest first, and the total number of entries
+func getPointsTransactions(userID, page, limit int) ([]PointsTransaction, int, error) {
+	var total int
+	err := db.QueryRow(`SELECT COUNT(*) FROM auth.points_transactions WHERE user_id = $1`, userID).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query(`
+		SELECT id, order_id, transaction_type, points, COALESCE(description, ''), created_at
+		FROM auth.points_transactions
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3
+	`, userID, limit, (page-1)*limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	transactions := []PointsTransaction{}
+	for rows.Next() {
+		var t PointsTransaction
+		if err := rows.Scan(&t.ID, &t.OrderID, &t.TransactionType, &t.Points, &t.Description, &t.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		transactions = append(transactions, t)
+	}
+
+	return transactions, total, rows.Err()
+}
+
+// PointsSummary is a user's balance with their tier
+type PointsSummary struct {
+	UserPoints
+	Tier         PointsTier  `json:"tier"`
+	NextTier     *PointsTier `json:"next_tier,omitempty"`
+	RollingSpend float64     `json:"rolling_spend"` // delivered orders within the tier window
+	ExpiryDays   int         `json:"expiry_days,omitempty"`
+}
+
+// Get a user's points balance and tier. Users without a points row yet have an empty balance.
+func getPointsSummary(userID int) (*PointsSummary, error) {
+	rules := currentPointsRules()
+
+	points, err := getUserPoints(userID)
+	if err == sql.ErrNoRows {
+		points, err = &UserPoints{UserID: userID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	spend, err := rollingSpend(db, userID, 0, rules.TierWindowDays)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PointsSummary{
+		UserPoints:   *points,
+		Tier:         tierForSpend(spend, rules.Tiers),
+		NextTier:     nextTier(spend, rules.Tiers),
+		RollingSpend: spend,
+		ExpiryDays:   rules.ExpiryDays,
+	}, nil
+}
+
+// Points that expire for a user: points earned before the cutoff that the points used
+// since haven't used up (points are used oldest first), never more than the current balance
+func expiringPoints(oldCredits, used, balance int) int {
+	expiring := oldCredits - used
+	if expiring > balance {
+		expiring = balance
+	}
+	if expiring < 0 {
+		return 0
+	}
+	return expiring
+}
+
+// Per-user totals the expiry sweep works from: points earned before the cutoff ($1) and
+// points used so far. Only 'spent' and 'expired' entries use points up. Earned points
+// later reversed, and spends later restored, cancel out and are left out entirely.
+const pointsUsageQuery = `
+	SELECT t.user_id,
+	       COALESCE(SUM(t.points) FILTER (WHERE t.transaction_type = 'earned' AND t.created_at < $1), 0) AS old_credits,
+	       COALESCE(-SUM(t.points) FILTER (WHERE t.transaction_type IN ('spent', 'expired')), 0) AS used
+	FROM auth.points_transactions t
+	WHERE NOT EXISTS (
+		SELECT 1 FROM auth.points_transactions p
+		WHERE p.user_id = t.user_id AND p.order_id = t.order_id
+		  AND ((t.transaction_type = 'earned' AND p.transaction_type = 'reversed')
+		    OR (t.transaction_type = 'spent' AND p.transaction_type = 'restored'))
+	)
+	GROUP BY t.user_id
+`
+
+// Write 'expired' entries for points earned before the cutoff and not used since.
+// Returns the number of users whose points expired.
+func expirePoints(cutoff time.Time) (int, error) {
+	rows, err := db.Query(`
+		SELECT user_id FROM (`+pointsUsageQuery+`) totals
+		WHERE old_credits > used
+	`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	userIDs := []int{}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, userID := range userIDs {
+		ok, err := expireUserPoints(userID, cutoff)
+		if err != nil {
+			return expired, err
+		}
+		if ok {
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+// Expire one user's unused points from before the cutoff. The balance row is locked so a
+// checkout redeeming points at the same time sees the result.
+func expireUserPoints(userID int, cutoff time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var balance int
+	err = tx.QueryRow(`SELECT points_balance FROM auth.user_points WHERE user_id = $1 FOR UPDATE`, userID).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var oldCredits, used int
+	err = tx.QueryRow(`
+		SELECT old_credits, used FROM (`+pointsUsageQuery+`) totals
+		WHERE user_id = $2
+	`, cutoff, userID).Scan(&oldCredits, &used)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	points := expiringPoints(oldCredits, used, balance)
+	if points == 0 {
+		return false, nil
+	}
+
+	description := fmt.Sprintf("Points earned before %s expired", cutoff.Format("2 Jan 2006"))
+	if _, err := addPointsTx(tx, userID, -points, "expired", description, nil); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
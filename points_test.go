@@ -0,0 +1,240 @@
+package main
+
+import "testing"
+
+// TestParseCategoryMultipliers tests reading per-category multipliers from the environment format
+func TestParseCategoryMultipliers(t *testing.T) {
+	multipliers, err := parseCategoryMultipliers(" hoodies:2, stickers : 0.5 ,,")
+	if err != nil {
+		t.Fatalf("parseCategoryMultipliers() error = %v", err)
+	}
+	if len(multipliers) != 2 || multipliers["hoodies"] != 2 || multipliers["stickers"] != 0.5 {
+		t.Errorf("parseCategoryMultipliers() = %v", multipliers)
+	}
+
+	for _, value := range []string{"hoodies", "hoodies:two", "hoodies:-1"} {
+		if _, err := parseCategoryMultipliers(value); err == nil {
+			t.Errorf("parseCategoryMultipliers(%q) should fail", value)
+		}
+	}
+}
+
+// TestPointsFor tests points per KES spent with category multipliers inherited down the tree
+func TestPointsFor(t *testing.T) {
+	id := func(i int) *int { return &i }
+	categories := map[int]pointsCategory{
+		1: {Slug: "apparel"},
+		2: {Slug: "hoodies", ParentID: id(1)},
+		3: {Slug: "zip-hoodies", ParentID: id(2)},
+		4: {Slug: "stickers"},
+	}
+	rules := &PointsRules{KESPerPoint: 100, CategoryMultipliers: map[string]float64{"hoodies": 2, "stickers": 0}}
+
+	tests := []struct {
+		name  string
+		lines []PointsLine
+		want  int
+	}{
+		{name: "No multiplier", lines: []PointsLine{{Amount: 1999, CategoryID: id(1)}}, want: 19},
+		{name: "Own multiplier", lines: []PointsLine{{Amount: 1500, CategoryID: id(2)}}, want: 30},
+		{name: "Inherited multiplier", lines: []PointsLine{{Amount: 1500, CategoryID: id(3)}}, want: 30},
+		{name: "Zero multiplier", lines: []PointsLine{{Amount: 5000, CategoryID: id(4)}}, want: 0},
+		{name: "Uncategorised", lines: []PointsLine{{Amount: 250}}, want: 2},
+		{name: "Rounded once per order", lines: []PointsLine{{Amount: 50}, {Amount: 50}, {Amount: 99.99, CategoryID: id(1)}}, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules.pointsFor(tt.lines, categories); got != tt.want {
+				t.Errorf("pointsFor() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestOrderPointsAction tests when an order earns points and when they are taken back
+func TestOrderPointsAction(t *testing.T) {
+	tests := []struct {
+		status, paymentStatus, earnOn string
+		want                          string
+	}{
+		{status: "pending", paymentStatus: "pending", earnOn: "delivered", want: ""},
+		{status: "confirmed", paymentStatus: "paid", earnOn: "delivered", want: ""},
+		{status: "confirmed", paymentStatus: "paid", earnOn: "paid", want: "earn"},
+		{status: "delivered", paymentStatus: "paid", earnOn: "delivered", want: "earn"},
+		{status: "delivered", paymentStatus: "pending", earnOn: "paid", want: "earn"},
+		{status: "refunded", paymentStatus: "refunded", earnOn: "delivered", want: "reverse"},
+		{status: "cancelled", paymentStatus: "paid", earnOn: "paid", want: "reverse"},
+		{status: "shipped", paymentStatus: "refunded", earnOn: "paid", want: "reverse"},
+	}
+
+	for _, tt := range tests {
+		if got := orderPointsAction(tt.status, tt.paymentStatus, tt.earnOn); got != tt.want {
+			t.Errorf("orderPointsAction(%q, %q, %q) = %q, want %q", tt.status, tt.paymentStatus, tt.earnOn, got, tt.want)
+		}
+	}
+}
+
+// TestLoadPointsRules tests the defaults and rejection of bad settings
+func TestLoadPointsRules(t *testing.T) {
+	t.Setenv("POINTS_KES_PER_POINT", "")
+	t.Setenv("POINTS_EARN_ON", "")
+	t.Setenv("POINTS_CATEGORY_MULTIPLIERS", "")
+	t.Setenv("POINTS_REDEEM_VALUE", "")
+	t.Setenv("POINTS_REDEEM_MAX_PERCENT", "")
+	t.Setenv("POINTS_EXPIRY_DAYS", "")
+	t.Setenv("POINTS_TIER_SILVER_SPEND", "")
+	t.Setenv("POINTS_TIER_GOLD_SPEND", "")
+	rules, err := loadPointsRules()
+	if err != nil {
+		t.Fatalf("loadPointsRules() error = %v", err)
+	}
+	if rules.KESPerPoint != 100 || rules.EarnOn != "delivered" || rules.RedeemValue != 1 || rules.RedeemMaxPercent != 50 {
+		t.Errorf("defaults = %+v", rules)
+	}
+	if len(rules.Tiers) != 3 || rules.Tiers[0].MinSpend != 0 || rules.Tiers[2].Name != "Gold" || rules.ExpiryDays != 365 {
+		t.Errorf("tier and expiry defaults = %+v", rules)
+	}
+
+	t.Setenv("POINTS_EARN_ON", "shipped")
+	if _, err := loadPointsRules(); err == nil {
+		t.Error("loadPointsRules() accepted POINTS_EARN_ON=shipped")
+	}
+
+	t.Setenv("POINTS_EARN_ON", "Paid")
+	t.Setenv("POINTS_KES_PER_POINT", "0")
+	if _, err := loadPointsRules(); err == nil {
+		t.Error("loadPointsRules() accepted POINTS_KES_PER_POINT=0")
+	}
+
+	t.Setenv("POINTS_KES_PER_POINT", "100")
+	t.Setenv("POINTS_REDEEM_VALUE", "free")
+	if _, err := loadPointsRules(); err == nil {
+		t.Error("loadPointsRules() accepted POINTS_REDEEM_VALUE=free")
+	}
+
+	t.Setenv("POINTS_REDEEM_VALUE", "0.5")
+	t.Setenv("POINTS_REDEEM_MAX_PERCENT", "150")
+	if _, err := loadPointsRules(); err == nil {
+		t.Error("loadPointsRules() accepted POINTS_REDEEM_MAX_PERCENT=150")
+	}
+
+	t.Setenv("POINTS_REDEEM_MAX_PERCENT", "50")
+	t.Setenv("POINTS_TIER_SILVER_SPEND", "60000")
+	if _, err := loadPointsRules(); err == nil {
+		t.Error("loadPointsRules() accepted a Silver threshold above Gold")
+	}
+}
+
+// TestRedemption tests converting points to a discount capped at a share of the subtotal
+func TestRedemption(t *testing.T) {
+	rules := &PointsRules{RedeemValue: 0.5, RedeemMaxPercent: 50}
+
+	tests := []struct {
+		name         string
+		requested    int
+		subtotal     float64
+		wantPoints   int
+		wantDiscount float64
+	}{
+		{name: "Under the cap", requested: 400, subtotal: 2000, wantPoints: 400, wantDiscount: 200},
+		{name: "Trimmed to the cap", requested: 5000, subtotal: 2000, wantPoints: 2000, wantDiscount: 1000},
+		{name: "Odd subtotal", requested: 5000, subtotal: 999.99, wantPoints: 999, wantDiscount: 499.5},
+		{name: "Nothing requested", requested: 0, subtotal: 2000, wantPoints: 0, wantDiscount: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points, discount := rules.redemption(tt.requested, tt.subtotal)
+			if points != tt.wantPoints || discount != tt.wantDiscount {
+				t.Errorf("redemption(%d, %.2f) = %d, %.2f, want %d, %.2f", tt.requested, tt.subtotal, points, discount, tt.wantPoints, tt.wantDiscount)
+			}
+		})
+	}
+
+	off := &PointsRules{RedeemValue: 1, RedeemMaxPercent: 0}
+	if points, _ := off.redemption(100, 2000); points != 0 {
+		t.Errorf("redemption() with a 0%% cap used %d points", points)
+	}
+}
+
+// TestPointsTotalsDelta tests which totals each kind of ledger entry moves
+func TestPointsTotalsDelta(t *testing.T) {
+	tests := []struct {
+		transactionType       string
+		points                int
+		wantEarned, wantSpent int
+	}{
+		{transactionType: "earned", points: 40, wantEarned: 40},
+		{transactionType: "reversed", points: -40, wantEarned: -40},
+		{transactionType: "spent", points: -300, wantSpent: 300},
+		{transactionType: "restored", points: 300, wantSpent: -300},
+	}
+
+	for _, tt := range tests {
+		earned, spent := pointsTotalsDelta(tt.transactionType, tt.points)
+		if earned != tt.wantEarned || spent != tt.wantSpent {
+			t.Errorf("pointsTotalsDelta(%q, %d) = %d, %d, want %d, %d", tt.transactionType, tt.points, earned, spent, tt.wantEarned, tt.wantSpent)
+		}
+	}
+}
+
+// TestTierForSpend tests picking the tier reached by a rolling spend and the one after it
+func TestTierForSpend(t *testing.T) {
+	tiers := []PointsTier{
+		{Name: "Bronze", MinSpend: 0, Multiplier: 1},
+		{Name: "Silver", MinSpend: 20000, Multiplier: 1.25},
+		{Name: "Gold", MinSpend: 50000, Multiplier: 1.5},
+	}
+
+	tests := []struct {
+		spend    float64
+		want     string
+		wantNext string
+	}{
+		{spend: 0, want: "Bronze", wantNext: "Silver"},
+		{spend: 19999.99, want: "Bronze", wantNext: "Silver"},
+		{spend: 20000, want: "Silver", wantNext: "Gold"},
+		{spend: 75000, want: "Gold"},
+	}
+
+	for _, tt := range tests {
+		if got := tierForSpend(tt.spend, tiers); got.Name != tt.want {
+			t.Errorf("tierForSpend(%.2f) = %s, want %s", tt.spend, got.Name, tt.want)
+		}
+		next := nextTier(tt.spend, tiers)
+		if (next == nil && tt.wantNext != "") || (next != nil && next.Name != tt.wantNext) {
+			t.Errorf("nextTier(%.2f) = %v, want %q", tt.spend, next, tt.wantNext)
+		}
+	}
+
+	// Silver customers earn a quarter more
+	rules := &PointsRules{KESPerPoint: 100}
+	lines := []PointsLine{{Amount: 4000 * tierForSpend(25000, tiers).Multiplier}}
+	if got := rules.pointsFor(lines, nil); got != 50 {
+		t.Errorf("Silver pointsFor() = %d, want 50", got)
+	}
+}
+
+// TestExpiringPoints tests that points are used oldest first before anything expires
+func TestExpiringPoints(t *testing.T) {
+	tests := []struct {
+		name                      string
+		oldCredits, used, balance int
+		want                      int
+	}{
+		{name: "Nothing used", oldCredits: 300, used: 0, balance: 500, want: 300},
+		{name: "Partly used", oldCredits: 300, used: 120, balance: 380, want: 180},
+		{name: "All used", oldCredits: 300, used: 400, balance: 100, want: 0},
+		{name: "Capped at balance", oldCredits: 300, used: 0, balance: 200, want: 200},
+		{name: "Negative balance", oldCredits: 300, used: 0, balance: -40, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expiringPoints(tt.oldCredits, tt.used, tt.balance); got != tt.want {
+				t.Errorf("expiringPoints() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Permissions that admin routes check. A role is a named set of these.
+const (
+	permCatalogWrite   = "catalog:write"   // products, variants, categories and images
+	permOrdersFulfil   = "orders:fulfil"   // view orders and stock holds, update order status
+	permCustomersRead  = "customers:read"  // view customer accounts
+	permCustomersWrite = "customers:write" // unlock, deactivate and reactivate accounts
+	permWalletAdjust   = "wallet:adjust"   // credit or debit customer wallets
+)
+
+var allPermissions = []string{permCatalogWrite, permOrdersFulfil, permCustomersRead, permCustomersWrite, permWalletAdjust}
+
+// Built-in roles. super_admin has every permission without it being stored;
+// customer can never hold permissions.
+const (
+	roleCustomer   = "customer"
+	roleSuperAdmin = "super_admin"
+)
+
+// Errors returned by role management
+var (
+	errRoleNotFound  = errors.New("role not found")
+	errRoleBuiltIn   = errors.New("built-in role can't be changed")
+	errRoleInUse     = errors.New("role is assigned to users")
+	errOwnRoleChange = errors.New("you can't change your own role")
+)
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{1,19}$`)
+
+// Whether a role gets into the admin area at all; what it can do there depends on its permissions
+func isStaffRole(role string) bool {
+	return role != "" && role != roleCustomer
+}
+
+func isValidPermission(permission string) bool {
+	for _, p := range allPermissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Role is a named set of admin permissions
+type Role struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions"`
+	IsSystem    bool      `json:"is_system"` // built-in roles can't be deleted
+	UserCount   int       `json:"user_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// RoleRequest creates a role, or updates one when fields are omitted
+type RoleRequest struct {
+	Name        string    `json:"name"`
+	Description *string   `json:"description,omitempty"`
+	Permissions *[]string `json:"permissions,omitempty"`
+}
+
+// Validate the request, de-duplicating permissions. The name is only checked when creating.
+func (r *RoleRequest) validate(creating bool) error {
+	if creating {
+		r.Name = strings.TrimSpace(r.Name)
+		if !roleNamePattern.MatchString(r.Name) {
+			return errors.New("name must be 2-20 lowercase letters, digits or underscores, starting with a letter")
+		}
+	}
+
+	if r.Permissions != nil {
+		seen := map[string]bool{}
+		permissions := []string{}
+		for _, p := range *r.Permissions {
+			if !isValidPermission(p) {
+				return fmt.Errorf("unknown permission %q", p)
+			}
+			if !seen[p] {
+				seen[p] = true
+				permissions = append(permissions, p)
+			}
+		}
+		r.Permissions = &permissions
+	} else if creating {
+		return errors.New("permissions are required")
+	}
+
+	if !creating && r.Description == nil && r.Permissions == nil {
+		return errors.New("no fields to update")
+	}
+
+	return nil
+}
+
+// Check whether a role grants a permission
+func roleHasPermission(role, permission string) (bool, error) {
+	if role == roleSuperAdmin {
+		return true, nil
+	}
+	if !isStaffRole(role) {
+		return false, nil
+	}
+
+	var granted bool
+	err := db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM auth.role_permissions WHERE role_name = $1 AND permission = $2
+		)
+	`, role, permission).Scan(&granted)
+	return granted, err
+}
+
+const roleColumns = `
+	r.name, COALESCE(r.description, ''), r.is_system, r.created_at, r.updated_at,
+	array_to_string(ARRAY(
+		SELECT permission FROM auth.role_permissions p WHERE p.role_name = r.name ORDER BY permission
+	), ','),
+	(SELECT COUNT(*) FROM auth.users u WHERE u.role = r.name)
+`
+
+func scanRole(row rowScanner) (*Role, error) {
+	var role Role
+	var permissions string
+	err := row.Scan(&role.Name, &role.Description, &role.IsSystem, &role.CreatedAt, &role.UpdatedAt, &permissions, &role.UserCount)
+	if err != nil {
+		return nil, err
+	}
+	role.Permissions = splitPermissions(role.Name, permissions)
+	return &role, nil
+}
+
+// Get every role with its permissions and how many users hold it
+func getRoles() ([]Role, error) {
+	rows, err := db.Query(`
+		SELECT ` + roleColumns + `
+		FROM auth.roles r
+		ORDER BY r.is_system DESC, r.name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, *role)
+	}
+
+	return roles, rows.Err()
+}
+
+// Get one role by name
+func getRole(name string) (*Role, error) {
+	role, err := scanRole(db.QueryRow(`
+		SELECT `+roleColumns+`
+		FROM auth.roles r
+		WHERE r.name = $1
+	`, name))
+	if err == sql.ErrNoRows {
+		return nil, errRoleNotFound
+	}
+	return role, err
+}
+
+// Stored permissions as a list; super_admin always lists every permission
+func splitPermissions(role, permissions string) []string {
+	if role == roleSuperAdmin {
+		return allPermissions
+	}
+	if permissions == "" {
+		return []string{}
+	}
+	return strings.Split(permissions, ",")
+}
+
+// Replace a role's permissions inside tx
+func setRolePermissions(tx *sql.Tx, name string, permissions []string) error {
+	if _, err := tx.Exec(`DELETE FROM auth.role_permissions WHERE role_name = $1`, name); err != nil {
+		return err
+	}
+	for _, permission := range permissions {
+		_, err := tx.Exec(`
+			INSERT INTO auth.role_permissions (role_name, permission) VALUES ($1, $2)
+		`, name, permission)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create a custom role
+func createRole(req *RoleRequest) (*Role, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO auth.roles (name, description) VALUES ($1, $2)
+	`, req.Name, req.Description)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setRolePermissions(tx, req.Name, *req.Permissions); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return getRole(req.Name)
+}
+
+// Update a role's description or permissions. The permissions of customer and
+// super_admin are fixed; other built-in roles (like admin) can be edited.
+func updateRole(name string, req *RoleRequest) (*Role, error) {
+	if req.Permissions != nil && (name == roleCustomer || name == roleSuperAdmin) {
+		return nil, errRoleBuiltIn
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE auth.roles SET description = COALESCE($2, description), updated_at = NOW()
+		WHERE name = $1
+	`, name, req.Description)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, errRoleNotFound
+	}
+
+	if req.Permissions != nil {
+		if err := setRolePermissions(tx, name, *req.Permissions); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return getRole(name)
+}
+
+// Delete a custom role that no user holds
+func deleteRole(name string) error {
+	role, err := getRole(name)
+	if err != nil {
+		return err
+	}
+	if role.IsSystem {
+		return errRoleBuiltIn
+	}
+	if role.UserCount > 0 {
+		return errRoleInUse
+	}
+
+	_, err = db.Exec(`DELETE FROM auth.roles WHERE name = $1 AND NOT is_system`, name)
+	if err != nil && strings.Contains(err.Error(), "foreign key") {
+		return errRoleInUse
+	}
+	return err
+}
+
+// Give a user a role and sign them out everywhere, since access tokens carry the role.
+// Admins can't change their own role, so the last super_admin can't demote themselves.
+func assignUserRole(actorID, userID int, role string) (*User, error) {
+	if actorID == userID {
+		return nil, errOwnRoleChange
+	}
+	if _, err := getRole(role); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE auth.users SET role = $1, updated_at = NOW() WHERE id = $2`, role, userID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, errors.New("user not found")
+	}
+
+	if _, err := revokeUserSessions(tx, userID, "role_change", nil); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return getUserForAdmin(userID)
+}
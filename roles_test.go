@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+// TestRoleRequestValidate tests role names, permission checks and de-duplication
+func TestRoleRequestValidate(t *testing.T) {
+	perms := func(p ...string) *[]string { return &p }
+	desc := "Packs orders"
+
+	tests := []struct {
+		name     string
+		req      RoleRequest
+		creating bool
+		wantErr  bool
+	}{
+		{name: "Valid create", req: RoleRequest{Name: "warehouse", Permissions: perms(permOrdersFulfil)}, creating: true},
+		{name: "Create with no permissions", req: RoleRequest{Name: "viewer", Permissions: perms()}, creating: true},
+		{name: "Create without permissions field", req: RoleRequest{Name: "viewer"}, creating: true, wantErr: true},
+		{name: "Uppercase name", req: RoleRequest{Name: "Warehouse", Permissions: perms()}, creating: true, wantErr: true},
+		{name: "Name too short", req: RoleRequest{Name: "w", Permissions: perms()}, creating: true, wantErr: true},
+		{name: "Name too long", req: RoleRequest{Name: "warehouse_night_shift", Permissions: perms()}, creating: true, wantErr: true},
+		{name: "Unknown permission", req: RoleRequest{Name: "warehouse", Permissions: perms("orders:delete")}, creating: true, wantErr: true},
+		{name: "Update description only", req: RoleRequest{Description: &desc}},
+		{name: "Update nothing", req: RoleRequest{}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.req.validate(tt.creating)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	req := RoleRequest{Name: "support", Permissions: perms(permCustomersRead, permCustomersRead, permWalletAdjust)}
+	if err := req.validate(true); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	if got := *req.Permissions; len(got) != 2 || got[0] != permCustomersRead || got[1] != permWalletAdjust {
+		t.Errorf("permissions = %v, want duplicates removed", got)
+	}
+}
+
+// TestRoleHasPermissionBuiltIns tests the built-in roles that never need a lookup
+func TestRoleHasPermissionBuiltIns(t *testing.T) {
+	for _, permission := range allPermissions {
+		if ok, err := roleHasPermission(roleSuperAdmin, permission); err != nil || !ok {
+			t.Errorf("super_admin denied %s (err = %v)", permission, err)
+		}
+		if ok, err := roleHasPermission(roleCustomer, permission); err != nil || ok {
+			t.Errorf("customer granted %s (err = %v)", permission, err)
+		}
+		if ok, err := roleHasPermission("", permission); err != nil || ok {
+			t.Errorf("empty role granted %s (err = %v)", permission, err)
+		}
+	}
+
+	if got := splitPermissions(roleSuperAdmin, ""); len(got) != len(allPermissions) {
+		t.Errorf("super_admin permissions = %v, want all", got)
+	}
+	if got := splitPermissions("warehouse", "orders:fulfil"); len(got) != 1 || got[0] != permOrdersFulfil {
+		t.Errorf("warehouse permissions = %v", got)
+	}
+}
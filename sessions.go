@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Errors returned when a refresh token can't be exchanged
+var (
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	errRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+// AuthTokens is the token pair handed out at login, registration and refresh
+type AuthTokens struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"` // access token lifetime in seconds
+}
+
+// Access token lifetime, from ACCESS_TOKEN_MINUTES (default 15)
+func accessTokenTTL() time.Duration {
+	return time.Duration(getEnvInt("ACCESS_TOKEN_MINUTES", 15)) * time.Minute
+}
+
+// Refresh token lifetime, from REFRESH_TOKEN_DAYS (default 30)
+func refreshTokenTTL() time.Duration {
+	return time.Duration(getEnvInt("REFRESH_TOKEN_DAYS", 30)) * 24 * time.Hour
+}
+
+// Random URL-safe token; only its hash is ever stored
+func generateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// SHA-256 hex digest used to look up opaque tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Start a session for a user and issue its first access and refresh tokens.
+// mfaVerified records that the login passed two-factor authentication.
+func issueSessionTokens(user *User, userAgent, ipAddress string, mfaVerified bool) (*AuthTokens, error) {
+	refreshToken, err := generateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	var sessionID int
+	err = db.QueryRow(`
+		INSERT INTO auth.sessions (user_id, refresh_token_hash, user_agent, ip_address, expires_at, mfa_verified)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`, user.ID, hashToken(refreshToken), userAgent, ipAddress, time.Now().Add(refreshTokenTTL()), mfaVerified).Scan(&sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := generateJWT(user, sessionID, mfaVerified)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthTokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL().Seconds()),
+	}, nil
+}
+
+// Exchange a refresh token for a new token pair. The refresh token is rotated on every use;
+// presenting one that was already rotated revokes the whole session.
+func rotateRefreshToken(refreshToken string) (*AuthTokens, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	tokenHash := hashToken(refreshToken)
+
+	var sessionID, userID int
+	var expiresAt time.Time
+	var revokedAt sql.NullTime
+	var mfaVerified bool
+	err = tx.QueryRow(`
+		SELECT id, user_id, expires_at, revoked_at, mfa_verified
+		FROM auth.sessions
+		WHERE refresh_token_hash = $1
+		FOR UPDATE
+	`, tokenHash).Scan(&sessionID, &userID, &expiresAt, &revokedAt, &mfaVerified)
+
+	if err == sql.ErrNoRows {
+		// An old token from a rotated session means it was copied; shut the session down
+		res, err := tx.Exec(`
+			UPDATE auth.sessions
+			SET revoked_at = NOW(), revoke_reason = 'refresh_token_reuse'
+			WHERE previous_token_hash = $1 AND revoked_at IS NULL
+		`, tokenHash)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			if err := tx.Commit(); err != nil {
+				return nil, err
+			}
+			return nil, errRefreshTokenReused
+		}
+		return nil, errInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		return nil, errInvalidRefreshToken
+	}
+
+	user, err := getUserByID(userID)
+	if err != nil {
+		if err.Error() == "user not found" {
+			return nil, errInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	newRefreshToken, err := generateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE auth.sessions
+		SET refresh_token_hash = $1, previous_token_hash = $2, last_used_at = NOW()
+		WHERE id = $3
+	`, hashToken(newRefreshToken), tokenHash, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	accessToken, err := generateJWT(user, sessionID, mfaVerified)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthTokens{
+		AccessToken:  accessToken,
+		RefreshToken: newRefreshToken,
+		ExpiresIn:    int(accessTokenTTL().Seconds()),
+	}, nil
+}
+
+// Returned when a single-use emailed token is unknown, expired or already used
+var errInvalidUserToken = errors.New("invalid or expired token")
+
+// Issue a single-use token for a user (password reset, email verification).
+// Any earlier unused token for the same purpose stops working.
+func createUserToken(userID int, purpose string, ttl time.Duration) (string, error) {
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE auth.user_tokens SET used_at = NOW()
+		WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL
+	`, userID, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO auth.user_tokens (user_id, purpose, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, userID, purpose, hashToken(token), time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Mark a token used inside tx and return its user; fails if unknown, expired or already used
+func consumeUserToken(tx *sql.Tx, purpose, token string) (int, error) {
+	var userID int
+	err := tx.QueryRow(`
+		UPDATE auth.user_tokens
+		SET used_at = NOW()
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, hashToken(token), purpose).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidUserToken
+	}
+	return userID, err
+}
+
+// Look up the user behind a single-use token without using it up
+func peekUserToken(purpose, token string) (int, error) {
+	var userID int
+	err := db.QueryRow(`
+		SELECT user_id FROM auth.user_tokens
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW()
+	`, hashToken(token), purpose).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidUserToken
+	}
+	return userID, err
+}
+
+// Check that an access token's session has not been revoked or expired
+func isSessionActive(sessionID int) (bool, error) {
+	var active bool
+	err := db.QueryRow(`
+		SELECT revoked_at IS NULL AND expires_at > NOW()
+		FROM auth.sessions
+		WHERE id = $1
+	`, sessionID).Scan(&active)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return active, err
+}
+
+// Revoke one of a user's sessions
+func revokeSession(userID, sessionID int, reason string) error {
+	_, err := db.Exec(`
+		UPDATE auth.sessions
+		SET revoked_at = NOW(), revoke_reason = $3
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, sessionID, userID, reason)
+	return err
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Revoke every active session of a user, optionally keeping the current one.
+// Pass a transaction to revoke atomically with another change (e.g. a password reset).
+func revokeUserSessions(q execer, userID int, reason string, exceptSessionID *int) (int64, error) {
+	res, err := q.Exec(`
+		UPDATE auth.sessions
+		SET revoked_at = NOW(), revoke_reason = $2
+		WHERE user_id = $1 AND revoked_at IS NULL AND ($3::int IS NULL OR id <> $3)
+	`, userID, reason, exceptSessionID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ImageStorage stores uploaded files under a key and serves them from a public URL
+type ImageStorage interface {
+	Save(key string, r io.Reader) (string, error)
+	Delete(key string) error
+}
+
+// Storage backend used by the upload handlers
+var imageStorage ImageStorage
+
+// LocalStorage keeps uploads on the local filesystem
+type LocalStorage struct {
+	Dir     string // directory files are written to
+	BaseURL string // public URL prefix the directory is served from
+}
+
+// Pick the storage backend from STORAGE_DRIVER (only "local" for now)
+func initStorage() {
+	driver := os.Getenv("STORAGE_DRIVER")
+	switch driver {
+	case "", "local":
+		imageStorage = newLocalStorage()
+	default:
+		log.Fatalf("Unknown STORAGE_DRIVER %q", driver)
+	}
+}
+
+// Local storage configured from UPLOAD_DIR and UPLOAD_BASE_URL
+func newLocalStorage() *LocalStorage {
+	dir := os.Getenv("UPLOAD_DIR")
+	if dir == "" {
+		dir = "uploads"
+	}
+
+	baseURL := os.Getenv("UPLOAD_BASE_URL")
+	if baseURL == "" {
+		baseURL = "/uploads"
+	}
+
+	return &LocalStorage{Dir: dir, BaseURL: strings.TrimRight(baseURL, "/")}
+}
+
+// Resolve a storage key to a path inside Dir, rejecting keys that escape it
+func (s *LocalStorage) filePath(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "..") {
+		return "", fmt.Errorf("invalid storage key: %q", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(clean)), nil
+}
+
+func (s *LocalStorage) Save(key string, r io.Reader) (string, error) {
+	dest, err := s.filePath(key)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+
+	// Write to a temp file first so a failed upload never leaves a partial file behind
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return "", err
+	}
+
+	return s.BaseURL + "/" + strings.TrimPrefix(path.Clean("/"+key), "/"), nil
+}
+
+func (s *LocalStorage) Delete(key string) error {
+	dest, err := s.filePath(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLocalStorage tests saving, serving URLs and deleting local uploads
+func TestLocalStorage(t *testing.T) {
+	storage := &LocalStorage{Dir: t.TempDir(), BaseURL: "/uploads"}
+
+	url, err := storage.Save("products/7/abc.png", strings.NewReader("image-bytes"))
+	if err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if url != "/uploads/products/7/abc.png" {
+		t.Errorf("Save() url = %q, want /uploads/products/7/abc.png", url)
+	}
+
+	saved := filepath.Join(storage.Dir, "products", "7", "abc.png")
+	if data, err := os.ReadFile(saved); err != nil || string(data) != "image-bytes" {
+		t.Errorf("saved file = %q, %v", data, err)
+	}
+
+	if err := storage.Delete("products/7/abc.png"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if _, err := os.Stat(saved); !os.IsNotExist(err) {
+		t.Error("file still exists after Delete()")
+	}
+
+	if _, err := storage.Save("../outside.png", strings.NewReader("x")); err == nil {
+		t.Error("Save() with .. in key expected error")
+	}
+}
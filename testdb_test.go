@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+// testRows is a canned result: column names and the rows to return
+type testRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+// testResponder answers a query with canned rows. Returning nil means no rows.
+type testResponder func(query string, args []driver.Value) *testRows
+
+var (
+	testResponders   = map[string]testResponder{}
+	testRespondersMu sync.Mutex
+	testDriverOnce   sync.Once
+)
+
+// useTestDB points db at an in-memory driver that answers queries with respond, so
+// handlers can run through middleware that reads the database. The previous db is
+// restored when the test ends.
+func useTestDB(t *testing.T, respond testResponder) {
+	t.Helper()
+	testDriverOnce.Do(func() {
+		sql.Register("testdb", testDriver{})
+	})
+
+	testRespondersMu.Lock()
+	testResponders[t.Name()] = respond
+	testRespondersMu.Unlock()
+
+	testDB, err := sql.Open("testdb", t.Name())
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+
+	previous := db
+	db = testDB
+	t.Cleanup(func() {
+		db = previous
+		testDB.Close()
+		testRespondersMu.Lock()
+		delete(testResponders, t.Name())
+		testRespondersMu.Unlock()
+	})
+}
+
+type testDriver struct{}
+
+func (testDriver) Open(name string) (driver.Conn, error) {
+	testRespondersMu.Lock()
+	defer testRespondersMu.Unlock()
+	respond, ok := testResponders[name]
+	if !ok {
+		return nil, errors.New("no test responder for " + name)
+	}
+	return &testConn{respond: respond}, nil
+}
+
+type testConn struct {
+	respond testResponder
+}
+
+func (c *testConn) Prepare(query string) (driver.Stmt, error) {
+	return &testStmt{conn: c, query: query}, nil
+}
+
+func (c *testConn) Close() error              { return nil }
+func (c *testConn) Begin() (driver.Tx, error) { return testTx{}, nil }
+
+type testTx struct{}
+
+func (testTx) Commit() error   { return nil }
+func (testTx) Rollback() error { return nil }
+
+type testStmt struct {
+	conn  *testConn
+	query string
+}
+
+func (s *testStmt) Close() error  { return nil }
+func (s *testStmt) NumInput() int { return -1 }
+
+func (s *testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.conn.respond(s.query, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows := s.conn.respond(s.query, args)
+	if rows == nil {
+		rows = &testRows{}
+	}
+	return &testResultRows{rows: rows}, nil
+}
+
+type testResultRows struct {
+	rows *testRows
+	next int
+}
+
+func (r *testResultRows) Columns() []string { return r.rows.columns }
+func (r *testResultRows) Close() error      { return nil }
+
+func (r *testResultRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows.values) {
+		return io.EOF
+	}
+	copy(dest, r.rows.values[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Failed logins allowed before backoff starts, per email and per IP. IPs get more
+// room because offices and mobile carriers put many customers behind one address.
+const (
+	emailFreeLoginAttempts = 3
+	ipFreeLoginAttempts    = 20
+	maxLoginBackoff        = 5 * time.Minute
+)
+
+// Failed logins for one email before the account is locked, from LOGIN_LOCKOUT_THRESHOLD (default 10)
+func loginLockoutThreshold() int {
+	return getEnvInt("LOGIN_LOCKOUT_THRESHOLD", 10)
+}
+
+// How long a lockout lasts, from LOGIN_LOCKOUT_MINUTES (default 15). Failure counts also
+// reset after this long without a failed attempt.
+func loginLockoutDuration() time.Duration {
+	return time.Duration(getEnvInt("LOGIN_LOCKOUT_MINUTES", 15)) * time.Minute
+}
+
+// The client's IP for throttling and sessions. Fiber's c.IP() returns the leftmost
+// X-Forwarded-For entry, which the client can set to anything, so walk the list from the
+// right and take the first address that wasn't added by one of TRUSTED_PROXIES.
+func clientIP(c *fiber.Ctx) string {
+	if !c.IsProxyTrusted() || !strings.EqualFold(c.App().Config().ProxyHeader, fiber.HeaderXForwardedFor) {
+		return c.IP()
+	}
+
+	ips := c.IPs()
+	for i := len(ips) - 1; i >= 0; i-- {
+		if !isTrustedProxy(ips[i], c.App().Config().TrustedProxies) {
+			return ips[i]
+		}
+	}
+	if len(ips) > 0 {
+		return ips[0]
+	}
+	return c.Context().RemoteIP().String()
+}
+
+// Whether ip is one of proxies, given as IPs or CIDR ranges
+func isTrustedProxy(ip string, proxies []string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if _, ipNet, err := net.ParseCIDR(proxy); err == nil {
+			if ipNet.Contains(addr) {
+				return true
+			}
+		} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay before the next attempt after a run of failures: none for the free attempts,
+// then 1s, 2s, 4s, ... capped at maxLoginBackoff
+func loginBackoff(failures, freeAttempts int) time.Duration {
+	over := failures - freeAttempts
+	if over <= 0 {
+		return 0
+	}
+	if over > 20 {
+		return maxLoginBackoff
+	}
+	return min(time.Second<<(over-1), maxLoginBackoff)
+}
+
+// LoginThrottle tells a client it must wait before trying to log in again
+type LoginThrottle struct {
+	RetryAfter time.Duration
+	Locked     bool // the account hit the lockout threshold, not just the backoff
+}
+
+// Throttle keys are case-insensitive for emails
+func loginThrottleKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Throttle rows a login attempt counts against, with the failures each allows before backoff
+func loginThrottleScopes(email, ipAddress string) []struct {
+	scope        string
+	key          string
+	freeAttempts int
+} {
+	return []struct {
+		scope        string
+		key          string
+		freeAttempts int
+	}{
+		{"email", loginThrottleKey(email), emailFreeLoginAttempts},
+		{"ip", ipAddress, ipFreeLoginAttempts},
+	}
+}
+
+// Check whether a login for this email or from this IP is blocked and, if not, count the
+// attempt as a failure before the password is checked. Both rows stay locked from the check
+// to the increment, so concurrent attempts can't all pass the check before any of them is
+// counted. A login that turns out to be good gives the attempt back with releaseLoginAttempt.
+// Returns nil if the attempt may proceed.
+func claimLoginAttempt(email, ipAddress string) (*LoginThrottle, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	scopes := loginThrottleScopes(email, ipAddress)
+	for _, s := range scopes {
+		_, err := tx.Exec(`
+			INSERT INTO auth.login_throttles (scope, key, failed_attempts)
+			VALUES ($1, $2, 0)
+			ON CONFLICT (scope, key) DO NOTHING
+		`, s.scope, s.key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	window := loginLockoutDuration()
+	failures := make([]int, len(scopes))
+	var throttle *LoginThrottle
+	for i, s := range scopes {
+		var lastFailedAt, blockedUntil sql.NullTime
+		err := tx.QueryRow(`
+			SELECT failed_attempts, last_failed_at, blocked_until
+			FROM auth.login_throttles
+			WHERE scope = $1 AND key = $2
+			FOR UPDATE
+		`, s.scope, s.key).Scan(&failures[i], &lastFailedAt, &blockedUntil)
+		if err != nil {
+			return nil, err
+		}
+
+		if blockedUntil.Valid && blockedUntil.Time.After(now) {
+			if throttle == nil {
+				throttle = &LoginThrottle{}
+			}
+			if wait := blockedUntil.Time.Sub(now); wait > throttle.RetryAfter {
+				throttle.RetryAfter = wait
+			}
+			if s.scope == "email" && failures[i] >= loginLockoutThreshold() {
+				throttle.Locked = true
+			}
+		}
+		if !lastFailedAt.Valid || lastFailedAt.Time.Before(now.Add(-window)) {
+			failures[i] = 0
+		}
+	}
+	if throttle != nil {
+		return throttle, tx.Commit()
+	}
+
+	for i, s := range scopes {
+		failures[i]++
+		var blockedUntil *time.Time
+		delay := loginBackoff(failures[i], s.freeAttempts)
+		if s.scope == "email" && failures[i] >= loginLockoutThreshold() {
+			delay = window
+		}
+		if delay > 0 {
+			until := now.Add(delay)
+			blockedUntil = &until
+		}
+
+		_, err := tx.Exec(`
+			UPDATE auth.login_throttles
+			SET failed_attempts = $3, last_failed_at = $4, blocked_until = $5
+			WHERE scope = $1 AND key = $2
+		`, s.scope, s.key, failures[i], now, blockedUntil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, tx.Commit()
+}
+
+// Give back an attempt counted by claimLoginAttempt once the password turns out to be right.
+// The backoff or lockout the claim started is lifted too, since no failure happened.
+func releaseLoginAttempt(email, ipAddress string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, s := range loginThrottleScopes(email, ipAddress) {
+		_, err := tx.Exec(`
+			UPDATE auth.login_throttles
+			SET failed_attempts = GREATEST(failed_attempts - 1, 0), blocked_until = NULL
+			WHERE scope = $1 AND key = $2
+		`, s.scope, s.key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Reset an email's failure count after a successful login and record the login time
+func recordSuccessfulLogin(user *User) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM auth.login_throttles WHERE scope = 'email' AND key = $1`, loginThrottleKey(user.Email))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE auth.users SET last_login = NOW() WHERE id = $1`, user.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Lift a lockout or backoff on a user's account (admin function)
+func unlockUserLogin(actorRole string, userID int) error {
+	user, err := getUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if !canManageAccountStatus(actorRole, user.Role) {
+		return errStaffAccountStatus
+	}
+
+	_, err = db.Exec(`DELETE FROM auth.login_throttles WHERE scope = 'email' AND key = $1`, loginThrottleKey(user.Email))
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TestLoginBackoff tests the free attempts, doubling delay and cap
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		free     int
+		want     time.Duration
+	}{
+		{failures: 0, free: 3, want: 0},
+		{failures: 3, free: 3, want: 0},
+		{failures: 4, free: 3, want: time.Second},
+		{failures: 5, free: 3, want: 2 * time.Second},
+		{failures: 8, free: 3, want: 16 * time.Second},
+		{failures: 12, free: 3, want: 256 * time.Second},
+		{failures: 13, free: 3, want: maxLoginBackoff},
+		{failures: 500, free: 3, want: maxLoginBackoff},
+		{failures: 20, free: 20, want: 0},
+	}
+
+	for _, tt := range tests {
+		if got := loginBackoff(tt.failures, tt.free); got != tt.want {
+			t.Errorf("loginBackoff(%d, %d) = %v, want %v", tt.failures, tt.free, got, tt.want)
+		}
+	}
+}
+
+// TestLoginLockoutSettings tests the lockout defaults and overrides
+func TestLoginLockoutSettings(t *testing.T) {
+	if got := loginLockoutThreshold(); got != 10 {
+		t.Errorf("loginLockoutThreshold() = %d, want 10", got)
+	}
+	if got := loginLockoutDuration(); got != 15*time.Minute {
+		t.Errorf("loginLockoutDuration() = %v, want 15m", got)
+	}
+
+	os.Setenv("LOGIN_LOCKOUT_THRESHOLD", "5")
+	os.Setenv("LOGIN_LOCKOUT_MINUTES", "60")
+	defer os.Unsetenv("LOGIN_LOCKOUT_THRESHOLD")
+	defer os.Unsetenv("LOGIN_LOCKOUT_MINUTES")
+
+	if got := loginLockoutThreshold(); got != 5 {
+		t.Errorf("loginLockoutThreshold() = %d, want 5", got)
+	}
+	if got := loginLockoutDuration(); got != time.Hour {
+		t.Errorf("loginLockoutDuration() = %v, want 1h", got)
+	}
+}
+
+// TestLoginThrottleKey tests that emails are throttled case-insensitively
+func TestLoginThrottleKey(t *testing.T) {
+	if got := loginThrottleKey("  John@Example.COM "); got != "john@example.com" {
+		t.Errorf("loginThrottleKey() = %q, want %q", got, "john@example.com")
+	}
+}
+
+// TestClientIP tests that spoofed X-Forwarded-For entries are skipped
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		proxies   []string
+		forwarded string
+		want      string
+	}{
+		{name: "Single hop", proxies: []string{"0.0.0.0"}, forwarded: "1.2.3.4", want: "1.2.3.4"},
+		{name: "Spoofed entry", proxies: []string{"0.0.0.0"}, forwarded: "6.6.6.6, 1.2.3.4", want: "1.2.3.4"},
+		{name: "Trusted hops", proxies: []string{"0.0.0.0", "10.0.0.0/8"}, forwarded: "6.6.6.6, 1.2.3.4, 10.0.0.2", want: "1.2.3.4"},
+		{name: "Only trusted hops", proxies: []string{"0.0.0.0", "10.0.0.0/8"}, forwarded: "10.0.0.1", want: "10.0.0.1"},
+		{name: "Untrusted peer", proxies: []string{"10.0.0.0/8"}, forwarded: "1.2.3.4", want: "0.0.0.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New(fiber.Config{
+				ProxyHeader:             fiber.HeaderXForwardedFor,
+				EnableTrustedProxyCheck: true,
+				TrustedProxies:          tt.proxies,
+				EnableIPValidation:      true,
+			})
+			app.Get("/", func(c *fiber.Ctx) error {
+				return c.SendString(clientIP(c))
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(fiber.HeaderXForwardedFor, tt.forwarded)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.want {
+				t.Errorf("clientIP() = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
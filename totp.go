@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238 defaults, which every authenticator app supports)
+const (
+	totpDigits        = 6
+	totpPeriod        = 30 // seconds per time step
+	totpSkew          = 1  // steps accepted either side of now, for clock drift
+	recoveryCodeCount = 10
+)
+
+// Errors returned by the second login step and 2FA management
+var (
+	errInvalidMFACode  = errors.New("invalid two-factor code")
+	errMFANotEnabled   = errors.New("two-factor authentication is not enabled")
+	errMFAAlreadyOn    = errors.New("two-factor authentication is already enabled")
+	errMFASetupMissing = errors.New("two-factor setup has not been started")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Random 160-bit TOTP secret, base32 encoded for authenticator apps
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// HOTP value (RFC 4226) for a key and counter, zero-padded to digits
+func hotp(key []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+// Time step a moment falls in
+func totpStep(t time.Time) uint64 {
+	return uint64(t.Unix()) / totpPeriod
+}
+
+// Check a code against a base32 secret and return the time step it matched.
+// Steps at or before lastStep are refused so a code can't be replayed.
+func matchTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := int64(totpStep(now))
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(hotp(key, uint64(step), totpDigits)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// otpauth:// URI that authenticator apps read from a QR code
+func totpProvisioningURI(issuer, account, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// One-time recovery codes like "k3p9x-2mv7q", for when the authenticator is lost
+func generateRecoveryCodes(n int) ([]string, error) {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789" // no 0/o or 1/l/i
+	codes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		for j := range b {
+			b[j] = alphabet[int(b[j])%len(alphabet)]
+		}
+		codes[i] = string(b[:5]) + "-" + string(b[5:])
+	}
+	return codes, nil
+}
+
+// Recovery codes are compared case-insensitively and without the dash
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// Issuer shown in authenticator apps, from TOTP_ISSUER (default "Merch Ke")
+func totpIssuer() string {
+	if issuer := strings.TrimSpace(os.Getenv("TOTP_ISSUER")); issuer != "" {
+		return issuer
+	}
+	return "Merch Ke"
+}
+
+// Whether admin tokens must have passed 2FA, from ADMIN_REQUIRE_2FA (default false)
+func adminRequires2FA() bool {
+	return getEnvBool("ADMIN_REQUIRE_2FA", false)
+}
+
+// How long the login challenge for the second step lasts, from MFA_CHALLENGE_MINUTES (default 5)
+func mfaChallengeTTL() time.Duration {
+	return time.Duration(getEnvInt("MFA_CHALLENGE_MINUTES", 5)) * time.Minute
+}
+
+// Whether a user has finished 2FA enrollment
+func isMFAEnabled(userID int) (bool, error) {
+	var enabled bool
+	err := db.QueryRow(`
+		SELECT enabled_at IS NOT NULL FROM auth.user_mfa WHERE user_id = $1
+	`, userID).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// Start (or restart) enrollment with a new secret. Fails if 2FA is already on.
+func beginMFASetup(userID int) (string, error) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+
+	res, err := db.Exec(`
+		INSERT INTO auth.user_mfa (user_id, totp_secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET totp_secret = EXCLUDED.totp_secret, created_at = NOW()
+		WHERE auth.user_mfa.enabled_at IS NULL
+	`, userID, secret)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", errMFAAlreadyOn
+	}
+
+	return secret, nil
+}
+
+// Check a TOTP code inside tx, recording its step so it can't be used twice
+func verifyTOTPInTx(tx *sql.Tx, userID int, code string, requireEnabled bool) error {
+	var secret string
+	var enabled bool
+	var lastStep sql.NullInt64
+	err := tx.QueryRow(`
+		SELECT totp_secret, enabled_at IS NOT NULL, last_used_step
+		FROM auth.user_mfa
+		WHERE user_id = $1
+		FOR UPDATE
+	`, userID).Scan(&secret, &enabled, &lastStep)
+	if err == sql.ErrNoRows {
+		if requireEnabled {
+			return errMFANotEnabled
+		}
+		return errMFASetupMissing
+	}
+	if err != nil {
+		return err
+	}
+	if requireEnabled && !enabled {
+		return errMFANotEnabled
+	}
+	if !requireEnabled && enabled {
+		return errMFAAlreadyOn
+	}
+
+	last := int64(-1)
+	if lastStep.Valid {
+		last = lastStep.Int64
+	}
+	step, ok := matchTOTP(secret, code, time.Now(), last)
+	if !ok {
+		return errInvalidMFACode
+	}
+
+	_, err = tx.Exec(`UPDATE auth.user_mfa SET last_used_step = $1 WHERE user_id = $2`, step, userID)
+	return err
+}
+
+// Use up one recovery code inside tx
+func useRecoveryCodeInTx(tx *sql.Tx, userID int, code string) error {
+	res, err := tx.Exec(`
+		UPDATE auth.mfa_recovery_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errInvalidMFACode
+	}
+	return nil
+}
+
+// Check either a TOTP code or a recovery code for a user with 2FA on.
+// Recovery codes only exist while 2FA is enabled.
+func verifySecondFactor(tx *sql.Tx, userID int, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		return useRecoveryCodeInTx(tx, userID, recoveryCode)
+	}
+	return verifyTOTPInTx(tx, userID, code, true)
+}
+
+// Finish enrollment with a code from the app. Returns fresh recovery codes (shown once)
+// and marks the current session as having passed 2FA.
+func enableMFA(userID, sessionID int, code string) ([]string, error) {
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := verifyTOTPInTx(tx, userID, code, false); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`UPDATE auth.user_mfa SET enabled_at = NOW() WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM auth.mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+	for _, c := range codes {
+		_, err := tx.Exec(`
+			INSERT INTO auth.mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)
+		`, userID, hashToken(normalizeRecoveryCode(c)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE auth.sessions SET mfa_verified = true WHERE id = $1 AND user_id = $2`, sessionID, userID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Turn 2FA off after checking a current code or recovery code
+func disableMFA(userID int, code, recoveryCode string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := verifySecondFactor(tx, userID, code, recoveryCode); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM auth.mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM auth.user_mfa WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	// Refreshed tokens should no longer claim 2FA
+	if _, err := tx.Exec(`UPDATE auth.sessions SET mfa_verified = false WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Second login step: check the code and use up the challenge from the password step.
+// A wrong code leaves the challenge usable so the user can retry until it expires.
+func completeMFALogin(challenge string, userID int, code, recoveryCode string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	challengeUserID, err := consumeUserToken(tx, "mfa_challenge", challenge)
+	if err != nil {
+		return err
+	}
+	if challengeUserID != userID {
+		return errInvalidUserToken
+	}
+
+	if err := verifySecondFactor(tx, userID, code, recoveryCode); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHOTPRFC6238Vectors checks the SHA-1 test vectors from RFC 6238 Appendix B
+func TestHOTPRFC6238Vectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, tt := range tests {
+		step := totpStep(time.Unix(tt.unix, 0))
+		if got := hotp(key, step, 8); got != tt.want {
+			t.Errorf("hotp(T=%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+// TestMatchTOTP tests clock skew, replay protection and malformed input
+func TestMatchTOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+	now := time.Unix(1111111111, 0)
+	step := int64(totpStep(now))
+
+	current := hotp(key, uint64(step), totpDigits)
+	previous := hotp(key, uint64(step-1), totpDigits)
+	tooOld := hotp(key, uint64(step-3), totpDigits)
+
+	if got, ok := matchTOTP(secret, current, now, -1); !ok || got != step {
+		t.Errorf("matchTOTP(current) = %d, %v; want %d, true", got, ok, step)
+	}
+	if _, ok := matchTOTP(strings.ToLower(secret), previous, now, -1); !ok {
+		t.Error("matchTOTP() rejected a code from the previous step")
+	}
+	if _, ok := matchTOTP(secret, tooOld, now, -1); ok {
+		t.Error("matchTOTP() accepted a code three steps old")
+	}
+	if _, ok := matchTOTP(secret, current, now, step); ok {
+		t.Error("matchTOTP() accepted a replayed code")
+	}
+	if _, ok := matchTOTP(secret, "12345", now, -1); ok {
+		t.Error("matchTOTP() accepted a short code")
+	}
+	if _, ok := matchTOTP("not base32!", current, now, -1); ok {
+		t.Error("matchTOTP() accepted an invalid secret")
+	}
+}
+
+// TestTOTPProvisioningURI tests the otpauth URI read by authenticator apps
+func TestTOTPProvisioningURI(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatalf("generateTOTPSecret() error = %v", err)
+	}
+	if len(secret) != 32 {
+		t.Errorf("secret length = %d, want 32", len(secret))
+	}
+
+	uri := totpProvisioningURI("Merch Ke", "admin@merch.ke", secret)
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatalf("url.Parse() error = %v", err)
+	}
+
+	if parsed.Scheme != "otpauth" || parsed.Host != "totp" {
+		t.Errorf("uri = %s, want otpauth://totp/...", uri)
+	}
+	if parsed.Path != "/Merch Ke:admin@merch.ke" {
+		t.Errorf("label = %q", parsed.Path)
+	}
+	query := parsed.Query()
+	if query.Get("secret") != secret || query.Get("issuer") != "Merch Ke" || query.Get("digits") != "6" {
+		t.Errorf("query = %v", query)
+	}
+}
+
+// TestRecoveryCodes tests recovery code format and normalisation
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		t.Fatalf("generateRecoveryCodes() error = %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("code %q, want xxxxx-xxxxx", code)
+		}
+		if seen[code] {
+			t.Errorf("duplicate code %q", code)
+		}
+		seen[code] = true
+	}
+
+	if normalizeRecoveryCode(" K3P9X-2MV7Q ") != normalizeRecoveryCode("k3p9x2mv7q") {
+		t.Error("normalizeRecoveryCode() should ignore case, spaces and the dash")
+	}
+}